@@ -33,6 +33,11 @@ The lightweight, thin Go port scanning tool
 func ScanInfo(c *cli.Context) {
 	// TODO: Align the output
 	fmt.Println(strings.Repeat("=", 80))
+	if c.Path("resume") != "" {
+		fmt.Printf("[+] Resuming: %s\n", c.Path("resume"))
+		fmt.Println(strings.Repeat("=", 80))
+		return
+	}
 	fmt.Printf("[+] Target: %s\n", c.String("target"))
 	if c.String("ports") == "" {
 		fmt.Println("[+] Ports: Top 1000")
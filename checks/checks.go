@@ -0,0 +1,256 @@
+// The checks package runs declarative YAML checks against open ports: payloads to send, and matchers
+// and extractors applied to what comes back.
+package checks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Severities are the severities a check can report
+var Severities = []string{"info", "low", "medium", "high", "critical"}
+
+// Check is a parsed check file
+type Check struct {
+	ID          string `yaml:"id"`
+	Name        string `yaml:"name"`
+	Severity    string `yaml:"severity"`
+	Description string `yaml:"description"`
+	// Ports and Services select the open ports the check runs against. A port matching either is enough,
+	// and a check with neither runs against every open port of its protocol
+	Ports    []uint16 `yaml:"ports"`
+	Services []string `yaml:"services"`
+	// Protocol is tcp or udp, tcp by default
+	Protocol string `yaml:"protocol"`
+	// TLS forces TLS on or off. When it's not given TLS is used on ports found wrapped in TLS
+	TLS *bool `yaml:"tls"`
+
+	// A check either sends raw payloads or makes an HTTP request
+	Steps []*Step      `yaml:"steps"`
+	HTTP  *HTTPRequest `yaml:"http"`
+
+	// Matchers decide whether the check found what it's looking for. All of them have to match when
+	// Condition is "and", and any of them when it's "or", the default
+	Condition  string       `yaml:"matchers-condition"`
+	Matchers   []*Matcher   `yaml:"matchers"`
+	Extractors []*Extractor `yaml:"extractors"`
+}
+
+// Step sends a payload and reads the reply
+type Step struct {
+	// Send is sent as is, Hex is hex decoded first
+	Send string `yaml:"send"`
+	Hex  string `yaml:"hex"`
+	// ReadSize is the most that's read after sending, 4096 bytes by default
+	ReadSize int `yaml:"read-size"`
+
+	data []byte
+}
+
+// HTTPRequest is the request an HTTP check sends
+type HTTPRequest struct {
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+}
+
+// Load parses and validates a check file
+func Load(path string) (*Check, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading check: %w", err)
+	}
+
+	check, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing check %s: %w", path, err)
+	}
+	return check, nil
+}
+
+// LoadDir parses every .yaml and .yml file in dir, or the single check dir points to
+func LoadDir(dir string) ([]*Check, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading checks: %w", err)
+	}
+	paths := []string{dir}
+	if info.IsDir() {
+		paths = nil
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return nil, fmt.Errorf("error listing checks: %w", err)
+			}
+			paths = append(paths, matches...)
+		}
+		slices.Sort(paths)
+	}
+
+	var checks []*Check
+	for _, path := range paths {
+		check, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(checks, func(c *Check) bool { return c.ID == check.ID }) {
+			return nil, fmt.Errorf("duplicate check id '%s' in %s", check.ID, path)
+		}
+		checks = append(checks, check)
+	}
+
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("no checks found in %s", dir)
+	}
+	return checks, nil
+}
+
+// Parse parses and validates a check
+func Parse(data []byte) (*Check, error) {
+	check := &Check{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(check); err != nil {
+		return nil, err
+	}
+
+	if check.ID == "" {
+		return nil, errors.New("missing id")
+	}
+	if check.Name == "" {
+		check.Name = check.ID
+	}
+	if check.Severity == "" {
+		check.Severity = "info"
+	}
+	if !slices.Contains(Severities, check.Severity) {
+		return nil, fmt.Errorf("unknown severity '%s', expected one of %s", check.Severity, strings.Join(Severities, ", "))
+	}
+	if check.Protocol == "" {
+		check.Protocol = "tcp"
+	}
+	if check.Protocol != "tcp" && check.Protocol != "udp" {
+		return nil, fmt.Errorf("unknown protocol '%s', expected tcp or udp", check.Protocol)
+	}
+
+	switch {
+	case check.HTTP != nil && len(check.Steps) > 0:
+		return nil, errors.New("a check either has steps or an http request, not both")
+	case check.HTTP != nil:
+		if check.Protocol != "tcp" {
+			return nil, errors.New("http checks only run over tcp")
+		}
+		if check.HTTP.Method == "" {
+			check.HTTP.Method = "GET"
+		}
+		if !strings.HasPrefix(check.HTTP.Path, "/") {
+			check.HTTP.Path = "/" + check.HTTP.Path
+		}
+	default:
+		// A check without steps still reads what the service sends on connect
+		if len(check.Steps) == 0 {
+			check.Steps = []*Step{{}}
+		}
+		for _, step := range check.Steps {
+			if err := step.compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if check.Condition == "" {
+		check.Condition = "or"
+	}
+	if check.Condition != "and" && check.Condition != "or" {
+		return nil, fmt.Errorf("unknown matchers-condition '%s', expected and or or", check.Condition)
+	}
+	if len(check.Matchers) == 0 {
+		return nil, errors.New("missing matchers")
+	}
+	for _, matcher := range check.Matchers {
+		if err := matcher.compile(check.HTTP != nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, extractor := range check.Extractors {
+		if err := extractor.compile(check.HTTP != nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return check, nil
+}
+
+// compile decodes the payload of the step
+func (s *Step) compile() error {
+	if s.Send != "" && s.Hex != "" {
+		return errors.New("a step either sends text or hex, not both")
+	}
+	s.data = []byte(s.Send)
+	if s.Hex != "" {
+		data, err := hex.DecodeString(strings.Join(strings.Fields(s.Hex), ""))
+		if err != nil {
+			return fmt.Errorf("invalid hex payload: %w", err)
+		}
+		s.data = data
+	}
+
+	if s.ReadSize == 0 {
+		s.ReadSize = 4096
+	}
+	if s.ReadSize < 0 {
+		return fmt.Errorf("invalid read-size %d", s.ReadSize)
+	}
+	return nil
+}
+
+// compilePatterns compiles the regular expressions of a matcher or an extractor
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex '%s': %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// checkPart validates the part of the response a matcher or an extractor looks at
+func checkPart(part *string, isHTTP bool) error {
+	if *part == "" {
+		*part = "body"
+		if !isHTTP {
+			*part = "all"
+		}
+	}
+	switch {
+	case *part == "all":
+		return nil
+	case isHTTP && (*part == "body" || *part == "header"):
+		return nil
+	}
+	return fmt.Errorf("unknown part '%s'", *part)
+}
+
+// AppliesTo returns true if the check runs against an open port with the given protocol, number and service
+func (c *Check) AppliesTo(protocol string, port uint16, service string) bool {
+	if protocol != c.Protocol {
+		return false
+	}
+	if len(c.Ports) == 0 && len(c.Services) == 0 {
+		return true
+	}
+	return slices.Contains(c.Ports, port) || slices.Contains(c.Services, strings.TrimPrefix(service, "ssl/"))
+}
@@ -0,0 +1,195 @@
+package checks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Matcher tests the response for words, regular expressions, bytes or HTTP status codes
+type Matcher struct {
+	// Type is word, regex, binary or status
+	Type string `yaml:"type"`
+	// Part is what the matcher looks at: the body, the header or all of an HTTP response, which is the body
+	// by default. Raw responses only have all
+	Part   string   `yaml:"part"`
+	Words  []string `yaml:"words"`
+	Regex  []string `yaml:"regex"`
+	Binary []string `yaml:"binary"`
+	Status []int    `yaml:"status"`
+	// Condition is "and" when every word, pattern or status has to match, and "or", the default, when any may
+	Condition       string `yaml:"condition"`
+	Negative        bool   `yaml:"negative"`
+	CaseInsensitive bool   `yaml:"case-insensitive"`
+
+	patterns []*regexp.Regexp
+	binary   [][]byte
+}
+
+// Extractor pulls values out of the response of a check that matched, to show alongside it
+type Extractor struct {
+	// Type is regex, the only kind of extractor
+	Type string `yaml:"type"`
+	Name string `yaml:"name"`
+	Part string `yaml:"part"`
+	// Regex are the patterns whose matches are extracted. Group picks the capture group, the whole match by default
+	Regex []string `yaml:"regex"`
+	Group int      `yaml:"group"`
+
+	patterns []*regexp.Regexp
+}
+
+// response is what a check got back
+type response struct {
+	// data is the raw response, or the header and body of an HTTP response
+	data   []byte
+	header []byte
+	body   []byte
+	status int
+}
+
+// part returns the part of the response a matcher or an extractor looks at
+func (r *response) part(name string) []byte {
+	switch name {
+	case "header":
+		return r.header
+	case "body":
+		return r.body
+	}
+	return r.data
+}
+
+// compile validates the matcher and compiles its patterns
+func (m *Matcher) compile(isHTTP bool) error {
+	if err := checkPart(&m.Part, isHTTP); err != nil {
+		return err
+	}
+	if m.Condition == "" {
+		m.Condition = "or"
+	}
+	if m.Condition != "and" && m.Condition != "or" {
+		return fmt.Errorf("unknown matcher condition '%s', expected and or or", m.Condition)
+	}
+
+	var err error
+	switch m.Type {
+	case "word":
+		if len(m.Words) == 0 {
+			return errors.New("word matcher without words")
+		}
+	case "regex":
+		patterns := m.Regex
+		if m.CaseInsensitive {
+			patterns = nil
+			for _, pattern := range m.Regex {
+				patterns = append(patterns, "(?i)"+pattern)
+			}
+		}
+		if m.patterns, err = compilePatterns(patterns); err != nil {
+			return err
+		}
+		if len(m.patterns) == 0 {
+			return errors.New("regex matcher without patterns")
+		}
+	case "binary":
+		for _, value := range m.Binary {
+			data, err := hex.DecodeString(strings.Join(strings.Fields(value), ""))
+			if err != nil {
+				return fmt.Errorf("invalid binary matcher '%s': %w", value, err)
+			}
+			m.binary = append(m.binary, data)
+		}
+		if len(m.binary) == 0 {
+			return errors.New("binary matcher without values")
+		}
+	case "status":
+		if !isHTTP {
+			return errors.New("status matchers only work on http checks")
+		}
+		if len(m.Status) == 0 {
+			return errors.New("status matcher without status codes")
+		}
+	default:
+		return fmt.Errorf("unknown matcher type '%s', expected word, regex, binary or status", m.Type)
+	}
+	return nil
+}
+
+// match returns true if the matcher matches the response
+func (m *Matcher) match(r *response) bool {
+	data := r.part(m.Part)
+
+	var results []bool
+	switch m.Type {
+	case "word":
+		for _, word := range m.Words {
+			if m.CaseInsensitive {
+				results = append(results, bytes.Contains(bytes.ToLower(data), []byte(strings.ToLower(word))))
+			} else {
+				results = append(results, bytes.Contains(data, []byte(word)))
+			}
+		}
+	case "regex":
+		for _, pattern := range m.patterns {
+			results = append(results, pattern.Match(data))
+		}
+	case "binary":
+		for _, value := range m.binary {
+			results = append(results, bytes.Contains(data, value))
+		}
+	case "status":
+		results = append(results, slices.Contains(m.Status, r.status))
+	}
+
+	return combine(m.Condition, results) != m.Negative
+}
+
+// combine returns whether all (for "and") or any (for "or") of the results are true
+func combine(condition string, results []bool) bool {
+	if condition == "and" {
+		return !slices.Contains(results, false)
+	}
+	return slices.Contains(results, true)
+}
+
+// compile validates the extractor and compiles its patterns
+func (e *Extractor) compile(isHTTP bool) error {
+	if e.Type != "regex" {
+		return fmt.Errorf("unknown extractor type '%s', expected regex", e.Type)
+	}
+	if err := checkPart(&e.Part, isHTTP); err != nil {
+		return err
+	}
+
+	var err error
+	if e.patterns, err = compilePatterns(e.Regex); err != nil {
+		return err
+	}
+	if len(e.patterns) == 0 {
+		return errors.New("regex extractor without patterns")
+	}
+	for _, pattern := range e.patterns {
+		if e.Group < 0 || e.Group > pattern.NumSubexp() {
+			return fmt.Errorf("regex '%s' has no group %d", pattern, e.Group)
+		}
+	}
+	return nil
+}
+
+// extract returns the distinct values the extractor finds in the response, in order
+func (e *Extractor) extract(r *response) []string {
+	var values []string
+	for _, pattern := range e.patterns {
+		for _, match := range pattern.FindAllSubmatch(r.part(e.Part), -1) {
+			value := strings.TrimSpace(string(match[e.Group]))
+			if value != "" && !slices.Contains(values, value) {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
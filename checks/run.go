@@ -0,0 +1,254 @@
+package checks
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/scanner"
+	"github.com/0niSec/gomap/services"
+)
+
+// maxResponseSize is how much of a response is kept for matching
+const maxResponseSize = 1024 * 1024
+
+// Options controls a check scan
+type Options struct {
+	Checks []*Check
+	// Workers is how many checks run at once
+	Workers int
+	// Timeout bounds connecting, every read and HTTP requests as a whole
+	Timeout time.Duration
+}
+
+// job is a check to run against an open port
+type job struct {
+	check      *Check
+	host, port int
+}
+
+// Run runs the checks against every open port they apply to and attaches the ones that matched to the results
+func Run(ctx context.Context, hosts []scanner.HostResult, opts Options) {
+	var jobs []job
+	for h, host := range hosts {
+		for p, port := range host.Ports {
+			if port.State != "open" {
+				continue
+			}
+			for _, check := range opts.Checks {
+				if check.AppliesTo(port.Protocol, port.Port, port.Service) {
+					jobs = append(jobs, job{check: check, host: h, port: p})
+				}
+			}
+		}
+	}
+
+	workers := opts.Workers
+	if workers <= 0 || workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	// Every job writes its own slot, and the matches are attached in order once they're all done
+	results := make([]*scanner.CheckResult, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				host := hosts[jobs[i].host]
+				result, err := jobs[i].check.run(ctx, host.IP, host.Ports[jobs[i].port], opts.Timeout)
+				if err != nil {
+					logger.Debug("Check failed", "check", jobs[i].check.ID, "host", host.IP, "port", host.Ports[jobs[i].port].Port, "err", err)
+					continue
+				}
+				results[i] = result
+			}
+		}()
+	}
+	for i := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i, job := range jobs {
+		if results[i] != nil {
+			port := &hosts[job.host].Ports[job.port]
+			port.Checks = append(port.Checks, *results[i])
+		}
+	}
+}
+
+// run runs the check against a port and returns its result, or nil if it didn't match
+func (c *Check) run(ctx context.Context, ip string, port scanner.PortResult, timeout time.Duration) (*scanner.CheckResult, error) {
+	address := net.JoinHostPort(ip, strconv.Itoa(int(port.Port)))
+
+	useTLS := port.Service == "https" || strings.HasPrefix(port.Service, "ssl/") || (port.ServiceVersion != nil && port.TLS != nil)
+	if c.TLS != nil {
+		useTLS = *c.TLS
+	}
+
+	var resp *response
+	var err error
+	if c.HTTP != nil {
+		resp, err = c.sendHTTP(ctx, address, useTLS, timeout)
+	} else {
+		resp, err = c.sendSteps(address, useTLS, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var results []bool
+	for _, matcher := range c.Matchers {
+		results = append(results, matcher.match(resp))
+	}
+	if !combine(c.Condition, results) {
+		return nil, nil
+	}
+
+	result := &scanner.CheckResult{ID: c.ID, Name: c.Name, Severity: c.Severity}
+	for _, extractor := range c.Extractors {
+		values := extractor.extract(resp)
+		if len(values) == 0 {
+			continue
+		}
+		name := extractor.Name
+		if name == "" {
+			name = "extracted"
+		}
+		if result.Extracted == nil {
+			result.Extracted = make(map[string][]string)
+		}
+		result.Extracted[name] = append(result.Extracted[name], values...)
+	}
+	return result, nil
+}
+
+// sendSteps connects to address, sends the payload of every step and reads the reply to each one.
+// The replies are joined into a single response.
+func (c *Check) sendSteps(address string, useTLS bool, timeout time.Duration) (*response, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if c.Protocol == "tcp" && useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, services.TLSConfig())
+	} else {
+		conn, err = dialer.Dial(c.Protocol, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting: %w", err)
+	}
+	defer conn.Close()
+
+	resp := &response{}
+	for _, step := range c.Steps {
+		if len(step.data) > 0 {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := conn.Write(step.data); err != nil {
+				return nil, fmt.Errorf("error sending payload: %w", err)
+			}
+		}
+
+		reply, err := readReply(conn, step.ReadSize, timeout)
+		resp.data = append(resp.data, reply...)
+		if err != nil || len(resp.data) >= maxResponseSize {
+			// The service closed the connection or stopped answering, so later steps would get nothing
+			break
+		}
+	}
+	return resp, nil
+}
+
+// readReply reads up to size bytes. It stops early once the service closes the connection,
+// or goes quiet after the first bytes of the reply arrived.
+func readReply(conn net.Conn, size int, timeout time.Duration) ([]byte, error) {
+	var reply []byte
+	buffer := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for len(reply) < size {
+		n, err := conn.Read(buffer[:min(len(buffer), size-len(reply))])
+		reply = append(reply, buffer[:n]...)
+		if err != nil {
+			if len(reply) > 0 && isTimeout(err) {
+				return reply, nil
+			}
+			return reply, err
+		}
+		// The rest of a reply arrives right behind its first bytes
+		conn.SetReadDeadline(time.Now().Add(min(timeout, 500*time.Millisecond)))
+	}
+	return reply, nil
+}
+
+// isTimeout returns true if err is a read deadline passing
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// sendHTTP sends the HTTP request of the check without following redirects
+func (c *Check) sendHTTP(ctx context.Context, address string, useTLS bool, timeout time.Duration) (*response, error) {
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	req, err := http.NewRequestWithContext(ctx, c.HTTP.Method, scheme+"://"+address+c.HTTP.Path, strings.NewReader(c.HTTP.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; gomap)")
+	req.Header.Set("Accept", "*/*")
+	for name, value := range c.HTTP.Headers {
+		req.Header.Set(name, value)
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// Never send scan traffic through a proxy from the environment
+			Proxy:             nil,
+			DialContext:       (&net.Dialer{Timeout: timeout}).DialContext,
+			TLSClientConfig:   services.TLSConfig(),
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %w", err)
+	}
+	header, err := httputil.DumpResponse(httpResp, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &response{
+		data:   append(append([]byte{}, header...), body...),
+		header: header,
+		body:   body,
+		status: httpResp.StatusCode,
+	}, nil
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// srvServices are the SRV records looked up for a domain, the services that tend to live on their own hosts
+var srvServices = []string{
+	"_ldap._tcp", "_gc._tcp", "_kerberos._tcp", "_kerberos._udp", "_kpasswd._tcp",
+	"_sip._tcp", "_sip._udp", "_sips._tcp", "_xmpp-client._tcp", "_xmpp-server._tcp", "_matrix._tcp",
+	"_imap._tcp", "_imaps._tcp", "_pop3s._tcp", "_submission._tcp", "_autodiscover._tcp",
+	"_caldavs._tcp", "_carddavs._tcp", "_vlmcs._tcp", "_h323cs._tcp",
+}
+
+// Related is a host named in the DNS records of a domain
+type Related struct {
+	Name string
+	// Record is the record the host was named in, like MX or SRV _ldap._tcp
+	Record string
+}
+
+// LookupRelated returns the hosts named by the MX, NS and common SRV records of a domain, all looked up at once.
+// Records the domain doesn't have are skipped.
+func (r *Resolver) LookupRelated(ctx context.Context, domain string) []Related {
+	var mu sync.Mutex
+	var related []Related
+	add := func(record string, names ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, name := range names {
+			// A null MX or an SRV target of "." means there's no such service
+			if name = strings.TrimSuffix(name, "."); name != "" {
+				related = append(related, Related{Name: name, Record: record})
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	lookup := func(f func(ctx context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+			defer cancel()
+			f(ctx)
+		}()
+	}
+
+	lookup(func(ctx context.Context) {
+		records, _ := r.resolver.LookupMX(ctx, domain)
+		for _, mx := range records {
+			add("MX", mx.Host)
+		}
+	})
+	lookup(func(ctx context.Context) {
+		records, _ := r.resolver.LookupNS(ctx, domain)
+		for _, ns := range records {
+			add("NS", ns.Host)
+		}
+	})
+	for _, service := range srvServices {
+		lookup(func(ctx context.Context) {
+			_, records, _ := r.resolver.LookupSRV(ctx, "", "", service+"."+domain)
+			for _, srv := range records {
+				add("SRV "+service, srv.Target)
+			}
+		})
+	}
+	wg.Wait()
+
+	// The lookups finish in any order, so the hosts are put back in the order of the records above
+	rank := map[string]int{"MX": 0, "NS": 1}
+	for i, service := range srvServices {
+		rank["SRV "+service] = i + 2
+	}
+	sort.SliceStable(related, func(i, j int) bool { return rank[related[i].Record] < rank[related[j].Record] })
+
+	seen := make(map[Related]bool)
+	unique := related[:0]
+	for _, rel := range related {
+		if !seen[rel] {
+			seen[rel] = true
+			unique = append(unique, rel)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,152 @@
+// Package dns resolves the names of targets and the hosts found by the scan, either with the system resolver
+// or by asking DNS servers directly, like split-horizon servers the scanning host doesn't use by default
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0niSec/gomap/logger"
+)
+
+const (
+	// lookupTimeout bounds every lookup, so a dead server doesn't hold up the scan
+	lookupTimeout = 2 * time.Second
+	// maxReverseLookups is how many reverse lookups run at once
+	maxReverseLookups = 32
+)
+
+// Resolver looks up the addresses of names and the names of addresses. Reverse lookups are cached, and can be
+// started ahead of time so the names are ready by the time the hosts are reported.
+type Resolver struct {
+	resolver *net.Resolver
+
+	mu      sync.Mutex
+	reverse map[string]*reverseLookup
+	slots   chan struct{}
+}
+
+// reverseLookup is a reverse lookup, done once done is closed
+type reverseLookup struct {
+	done chan struct{}
+	name string
+}
+
+// NewResolver returns a resolver using the system resolver when system is true. Otherwise it asks DNS servers
+// directly: the servers given, each an IP with an optional port, or the ones in /etc/resolv.conf.
+func NewResolver(system bool, servers []string) (*Resolver, error) {
+	if system && len(servers) > 0 {
+		return nil, fmt.Errorf("DNS servers can't be given with the system resolver")
+	}
+
+	r := &Resolver{
+		resolver: &net.Resolver{PreferGo: !system},
+		reverse:  make(map[string]*reverseLookup),
+		slots:    make(chan struct{}, maxReverseLookups),
+	}
+	if len(servers) == 0 {
+		return r, nil
+	}
+
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		addr, err := serverAddr(server)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = addr
+	}
+
+	// Every query goes to the next server, so a retry after a timeout asks another one
+	var next atomic.Uint32
+	dialer := net.Dialer{Timeout: lookupTimeout}
+	r.resolver.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		addr := addrs[int(next.Add(1)-1)%len(addrs)]
+		return dialer.DialContext(ctx, network, addr)
+	}
+	logger.Debug("Using DNS servers", "servers", addrs)
+	return r, nil
+}
+
+// serverAddr returns the address of a DNS server given as an IP, with port 53 unless it has its own
+func serverAddr(server string) (string, error) {
+	server = strings.TrimSpace(server)
+	if host, port, err := net.SplitHostPort(server); err == nil {
+		if net.ParseIP(host) == nil {
+			return "", fmt.Errorf("invalid DNS server '%s', expected an IP address", server)
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	if net.ParseIP(server) == nil {
+		return "", fmt.Errorf("invalid DNS server '%s', expected an IP address", server)
+	}
+	return net.JoinHostPort(server, "53"), nil
+}
+
+// LookupIP returns the addresses of a name
+func (r *Resolver) LookupIP(ctx context.Context, name string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	return r.resolver.LookupIP(ctx, "ip", name)
+}
+
+// Prefetch starts the reverse lookups of the addresses in the background, at most [maxReverseLookups] at once
+func (r *Resolver) Prefetch(ips []string) {
+	for _, ip := range ips {
+		r.start(ip)
+	}
+}
+
+// LookupAddr returns the name of an address, or an empty string if it has none. It waits for the lookup
+// [Prefetch] started, if any.
+func (r *Resolver) LookupAddr(ip string) string {
+	lookup := r.start(ip)
+	<-lookup.done
+	return lookup.name
+}
+
+// LookupAddrs looks up the names of the addresses concurrently and returns the ones that have a name
+func (r *Resolver) LookupAddrs(ips []string) map[string]string {
+	r.Prefetch(ips)
+	names := make(map[string]string)
+	for _, ip := range ips {
+		if name := r.LookupAddr(ip); name != "" {
+			names[ip] = name
+		}
+	}
+	return names
+}
+
+// start returns the reverse lookup of an address, starting it unless it already was
+func (r *Resolver) start(ip string) *reverseLookup {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if lookup, ok := r.reverse[ip]; ok {
+		return lookup
+	}
+
+	lookup := &reverseLookup{done: make(chan struct{})}
+	r.reverse[ip] = lookup
+	go func() {
+		defer close(lookup.done)
+		r.slots <- struct{}{}
+		defer func() { <-r.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		names, err := r.resolver.LookupAddr(ctx, ip)
+		if err != nil {
+			logger.Debug("Reverse DNS lookup failed", "ip", ip, "err", err)
+			return
+		}
+		if len(names) > 0 {
+			lookup.name = strings.TrimSuffix(names[0], ".")
+		}
+	}()
+	return lookup
+}
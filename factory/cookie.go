@@ -0,0 +1,37 @@
+package factory
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// NewCookieKey generates a random key for [SYNCookie].
+// A new key should be used for every scan so replies to an earlier scan are never accepted.
+func NewCookieKey() ([]byte, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating SYN cookie key: %w", err)
+	}
+
+	return key, nil
+}
+
+// SYNCookie returns the sequence number to use for a SYN probe to dstIP:dstPort.
+//
+// The cookie is a keyed hash (HMAC-SHA256) of the destination, so a reply can be validated without keeping any
+// state about the probe: a genuine SYN/ACK or RST acknowledges the cookie, meaning its Ack is SYNCookie(...) + 1.
+func SYNCookie(key []byte, dstIP net.IP, dstPort uint16) uint32 {
+	mac := hmac.New(sha256.New, key)
+
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, dstPort)
+
+	mac.Write(dstIP.To16())
+	mac.Write(port)
+
+	return binary.BigEndian.Uint32(mac.Sum(nil)[:4])
+}
@@ -0,0 +1,54 @@
+package factory
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSYNCookie(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	otherKey := []byte("fedcba9876543210")
+	ip := net.ParseIP("192.0.2.10")
+	cookie := SYNCookie(key, ip, 443)
+
+	tests := []struct {
+		name   string
+		key    []byte
+		ip     net.IP
+		port   uint16
+		sameAs bool
+	}{
+		{"same destination", key, net.ParseIP("192.0.2.10"), 443, true},
+		{"4-byte form of the same address", key, net.IPv4(192, 0, 2, 10).To4(), 443, true},
+		{"other port", key, ip, 444, false},
+		{"other address", key, net.ParseIP("192.0.2.11"), 443, false},
+		{"other key", otherKey, ip, 443, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := SYNCookie(test.key, test.ip, test.port)
+			if (got == cookie) != test.sameAs {
+				t.Errorf("SYNCookie() = %#x, cookie of 192.0.2.10:443 = %#x, want same: %v", got, cookie, test.sameAs)
+			}
+		})
+	}
+}
+
+func TestNewCookieKey(t *testing.T) {
+	first, err := NewCookieKey()
+	if err != nil {
+		t.Fatalf("NewCookieKey() error = %v", err)
+	}
+	second, err := NewCookieKey()
+	if err != nil {
+		t.Fatalf("NewCookieKey() error = %v", err)
+	}
+
+	if len(first) != 16 {
+		t.Errorf("len(NewCookieKey()) = %d, want 16", len(first))
+	}
+	if string(first) == string(second) {
+		t.Error("NewCookieKey() returned the same key twice")
+	}
+}
@@ -0,0 +1,81 @@
+package factory
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/0niSec/gomap/logger"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// IPFields are the IPv4 header fields a probe controls. A zero TTL means the default of 64
+type IPFields struct {
+	ID  uint16
+	TTL uint8
+	TOS uint8
+	DF  bool
+}
+
+// ipLayer builds the IPv4 header of a probe
+func (f IPFields) ipLayer(srcIP, dstIP net.IP, protocol layers.IPProtocol) *layers.IPv4 {
+	ttl := f.TTL
+	if ttl == 0 {
+		ttl = 64
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TOS:      f.TOS,
+		Id:       f.ID,
+		TTL:      ttl,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+		Protocol: protocol,
+	}
+	if f.DF {
+		ip.Flags = layers.IPv4DontFragment
+	}
+	return ip
+}
+
+// CreateTCPProbe serializes a TCP segment whose every flag, option and header field is set by the caller,
+// like the probes of OS detection. It returns the packet bytes, starting at the IPv4 header.
+func CreateTCPProbe(srcIP, dstIP net.IP, fields IPFields, tcp *layers.TCP) ([]byte, error) {
+	ip := fields.ipLayer(srcIP, dstIP, layers.IPProtocolTCP)
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		logger.Error("Failed to set network layer for TCP checksum", "err", err)
+		return nil, fmt.Errorf("error setting network layer for TCP checksum: %w", err)
+	}
+	return serializeProbe(ip, tcp)
+}
+
+// CreateICMPProbe serializes an ICMP message carrying payload. It returns the packet bytes, starting at the IPv4 header.
+func CreateICMPProbe(srcIP, dstIP net.IP, fields IPFields, icmp *layers.ICMPv4, payload []byte) ([]byte, error) {
+	return serializeProbe(fields.ipLayer(srcIP, dstIP, layers.IPProtocolICMPv4), icmp, gopacket.Payload(payload))
+}
+
+// CreateUDPProbe serializes a UDP datagram carrying payload. It returns the packet bytes, starting at the IPv4 header.
+func CreateUDPProbe(srcIP, dstIP net.IP, fields IPFields, srcPort, dstPort uint16, payload []byte) ([]byte, error) {
+	ip := fields.ipLayer(srcIP, dstIP, layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		logger.Error("Failed to set network layer for UDP checksum", "err", err)
+		return nil, fmt.Errorf("error setting network layer for UDP checksum: %w", err)
+	}
+	return serializeProbe(ip, udp, gopacket.Payload(payload))
+}
+
+// serializeProbe serializes the layers of a probe, filling in lengths and checksums
+func serializeProbe(layers ...gopacket.SerializableLayer) ([]byte, error) {
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buffer, opts, layers...); err != nil {
+		logger.Error("Failed to serialize layers while creating probe", "err", err)
+		return nil, fmt.Errorf("error serializing layers while creating probe: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
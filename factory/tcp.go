@@ -3,7 +3,6 @@ package factory
 import (
 	"encoding/binary"
 	"fmt"
-	"math/rand"
 	"net"
 	"time"
 
@@ -15,21 +14,20 @@ import (
 type PortStatus int
 
 // CreateSYNPacket creates a TCP SYN packet with the specified source and destination IP and port.
+// The seq is the sequence number of the SYN. Replies to the probe acknowledge it with an Ack of seq+1.
 // It returns the serialized packet bytes, the IPv4 layer, and the TCP layer.
 // If there is an error generating the packet, it returns an error.
-func CreateSYNPacket(srcIP, dstIP net.IP, srcPort, dstPort uint16) ([]byte, *layers.IPv4, *layers.TCP, error) {
+func CreateSYNPacket(srcIP, dstIP net.IP, srcPort, dstPort uint16, seq uint32) ([]byte, *layers.IPv4, *layers.TCP, error) {
+	return CreateSYNPacketWithFields(srcIP, dstIP, srcPort, dstPort, seq, IPFields{})
+}
+
+// CreateSYNPacketWithFields creates the same SYN as [CreateSYNPacket], with the TTL, ID and flags of its
+// IPv4 header set by fields. Traceroute limits the TTL of its SYNs this way.
+func CreateSYNPacketWithFields(srcIP, dstIP net.IP, srcPort, dstPort uint16, seq uint32, fields IPFields) ([]byte, *layers.IPv4, *layers.TCP, error) {
 	// Create IP Layer
-	ipLayer := &layers.IPv4{
-		Version: 4,
-		TTL:     64,
-		IHL:     5,
-		// SrcIP and DstIP are left as net.IP types and not converted into IPv4 here
-		// They will be converted into IPv4 when the socket connection is made
-		// Gopacket probably does this for us but I'm not sure
-		SrcIP:    srcIP, // net.IP
-		DstIP:    dstIP, // net.IP
-		Protocol: layers.IPProtocolTCP,
-	}
+	// SrcIP and DstIP are left as net.IP types and not converted into IPv4 here
+	// They will be converted into IPv4 when the socket connection is made
+	ipLayer := fields.ipLayer(srcIP, dstIP, layers.IPProtocolTCP)
 
 	// Create TCP Layer
 	tcpLayer := &layers.TCP{
@@ -47,7 +45,7 @@ func CreateSYNPacket(srcIP, dstIP net.IP, srcPort, dstPort uint16) ([]byte, *lay
 		FIN:     false,
 		Urgent:  0,
 		Window:  65535,
-		Seq:     rand.Uint32(),
+		Seq:     seq,
 		Options: []layers.TCPOption{
 			{
 				OptionType:   layers.TCPOptionKindMSS,
@@ -6,7 +6,11 @@ require (
 	github.com/charmbracelet/lipgloss v0.11.1
 	github.com/gopacket/gopacket v1.2.0
 	github.com/urfave/cli/v2 v2.27.2
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/crypto v0.25.0
 	golang.org/x/net v0.27.0
+	golang.org/x/sys v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -20,5 +24,4 @@ require (
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 )
@@ -0,0 +1,240 @@
+package gomapcli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/0niSec/gomap/dns"
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/scanner"
+	"github.com/urfave/cli/v2"
+)
+
+// maxExpandedTargets bounds how many addresses target expansion adds, in case the scope is wider than meant
+const maxExpandedTargets = 256
+
+// scope is what target expansion may add: names within its domains and addresses within its ranges
+type scope struct {
+	domains []string
+	ranges  []*net.IPNet
+}
+
+// parseScope parses a comma separated list of domains, CIDR ranges and IP addresses (e.g. example.com,10.0.0.0/8)
+func parseScope(value string) (*scope, error) {
+	var s scope
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, ipnet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing scope range '%s': %w", entry, err)
+			}
+			s.ranges = append(s.ranges, ipnet)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			s.ranges = append(s.ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		default:
+			s.domains = append(s.domains, strings.TrimPrefix(strings.TrimSuffix(entry, "."), "*."))
+		}
+	}
+	if len(s.domains) == 0 && len(s.ranges) == 0 {
+		return nil, fmt.Errorf("no domains or ranges found in scope '%s'", value)
+	}
+	return &s, nil
+}
+
+// allowsName returns true if the name is one of the domains of the scope or within one, or if the scope only has ranges
+func (s *scope) allowsName(name string) bool {
+	if len(s.domains) == 0 {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range s.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsIP returns true if the address is within one of the ranges of the scope, or if the scope only has domains
+func (s *scope) allowsIP(ip net.IP) bool {
+	if len(s.ranges) == 0 {
+		return true
+	}
+	for _, ipnet := range s.ranges {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expander adds targets found in the DNS records of the domains given as targets, and in the certificates
+// of the hosts the scan finds
+type expander struct {
+	resolver   *dns.Resolver
+	targets    *Targets
+	scope      *scope
+	resolveAll bool
+	// certs is true with --expand-from-certs
+	certs bool
+	// seen are the addresses already scanned or queued, so none is scanned twice
+	seen  map[string]bool
+	added int
+}
+
+// newExpander returns the expander --expand-dns and --expand-from-certs ask for, or nil without either.
+// Without --scope, the hosts found in DNS records are kept within the domains and ranges given as targets.
+// Certificates only get harvested by version detection, and since anything could be named in them,
+// the hosts they name are only scanned within an explicit --scope.
+func newExpander(c *cli.Context, state *scanner.ScanState, resolver *dns.Resolver, targets *Targets) (*expander, error) {
+	if !state.ExpandDNS && !c.Bool("expand-from-certs") {
+		return nil, nil
+	}
+
+	var s *scope
+	var err error
+	if c.String("scope") != "" {
+		if s, err = parseScope(c.String("scope")); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Bool("expand-from-certs") {
+		if !c.Bool("service") {
+			return nil, fmt.Errorf("--expand-from-certs requires -sV, which reads the certificates")
+		}
+		if s == nil {
+			return nil, fmt.Errorf("--expand-from-certs requires --scope to bound the hosts it adds")
+		}
+		// The hosts found this way are scanned one at a time after the others, which stateless and sharded scans don't do
+		if state.Stateless {
+			return nil, fmt.Errorf("--expand-from-certs can't be combined with --stateless")
+		}
+		if _, shards, _ := scanner.ParseShard(state.Shard); shards > 1 {
+			return nil, fmt.Errorf("--expand-from-certs can't be combined with --shard")
+		}
+	}
+
+	// The targets are written like a scope, so they bound what --expand-dns adds when no scope was given
+	if s == nil {
+		if s, err = parseScope(state.Target); err != nil {
+			return nil, err
+		}
+		logger.Debug("Bounding target expansion to the targets", "scope", state.Target)
+	}
+
+	e := &expander{
+		resolver:   resolver,
+		targets:    targets,
+		scope:      s,
+		resolveAll: state.ResolveAll,
+		certs:      c.Bool("expand-from-certs"),
+		seen:       make(map[string]bool),
+	}
+	for _, ip := range targets.IPs {
+		e.seen[ip.String()] = true
+	}
+	return e, nil
+}
+
+// expandDNS adds the hosts named in the MX, NS and SRV records of the domains given as targets
+func (e *expander) expandDNS(ctx context.Context) {
+	var domains []string
+	for _, ip := range e.targets.IPs {
+		if name, ok := e.targets.Names[ip.String()]; ok && !slices.Contains(domains, name) {
+			domains = append(domains, name)
+		}
+	}
+
+	for _, domain := range domains {
+		for _, related := range e.resolver.LookupRelated(ctx, domain) {
+			e.add(ctx, related.Name, fmt.Sprintf("%s record of %s", related.Record, domain))
+		}
+	}
+}
+
+// harvest adds the hosts named in the certificates of the host that are within the scope, and returns their addresses
+func (e *expander) harvest(ctx context.Context, host scanner.HostResult) []net.IP {
+	if !e.certs {
+		return nil
+	}
+
+	var added []net.IP
+	for _, port := range host.Ports {
+		if port.ServiceVersion == nil || port.TLS == nil || port.TLS.Certificate == nil {
+			continue
+		}
+		source := fmt.Sprintf("certificate of %s:%d", host.Name(), port.Port)
+		for _, san := range port.TLS.Certificate.SANs {
+			switch {
+			case strings.HasPrefix(san, "DNS:"):
+				// A wildcard names no host in particular
+				if name := strings.TrimPrefix(san, "DNS:"); !strings.HasPrefix(name, "*") {
+					added = append(added, e.add(ctx, name, source)...)
+				}
+			case strings.HasPrefix(san, "IP:"):
+				// Addresses are only bounded by the ranges of the scope, so they need one
+				ip := net.ParseIP(strings.TrimPrefix(san, "IP:"))
+				if ip != nil && ip.To4() != nil && len(e.scope.ranges) > 0 && e.scope.allowsIP(ip) {
+					added = append(added, e.addIPs([]net.IP{ip.To4()}, "", source)...)
+				}
+			}
+		}
+	}
+	return added
+}
+
+// add resolves a name within the scope and adds its addresses within the scope that aren't targets yet
+func (e *expander) add(ctx context.Context, name, source string) []net.IP {
+	if !e.scope.allowsName(name) {
+		logger.Debug("Skipping host out of scope", "name", name, "source", source)
+		return nil
+	}
+
+	ips, _, err := ParseTarget(ctx, name, e.resolver, e.resolveAll)
+	if err != nil {
+		logger.Debug("Failed to resolve expanded target", "name", name, "source", source, "err", err)
+		return nil
+	}
+	var allowed []net.IP
+	for _, ip := range ips {
+		if e.scope.allowsIP(ip) {
+			allowed = append(allowed, ip)
+		}
+	}
+	return e.addIPs(allowed, name, source)
+}
+
+// addIPs adds the addresses that aren't targets yet, named name and found in source
+func (e *expander) addIPs(ips []net.IP, name, source string) []net.IP {
+	var added []net.IP
+	for _, ip := range ips {
+		if e.seen[ip.String()] {
+			continue
+		}
+		if e.added >= maxExpandedTargets {
+			return added
+		}
+
+		e.seen[ip.String()] = true
+		if e.added++; e.added == maxExpandedTargets {
+			logger.Error("Reached the most targets expansion adds, skipping the rest", "max", maxExpandedTargets)
+		}
+		e.targets.IPs = append(e.targets.IPs, ip)
+		if name != "" {
+			e.targets.Names[ip.String()] = name
+		}
+		e.targets.Sources[ip.String()] = source
+		logger.Debug("Added expanded target", "ip", ip, "name", name, "source", source)
+		added = append(added, ip)
+	}
+	return added
+}
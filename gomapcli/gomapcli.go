@@ -2,19 +2,52 @@
 package gomapcli
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/0niSec/gomap/logger"
 	"github.com/0niSec/gomap/network"
+	"github.com/0niSec/gomap/progress"
 	"github.com/0niSec/gomap/scanner"
 	"github.com/0niSec/gomap/services"
 	"github.com/urfave/cli/v2"
 )
 
+// defaultStateFile is where the state of a scan is saved when --state-file isn't given
+const defaultStateFile = "gomap-resume.json"
+
 func Runner(c *cli.Context) error {
 	// Calculate start time
 	startTime := time.Now()
 
+	// Stop sending new probes on Ctrl-C or SIGTERM. Restoring the default behavior afterwards means
+	// a second signal kills gomap right away instead of waiting for the probes in flight
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	// Either continue an interrupted scan or start a new one
+	state, err := loadOrCreateState(c)
+	if err != nil {
+		return err
+	}
+
+	// Check the output format now rather than after a long scan
+	if !slices.Contains(scanner.OutputFormats, c.String("output-format")) {
+		return fmt.Errorf("unknown output format '%s', expected one of %s", c.String("output-format"), strings.Join(scanner.OutputFormats, ", "))
+	}
+
 	// Get the interface
 	iface, err := network.GetValidInterface()
 	if err != nil {
@@ -27,34 +60,228 @@ func Runner(c *cli.Context) error {
 		return fmt.Errorf("error getting interface IP address: %w", err)
 	}
 
-	// Parse the target (IP or domain)
-	target, err := ParseTarget(c.String("target"))
+	// Targets given by name are looked up with this resolver, and so are the names of the hosts that are up
+	resolver, err := newResolver(c)
+	if err != nil {
+		return err
+	}
+
+	// Load the OS database, service probes, scripts, checks and CVE feed now rather than after a long scan
+	inspection, err := newInspection(c, srcIP, resolver)
+	if err != nil {
+		return err
+	}
+
+	// Print and/or record every packet we send and receive
+	scanner.SetPacketTrace(c.Bool("packet-trace"))
+	scanner.SetShowReasons(c.Bool("reason") || c.Count("verbose") > 0)
+	if c.Path("pcap-out") != "" {
+		closePcap, err := scanner.OpenPcapOut(c.Path("pcap-out"))
+		if err != nil {
+			return fmt.Errorf("error opening pcap output file: %w", err)
+		}
+		defer func() {
+			if err := closePcap(); err != nil {
+				logger.Error("Failed to close pcap output file", "err", err)
+			}
+		}()
+	}
+
+	// Parse the targets (IPs, domains or CIDR ranges)
+	parsed, err := ParseTargets(ctx, state.Target, resolver, state.ResolveAll)
 	if err != nil {
 		return fmt.Errorf("error parsing target: %w", err)
 	}
+	expansion, err := newExpander(c, state, resolver, parsed)
+	if err != nil {
+		return err
+	}
+	if state.ExpandDNS {
+		expansion.expandDNS(ctx)
+	}
+	targets := parsed.IPs
+	names, err := newHostNames(c, resolver, parsed)
+	if err != nil {
+		return err
+	}
+
+	// A UDP scan sends every port the payloads of its service
+	protocol := "tcp"
+	var payloads *services.PayloadDB
+	if state.UDP {
+		protocol = "udp"
+		payloads, err = services.DefaultPayloads()
+		if err != nil {
+			return fmt.Errorf("error loading UDP payloads: %w", err)
+		}
+	}
 
 	// Parse the ports depending on the -p flag
 	ports := Top1000Ports
-	if c.String("ports") != "" {
-		ports, err = ParsePorts(c.String("ports"))
+	if state.UDP {
+		ports, err = services.TopPorts("udp", len(Top1000Ports))
+		if err != nil {
+			return fmt.Errorf("error loading nmap services: %w", err)
+		}
+	}
+	if state.Ports != "" {
+		ports, err = ParsePorts(state.Ports)
 		if err != nil {
 			return fmt.Errorf("error parsing ports: %w", err)
 		}
 	}
 
-	// Scan the ports
-	results, err := scanner.Scan(srcIP, target, ports, c.Duration("timeout"))
+	// Walk targets×ports in a random order. Workers sharing a seed scan disjoint shards of the same order
+	shard, shards, err := scanner.ParseShard(state.Shard)
 	if err != nil {
-		return fmt.Errorf("error scanning ports: %w", err)
+		return err
 	}
+	perm, err := scanner.NewPermutation(uint64(len(targets))*uint64(len(ports)), state.Seed, shard, shards)
+	if err != nil {
+		return fmt.Errorf("error creating scan order: %w", err)
+	}
+	logger.Debug("Scan order", "seed", state.Seed, "shard", shard+1, "shards", shards)
 
 	// Get the services
-	services, err := services.GetServices(ports)
+	services, err := services.GetServices(ports, protocol)
 	if err != nil {
 		return fmt.Errorf("error loading nmap services: %w", err)
 	}
 
-	scanner.PrettyPrintScanResults(results, services)
+	now := startTime.Local()
+	fmt.Printf("Starting gomap at %s %02d:%02d:%02d\n", now.Format("2006-01-02"), now.Hour(), now.Minute(), now.Second())
+
+	// Answer keypresses and SIGUSR1 with status updates, and print them on a timer if asked to
+	progress.SetVerbosity(c.Count("verbose"))
+	restoreTerminal := StartInteraction()
+	defer restoreTerminal()
+	statsDone := make(chan struct{})
+	defer close(statsDone)
+
+	// The results of every host, in the order they were printed
+	var report []scanner.HostResult
+
+	if state.Stateless {
+		// Every step of this shard of the permutation that wasn't done by an earlier run is a probe
+		total := (uint64(len(targets))*uint64(len(ports)) + shards - 1 - shard) / shards
+		progress.Start(total-min(total, state.GetPosition()), uint64(len(targets)))
+		go progress.Report(c.Duration("stats-every"), statsDone)
+
+		// Scan every target at once and only report the ports that replied
+		results, hints, err := scanner.StatelessScan(ctx, srcIP, targets, ports, perm, state.Rate, c.Duration("timeout"), state)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return fmt.Errorf("error scanning ports: %w", err)
+		}
+		if err == nil {
+			for range targets {
+				progress.HostDone()
+			}
+		}
+
+		hosts := buildHostResults(results, protocol, services)
+		for i := range hosts {
+			hosts[i].AddStackHints(hints[hosts[i].IP])
+		}
+		names.name(hosts)
+		groupByName(hosts)
+		inspection.inspect(ctx, hosts)
+		printHostResults("Gomap scan report for", hosts)
+		report = append(report, hosts...)
+	} else {
+		// Skip the ports a resumed scan already finished
+		portsByTarget := scanner.PermutedPorts(targets, ports, perm)
+		remaining := make([][]uint16, len(targets))
+		var total uint64
+		for i, target := range targets {
+			remaining[i] = pendingPorts(state, target, portsByTarget[i])
+			total += uint64(len(remaining[i]))
+		}
+		progress.Start(total, uint64(len(targets)))
+		go progress.Report(c.Duration("stats-every"), statsDone)
+
+		// The hosts named in the certificates of a host are queued after the others, so the targets can grow
+		for i := 0; i < len(targets); i++ {
+			if ctx.Err() != nil {
+				break
+			}
+			target := targets[i]
+
+			if len(remaining[i]) == 0 {
+				if results := state.Snapshot()[target.String()]; len(results) > 0 {
+					hosts := []scanner.HostResult{scanner.NewHostResult(target.String(), protocol, results, services)}
+					names.name(hosts)
+					inspection.inspect(ctx, hosts)
+					printHostResults("Gomap scan report for", hosts)
+					report = append(report, hosts...)
+					targets, remaining = queueHarvested(ctx, expansion, hosts[0], state, ports, targets, remaining)
+				}
+				progress.HostDone()
+				continue
+			}
+
+			// Scan the ports
+			var results map[uint16]string
+			var hints map[uint16]*scanner.StackHints
+			if state.UDP {
+				results, err = scanner.UDPScan(ctx, srcIP, target, remaining[i], payloads, snmpCommunities(c), c.Duration("timeout"), c.Int("max-parallelism"), c.Int("max-retries"), state)
+			} else {
+				results, hints, err = scanner.Scan(ctx, srcIP, target, remaining[i], c.Duration("timeout"), c.Int("max-parallelism"), c.Int("max-retries"), state)
+			}
+			if errors.Is(err, scanner.ErrTargetDown) && len(targets) > 1 {
+				// Keep going with the rest of the targets
+				progress.HostDone()
+				continue
+			}
+			if err != nil && !errors.Is(err, context.Canceled) {
+				return fmt.Errorf("error scanning ports: %w", err)
+			}
+			if err == nil {
+				progress.HostDone()
+			}
+
+			// The scan checkpoints as it goes, and once more after every target
+			if err := state.Save(); err != nil {
+				logger.Error("Failed to save scan state", "err", err)
+			}
+
+			hosts := []scanner.HostResult{scanner.NewHostResult(target.String(), protocol, hostResults(state, target, results), services)}
+			hosts[0].AddStackHints(hints)
+			names.name(hosts)
+			inspection.inspect(ctx, hosts)
+			printHostResults("Gomap scan report for", hosts)
+			report = append(report, hosts...)
+			targets, remaining = queueHarvested(ctx, expansion, hosts[0], state, ports, targets, remaining)
+		}
+	}
+
+	if inspection.version != nil {
+		reportSharedHostKeys(report)
+	}
+
+	// Write the results, partial or not, to the output file
+	if c.Path("output") != "" {
+		if err := scanner.WriteResults(c.Path("output"), c.String("output-format"), report); err != nil {
+			return err
+		}
+	}
+
+	// An interrupted scan always leaves a state file behind so it can be resumed
+	if ctx.Err() != nil {
+		if err := state.Save(); err != nil {
+			return fmt.Errorf("error saving scan state: %w", err)
+		}
+		fmt.Printf("Scan interrupted, partial results shown. Resume with: gomap --resume %s\n", state.Path())
+		return nil
+	}
+
+	// A finished scan has nothing left to resume, so the state file nobody asked for is removed
+	if !c.IsSet("state-file") && state.Path() == defaultStateFile {
+		if err := os.Remove(state.Path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("Failed to remove scan state", "err", err)
+		}
+	} else if err := state.Save(); err != nil {
+		logger.Error("Failed to save scan state", "err", err)
+	}
 
 	endTime := time.Now()
 	duration := endTime.Sub(startTime).Seconds()
@@ -62,3 +289,102 @@ func Runner(c *cli.Context) error {
 
 	return nil
 }
+
+// pendingPorts returns the ports of target the scan state doesn't have a result for yet
+func pendingPorts(state *scanner.ScanState, target net.IP, ports []uint16) []uint16 {
+	var pending []uint16
+	for _, port := range ports {
+		if !state.Done(target.String(), port) {
+			pending = append(pending, port)
+		}
+	}
+	return pending
+}
+
+// hostResults returns the results of target recorded in the scan state, along with the results of this run that
+// the state leaves out because they have to be probed again on resume
+func hostResults(state *scanner.ScanState, target net.IP, results map[uint16]string) map[uint16]string {
+	merged := state.Snapshot()[target.String()]
+	if merged == nil {
+		merged = make(map[uint16]string, len(results))
+	}
+	for port, status := range results {
+		if _, ok := merged[port]; !ok {
+			merged[port] = status
+		}
+	}
+	return merged
+}
+
+// queueHarvested adds the hosts named in the certificates of host to the targets, along with their ports left to scan
+func queueHarvested(ctx context.Context, e *expander, host scanner.HostResult, state *scanner.ScanState, ports []uint16, targets []net.IP, remaining [][]uint16) ([]net.IP, [][]uint16) {
+	if e == nil {
+		return targets, remaining
+	}
+	for _, ip := range e.harvest(ctx, host) {
+		pending := pendingPorts(state, ip, ports)
+		targets = append(targets, ip)
+		remaining = append(remaining, pending)
+		progress.AddHost(uint64(len(pending)))
+	}
+	return targets, remaining
+}
+
+// loadOrCreateState loads the state file given with --resume, or creates the state of a new scan from the flags
+func loadOrCreateState(c *cli.Context) (*scanner.ScanState, error) {
+	if c.Path("resume") != "" {
+		state, err := scanner.LoadState(c.Path("resume"))
+		if err != nil {
+			return nil, fmt.Errorf("error resuming scan: %w", err)
+		}
+		return state, nil
+	}
+
+	// The target can't be a required flag since subcommands like replay and --resume don't take one
+	if c.String("target") == "" {
+		return nil, fmt.Errorf("no target specified, use --target")
+	}
+
+	// Only a stateless scan walks the permutation across hosts. A stateful scan probes one host at a time,
+	// so a seed or a shard wouldn't mean the same thing there
+	if (c.IsSet("seed") || c.IsSet("shard")) && !c.Bool("stateless") {
+		return nil, fmt.Errorf("--seed and --shard require --stateless")
+	}
+
+	// Sharded workers must walk the same order, so they can't each pick a random seed
+	_, shards, err := scanner.ParseShard(c.String("shard"))
+	if err != nil {
+		return nil, err
+	}
+	if shards > 1 && !c.IsSet("seed") {
+		return nil, fmt.Errorf("--shard requires --seed so every worker walks the same order")
+	}
+
+	// Stateless scans validate replies with SYN cookies, which UDP has no equivalent of
+	if c.Bool("stateless") && c.Bool("udp") {
+		return nil, fmt.Errorf("--stateless only supports SYN scans, not -sU")
+	}
+
+	seed := c.Int64("seed")
+	if !c.IsSet("seed") {
+		seed = time.Now().UnixNano()
+	}
+
+	// The state is always saved while scanning, so even a scan that's killed can be resumed
+	path := c.Path("state-file")
+	if path == "" {
+		path = defaultStateFile
+	}
+	state := scanner.NewScanState(path)
+	state.Target = c.String("target")
+	state.ResolveAll = c.Bool("resolve-all")
+	state.ExpandDNS = c.Bool("expand-dns")
+	state.Ports = c.String("ports")
+	state.Seed = seed
+	state.Shard = c.String("shard")
+	state.Stateless = c.Bool("stateless")
+	state.UDP = c.Bool("udp")
+	state.Rate = c.Int("rate")
+
+	return state, nil
+}
@@ -0,0 +1,105 @@
+package gomapcli
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/progress"
+	"github.com/0niSec/gomap/scanner"
+	"golang.org/x/sys/unix"
+)
+
+// StartInteraction answers runtime interaction while a scan is running:
+//
+//   - v / V raises / lowers the verbosity
+//   - d / D raises / lowers the debugging level
+//   - p toggles packet tracing
+//   - Enter (or any other key) prints a status line
+//   - SIGUSR1 prints a status line, for when gomap runs without a terminal (e.g. under systemd)
+//
+// Keypresses are only read when stdin is a terminal. The returned function restores the terminal and must be
+// called before gomap exits.
+func StartInteraction() func() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			progress.PrintStatus()
+		}
+	}()
+
+	restore := func() {
+		signal.Stop(usr1)
+	}
+
+	// Turn off line buffering and echo, but leave output processing alone so printed lines still work
+	fd := int(os.Stdin.Fd())
+	original, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		// Not a terminal
+		return restore
+	}
+
+	raw := *original
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		logger.Debug("Failed to set terminal mode, keypresses are ignored", "err", err)
+		return restore
+	}
+
+	go readKeypresses()
+
+	return func() {
+		signal.Stop(usr1)
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, original); err != nil {
+			logger.Error("Failed to restore terminal", "err", err)
+		}
+	}
+}
+
+// readKeypresses handles keypresses on stdin until it's closed
+func readKeypresses() {
+	buf := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(buf); err != nil {
+			return
+		}
+		handleKeypress(buf[0])
+	}
+}
+
+// handleKeypress acts on a single keypress
+func handleKeypress(key byte) {
+	switch key {
+	case 'v':
+		fmt.Printf("Verbosity Increased to %d.\n", progress.IncreaseVerbosity())
+	case 'V':
+		if progress.Verbosity() > 0 {
+			progress.SetVerbosity(progress.Verbosity() - 1)
+		}
+		fmt.Printf("Verbosity Decreased to %d.\n", progress.Verbosity())
+	case 'd':
+		fmt.Printf("Debugging Increased to %d.\n", progress.IncreaseDebugging())
+		logger.SetLevel(slog.LevelDebug)
+	case 'D':
+		fmt.Println("Debugging Decreased to 0.")
+		progress.SetDebugging(0)
+		logger.SetLevel(slog.LevelInfo)
+	case 'p':
+		if scanner.PacketTraceEnabled() {
+			scanner.SetPacketTrace(false)
+			fmt.Println("Packet Tracing disabled.")
+		} else {
+			scanner.SetPacketTrace(true)
+			fmt.Println("Packet Tracing enabled.")
+		}
+	default:
+		progress.PrintStatus()
+	}
+}
@@ -0,0 +1,107 @@
+package gomapcli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/0niSec/gomap/dns"
+	"github.com/0niSec/gomap/scanner"
+	"github.com/urfave/cli/v2"
+)
+
+// newResolver returns the resolver --system-dns and --dns-servers ask for
+func newResolver(c *cli.Context) (*dns.Resolver, error) {
+	var servers []string
+	for _, server := range strings.Split(c.String("dns-servers"), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+
+	resolver, err := dns.NewResolver(c.Bool("system-dns"), servers)
+	if err != nil {
+		return nil, fmt.Errorf("error creating DNS resolver: %w", err)
+	}
+	return resolver, nil
+}
+
+// hostNames names the hosts in the reports, by the name they were given as a target or by reverse DNS
+type hostNames struct {
+	resolver *dns.Resolver
+	// targets has the names the targets were given by and their addresses that aren't scanned
+	targets *Targets
+	// reverse is false with -n, when no reverse lookups are done
+	reverse bool
+}
+
+// newHostNames returns the names of the hosts as -R and -n ask for. With -R, the reverse lookups of every
+// target start right away, whether the target turns out to be up or not. Otherwise only the hosts
+// that are up get looked up, when they're reported.
+func newHostNames(c *cli.Context, resolver *dns.Resolver, targets *Targets) (*hostNames, error) {
+	if c.Bool("resolve") && c.Bool("no-resolve") {
+		return nil, fmt.Errorf("-R and -n can't be given together")
+	}
+
+	n := &hostNames{resolver: resolver, targets: targets, reverse: !c.Bool("no-resolve")}
+	if c.Bool("resolve") {
+		ips := make([]string, len(targets.IPs))
+		for i, target := range targets.IPs {
+			ips[i] = target.String()
+		}
+		resolver.Prefetch(ips)
+	}
+	return n, nil
+}
+
+// name sets the hostname of every host, looking up the ones not given by name all at once, along with
+// the addresses of the name that weren't scanned and where target expansion found the host
+func (n *hostNames) name(hosts []scanner.HostResult) {
+	var lookups []string
+	for i := range hosts {
+		hosts[i].OtherAddresses = n.targets.Unscanned[hosts[i].IP]
+		hosts[i].Source = n.targets.Sources[hosts[i].IP]
+		if name, ok := n.targets.Names[hosts[i].IP]; ok {
+			hosts[i].Hostname = name
+		} else {
+			lookups = append(lookups, hosts[i].IP)
+		}
+	}
+	if !n.reverse || len(lookups) == 0 {
+		return
+	}
+
+	names := n.resolver.LookupAddrs(lookups)
+	for i := range hosts {
+		if name, ok := names[hosts[i].IP]; ok {
+			hosts[i].Hostname = name
+		}
+	}
+}
+
+// groupByName moves the hosts sharing a hostname next to the first of them, so every address a name resolved
+// to is reported together. The hosts keep their order otherwise.
+func groupByName(hosts []scanner.HostResult) {
+	byName := make(map[string][]int)
+	for i, host := range hosts {
+		if host.Hostname != "" {
+			byName[host.Hostname] = append(byName[host.Hostname], i)
+		}
+	}
+
+	grouped := make([]scanner.HostResult, 0, len(hosts))
+	placed := make([]bool, len(hosts))
+	for i, host := range hosts {
+		if placed[i] {
+			continue
+		}
+		if host.Hostname == "" {
+			grouped = append(grouped, host)
+			continue
+		}
+		for _, j := range byName[host.Hostname] {
+			grouped = append(grouped, hosts[j])
+			placed[j] = true
+		}
+	}
+	copy(hosts, grouped)
+}
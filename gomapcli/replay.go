@@ -0,0 +1,39 @@
+package gomapcli
+
+import (
+	"fmt"
+
+	"github.com/0niSec/gomap/scanner"
+	"github.com/0niSec/gomap/services"
+	"github.com/urfave/cli/v2"
+)
+
+// ReplayRunner rebuilds port states from a recorded capture instead of scanning a live target
+func ReplayRunner(c *cli.Context) error {
+	results, err := scanner.ReplayCapture(c.Path("pcap"))
+	if err != nil {
+		return fmt.Errorf("error replaying capture: %w", err)
+	}
+
+	if len(results) == 0 {
+		fmt.Println("No SYN probes found in capture")
+		return nil
+	}
+
+	// Only the ports found in the capture need a service name
+	var ports []uint16
+	for _, target := range results {
+		for port := range target {
+			ports = append(ports, port)
+		}
+	}
+
+	services, err := services.GetServices(ports, "tcp")
+	if err != nil {
+		return fmt.Errorf("error loading nmap services: %w", err)
+	}
+
+	printHostResults("Gomap replay report for", buildHostResults(results, "tcp", services))
+
+	return nil
+}
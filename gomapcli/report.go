@@ -0,0 +1,405 @@
+package gomapcli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0niSec/gomap/checks"
+	"github.com/0niSec/gomap/dns"
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/osfp"
+	"github.com/0niSec/gomap/scanner"
+	"github.com/0niSec/gomap/scripts"
+	"github.com/0niSec/gomap/services"
+	"github.com/0niSec/gomap/vulns"
+	"github.com/urfave/cli/v2"
+)
+
+// buildHostResults turns the port statuses of every host into host results, sorted by IP address
+func buildHostResults(results map[string]map[uint16]string, protocol string, services map[uint16]string) []scanner.HostResult {
+	hosts := make([]scanner.HostResult, 0, len(results))
+	for target, ports := range results {
+		hosts = append(hosts, scanner.NewHostResult(target, protocol, ports, services))
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(hosts[i].IP).To16(), net.ParseIP(hosts[j].IP).To16()) < 0
+	})
+
+	return hosts
+}
+
+// printHostResults prints the results of every host, each under its own header
+func printHostResults(header string, hosts []scanner.HostResult) {
+	for _, host := range hosts {
+		fmt.Println(header, host.Name())
+		scanner.PrettyPrintScanResults(host)
+	}
+}
+
+// inspection is everything that looks deeper into the open ports the scan found. Each part is nil when
+// its flags weren't given
+type inspection struct {
+	// srcIP and timeout are used to probe the timestamp clocks of hosts the scan couldn't guess the uptime of
+	srcIP   net.IP
+	timeout time.Duration
+
+	os     *osOptions
+	tracer *scanner.Tracer
+	// firewalk is true when --firewalk looks for where the filtered ports are blocked, along the routes of tracer
+	firewalk bool
+	version  *services.DetectOptions
+	vulns    *vulns.DB
+	minCVSS  float64
+	scripts  *scripts.Options
+	checks   *checks.Options
+}
+
+// newInspection loads the inspection the flags ask for. OS detection sends its probes from srcIP, and traceroute
+// names its hops with resolver unless -n is given
+func newInspection(c *cli.Context, srcIP net.IP, resolver *dns.Resolver) (*inspection, error) {
+	if err := checkTimeouts(c); err != nil {
+		return nil, err
+	}
+
+	i := inspection{srcIP: srcIP, timeout: c.Duration("timeout")}
+	var err error
+	if i.os, err = osDetectionOptions(c, srcIP); err != nil {
+		return nil, err
+	}
+	if c.Bool("traceroute") || c.Bool("firewalk") {
+		if c.Bool("no-resolve") {
+			resolver = nil
+		}
+		i.tracer = scanner.NewTracer(srcIP, resolver)
+	}
+	i.firewalk = c.Bool("firewalk")
+	if i.version, err = versionOptions(c); err != nil {
+		return nil, err
+	}
+	if i.vulns, i.minCVSS, err = vulnOptions(c); err != nil {
+		return nil, err
+	}
+	if i.scripts, err = scriptOptions(c); err != nil {
+		return nil, err
+	}
+	if i.checks, err = checkOptions(c); err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+// inspect runs OS detection, uptime probing, traceroute, firewalking, version detection, CVE matching, scripts and checks against the hosts. The last
+// three run in that order since each one builds on what was found before it. It's skipped once the scan is interrupted.
+func (i *inspection) inspect(ctx context.Context, hosts []scanner.HostResult) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	if i.os != nil {
+		detectOS(ctx, i.os, hosts)
+	}
+	probeUptimes(ctx, i.srcIP, i.timeout, hosts)
+	if i.tracer != nil && !i.firewalk {
+		traceHosts(ctx, i.tracer, hosts)
+	}
+	if i.firewalk {
+		firewalkHosts(ctx, i.tracer, hosts)
+	}
+	if i.version != nil {
+		detectVersions(i.version, hosts)
+	}
+	if i.vulns != nil {
+		vulns.Annotate(hosts, i.vulns, i.minCVSS)
+	}
+	if i.scripts != nil {
+		scripts.Run(ctx, hosts, *i.scripts)
+	}
+	if i.checks != nil {
+		checks.Run(ctx, hosts, *i.checks)
+	}
+}
+
+// osOptions controls OS detection
+type osOptions struct {
+	srcIP   net.IP
+	db      *osfp.DB
+	timeout time.Duration
+}
+
+// osDetectionOptions returns the OS detection options given on the command line, or nil without -O.
+// The OS database is loaded here so a bad database is reported before the scan starts.
+func osDetectionOptions(c *cli.Context, srcIP net.IP) (*osOptions, error) {
+	if !c.Bool("os") {
+		return nil, nil
+	}
+
+	var db *osfp.DB
+	var err error
+	if c.Path("os-db") != "" {
+		db, err = osfp.LoadDB(c.Path("os-db"))
+	} else {
+		db, err = osfp.DefaultDB()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading OS database: %w", err)
+	}
+	logger.Debug("Loaded OS database", "fingerprints", db.Len())
+
+	return &osOptions{srcIP: srcIP, db: db, timeout: c.Duration("os-timeout")}, nil
+}
+
+// detectOS fingerprints every host with an open TCP port, one host at a time
+func detectOS(ctx context.Context, opts *osOptions, hosts []scanner.HostResult) {
+	for i := range hosts {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := scanner.DetectOS(opts.srcIP, &hosts[i], opts.db, opts.timeout); err != nil {
+			logger.Error("OS detection failed", "host", hosts[i].IP, "err", err)
+		}
+	}
+}
+
+// probeUptimes guesses the uptime of the hosts whose SYN/ACKs, from the scan and OS detection, didn't tell it
+func probeUptimes(ctx context.Context, srcIP net.IP, timeout time.Duration, hosts []scanner.HostResult) {
+	for i := range hosts {
+		if ctx.Err() != nil {
+			return
+		}
+		hosts[i].ProbeUptime(srcIP, timeout)
+	}
+}
+
+// traceHosts traces the route to every host, one host at a time so later routes can reuse the hops of earlier ones
+func traceHosts(ctx context.Context, tracer *scanner.Tracer, hosts []scanner.HostResult) {
+	for i := range hosts {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := tracer.TraceHost(&hosts[i]); err != nil {
+			logger.Error("Traceroute failed", "host", hosts[i].IP, "err", err)
+		}
+	}
+}
+
+// firewalkHosts finds where the filtered ports of every host are blocked, tracing the routes on the way
+func firewalkHosts(ctx context.Context, tracer *scanner.Tracer, hosts []scanner.HostResult) {
+	for i := range hosts {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := tracer.TraceHost(&hosts[i]); err != nil {
+			logger.Error("Traceroute failed", "host", hosts[i].IP, "err", err)
+			continue
+		}
+		if err := tracer.Firewalk(&hosts[i]); err != nil {
+			logger.Error("Firewalk failed", "host", hosts[i].IP, "err", err)
+		}
+	}
+}
+
+// versionOptions returns the version detection options given on the command line, or nil without -sV.
+// The service probes are loaded here so a bad probes file is reported before the scan starts.
+func versionOptions(c *cli.Context) (*services.DetectOptions, error) {
+	if !c.Bool("service") {
+		return nil, nil
+	}
+
+	intensity := c.Int("version-intensity")
+	if intensity < 0 || intensity > 9 {
+		return nil, fmt.Errorf("version intensity must be between 0 and 9, got %d", intensity)
+	}
+
+	var probes *services.ProbeDB
+	var err error
+	if c.Path("service-probes") != "" {
+		probes, err = services.LoadProbes(c.Path("service-probes"))
+	} else {
+		probes, err = services.DefaultProbes()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading service probes: %w", err)
+	}
+
+	payloads, err := services.DefaultPayloads()
+	if err != nil {
+		return nil, fmt.Errorf("error loading UDP payloads: %w", err)
+	}
+
+	return &services.DetectOptions{
+		Workers:         c.Int("version-workers"),
+		ConnectTimeout:  c.Duration("connect-timeout"),
+		ReadTimeout:     c.Duration("read-timeout"),
+		Intensity:       intensity,
+		Probes:          probes,
+		Payloads:        payloads,
+		SNMPCommunities: snmpCommunities(c),
+		TryLogins:       c.Bool("db-logins"),
+	}, nil
+}
+
+// snmpCommunities returns the communities given with --snmp-communities
+func snmpCommunities(c *cli.Context) []string {
+	var communities []string
+	for _, community := range strings.Split(c.String("snmp-communities"), ",") {
+		if community = strings.TrimSpace(community); community != "" {
+			communities = append(communities, community)
+		}
+	}
+	return communities
+}
+
+// detectVersions runs version detection on every open port of the hosts.
+// UDP ports that may be open are probed too, and the ones that answer turn out to be open.
+func detectVersions(opts *services.DetectOptions, hosts []scanner.HostResult) {
+
+	// Remember where every open port is so the results can be put back in place
+	type location struct{ host, port int }
+	var targets []services.Target
+	var locations []location
+	for h, host := range hosts {
+		for p, port := range host.Ports {
+			if port.State != "open" && !(port.Protocol == "udp" && port.State == "open|filtered") {
+				continue
+			}
+			targets = append(targets, services.Target{IP: net.ParseIP(host.IP), Port: port.Port, Protocol: port.Protocol})
+			locations = append(locations, location{h, p})
+		}
+	}
+
+	versions := services.DetectVersions(targets, *opts)
+
+	for i, version := range versions {
+		port := &hosts[locations[i].host].Ports[locations[i].port]
+		port.ServiceVersion = version
+		// Every UDP version comes from a reply
+		if version != nil && port.Protocol == "udp" {
+			port.State = "open"
+		}
+		// What the probes found beats the guess made from the port number
+		if version != nil && version.Name != "" {
+			port.Service = version.Name
+		}
+	}
+}
+
+// scriptOptions returns the script scan options given on the command line, or nil without --script or -sC.
+// The scripts are compiled here so a broken script is reported before the scan starts.
+func scriptOptions(c *cli.Context) (*scripts.Options, error) {
+	var names []string
+	if c.Bool("default-scripts") {
+		names = append(names, "default")
+	}
+	if c.String("script") != "" {
+		names = append(names, c.String("script"))
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	selected, err := scripts.Select(strings.Join(names, ","))
+	if err != nil {
+		return nil, fmt.Errorf("error loading scripts: %w", err)
+	}
+
+	args, err := scripts.ParseArgs(c.String("script-args"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &scripts.Options{
+		Scripts: selected,
+		Args:    args,
+		Workers: c.Int("script-workers"),
+		Timeout: c.Duration("script-timeout"),
+	}, nil
+}
+
+// vulnOptions returns the CVE feed given with --vulners-db and the lowest score of the CVEs to report,
+// or no feed without --vulners-db
+func vulnOptions(c *cli.Context) (*vulns.DB, float64, error) {
+	if c.Path("vulners-db") == "" {
+		return nil, 0, nil
+	}
+	// CVEs are matched against the CPEs version detection finds
+	if !c.Bool("service") {
+		return nil, 0, fmt.Errorf("--vulners-db requires -sV")
+	}
+
+	minCVSS := c.Float64("min-cvss")
+	if minCVSS < 0 || minCVSS > 10 {
+		return nil, 0, fmt.Errorf("minimum CVSS score must be between 0 and 10, got %g", minCVSS)
+	}
+
+	db, err := vulns.Load(c.Path("vulners-db"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return db, minCVSS, nil
+}
+
+// checkTimeouts rejects the timeouts of the inspection that aren't positive, since a zero timeout would make every
+// connection and read fail right away
+func checkTimeouts(c *cli.Context) error {
+	for _, name := range []string{"connect-timeout", "read-timeout", "os-timeout", "script-timeout", "check-timeout"} {
+		if timeout := c.Duration(name); timeout <= 0 {
+			return fmt.Errorf("--%s must be greater than 0, got %s", name, timeout)
+		}
+	}
+	return nil
+}
+
+// checkOptions returns the check options given on the command line, or nil without --checks.
+// The checks are parsed here so a broken check is reported before the scan starts.
+func checkOptions(c *cli.Context) (*checks.Options, error) {
+	if c.Path("checks") == "" {
+		return nil, nil
+	}
+
+	loaded, err := checks.LoadDir(c.Path("checks"))
+	if err != nil {
+		return nil, fmt.Errorf("error loading checks: %w", err)
+	}
+
+	return &checks.Options{
+		Checks:  loaded,
+		Workers: c.Int("script-workers"),
+		Timeout: c.Duration("check-timeout"),
+	}, nil
+}
+
+// reportSharedHostKeys warns about SSH host keys found on more than one host, which usually means
+// the hosts were cloned from the same VM image
+func reportSharedHostKeys(hosts []scanner.HostResult) {
+	owners := make(map[string][]string)
+	var fingerprints []string
+	for _, host := range hosts {
+		for _, port := range host.Ports {
+			if port.ServiceVersion == nil || port.SSH == nil {
+				continue
+			}
+			for _, key := range port.SSH.HostKeys {
+				if _, ok := owners[key.Fingerprint]; !ok {
+					fingerprints = append(fingerprints, key.Fingerprint)
+				}
+				// The same sshd listening on several ports of one host isn't a clone
+				if !slices.Contains(owners[key.Fingerprint], host.IP) {
+					owners[key.Fingerprint] = append(owners[key.Fingerprint], host.IP)
+				}
+			}
+		}
+	}
+
+	for _, fingerprint := range fingerprints {
+		if len(owners[fingerprint]) > 1 {
+			fmt.Printf("WARNING: SSH host key %s is shared by %s\n", fingerprint, strings.Join(owners[fingerprint], ", "))
+		}
+	}
+}
@@ -9,14 +9,17 @@ import (
 var (
 	logger *slog.Logger
 	once   sync.Once
+	// level can be changed while goroutines are logging, e.g. when debugging is raised during a scan
+	level = new(slog.LevelVar)
 )
 
 // init initializes the logger
 func init() {
 	once.Do(func() {
 		// Create a JSON handler for structured logging
+		level.Set(slog.LevelInfo) // Set default level to Info
 		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
-			Level: slog.LevelInfo, // Set default level to Info
+			Level: level,
 		})
 
 		logger = slog.New(handler)
@@ -28,15 +31,14 @@ func GetLogger() *slog.Logger {
 	return logger
 }
 
-// SetLevel sets the logging level
-func SetLevel(level slog.Level) {
-	handler := logger.Handler()
-	if _, ok := handler.(*slog.JSONHandler); ok {
-		newHandler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
-			Level: level,
-		})
-		logger = slog.New(newHandler)
-	}
+// SetLevel sets the logging level. It's safe to call while other goroutines are logging
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// GetLevel returns the current logging level
+func GetLevel() slog.Level {
+	return level.Level()
 }
 
 // Debug logs a debug message
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/0niSec/gomap/gomapcli"
+	"github.com/0niSec/gomap/services"
 	"github.com/urfave/cli/v2"
 )
 
@@ -29,9 +30,50 @@ func main() {
 			&cli.StringFlag{
 				Name:     "target",
 				Aliases:  []string{"t"},
-				Usage:    "The target to scan. Can accept IP addresses and domain names",
+				Usage:    "The targets to scan. Can accept IPv4 addresses, domain names and IPv4 CIDR ranges, separated by commas. IPv6 isn't supported",
+				Category: "TARGET SPECIFICATION:",
+			},
+			&cli.BoolFlag{
+				Name:     "resolve",
+				Aliases:  []string{"R"},
+				Usage:    "Look up the reverse DNS name of every target, even the ones that are down",
+				Category: "TARGET SPECIFICATION:",
+			},
+			&cli.BoolFlag{
+				Name:     "no-resolve",
+				Aliases:  []string{"n"},
+				Usage:    "Never look up reverse DNS names. By default only the hosts that are up are looked up",
+				Category: "TARGET SPECIFICATION:",
+			},
+			&cli.BoolFlag{
+				Name:     "resolve-all",
+				Usage:    "Scan every IPv4 address a domain name resolves to, not just the first. IPv6 addresses are skipped with a warning and only listed in the report",
+				Category: "TARGET SPECIFICATION:",
+			},
+			&cli.BoolFlag{
+				Name:     "expand-dns",
+				Usage:    "Also scan the hosts named in the MX, NS and common SRV records of the domain names given as targets, within --scope or else within the domains and ranges given as targets",
+				Category: "TARGET SPECIFICATION:",
+			},
+			&cli.BoolFlag{
+				Name:     "expand-from-certs",
+				Usage:    "Also scan the hosts named in the SANs of the TLS certificates -sV finds, within --scope",
+				Category: "TARGET SPECIFICATION:",
+			},
+			&cli.StringFlag{
+				Name:     "scope",
+				Usage:    "Domains, CIDR ranges and IP addresses the hosts added by target expansion must be within, separated by commas",
+				Category: "TARGET SPECIFICATION:",
+			},
+			&cli.StringFlag{
+				Name:     "dns-servers",
+				Usage:    "Ask these DNS servers instead of the ones in /etc/resolv.conf, separated by commas (e.g. 10.0.0.53,10.0.1.53:5353)",
+				Category: "TARGET SPECIFICATION:",
+			},
+			&cli.BoolFlag{
+				Name:     "system-dns",
+				Usage:    "Use the system resolver instead of asking DNS servers directly",
 				Category: "TARGET SPECIFICATION:",
-				Required: true,
 			},
 			&cli.DurationFlag{
 				Name:     "timeout",
@@ -46,6 +88,104 @@ func main() {
 				Usage:    "Output file",
 				Category: "OUTPUT MODES:",
 			},
+			&cli.StringFlag{
+				Name:     "output-format",
+				Usage:    "Format of the output file (text or json)",
+				Value:    "text",
+				Category: "OUTPUT MODES:",
+			},
+			&cli.BoolFlag{
+				Name:     "stateless",
+				Usage:    "Scan all targets at once without per-probe state, validating replies with SYN cookies",
+				Category: "SCAN TECHNIQUES:",
+			},
+			&cli.BoolFlag{
+				Name:     "udp",
+				Aliases:  []string{"sU"},
+				Usage:    "UDP scan, sending each port payloads its service answers",
+				Category: "SCAN TECHNIQUES:",
+			},
+			&cli.StringFlag{
+				Name:     "snmp-communities",
+				Usage:    "SNMP communities tried by UDP scans and version detection, separated by commas",
+				Value:    "public,private",
+				Category: "SCAN TECHNIQUES:",
+			},
+			&cli.IntFlag{
+				Name:     "rate",
+				Usage:    "Probes sent per second in a stateless scan (0 for no limit)",
+				Value:    10000,
+				Category: "TIMING AND PERFORMANCE:",
+			},
+			&cli.Int64Flag{
+				Name:     "seed",
+				Usage:    "Seed for the random order of targets and ports of a stateless scan (default: random)",
+				Category: "TIMING AND PERFORMANCE:",
+			},
+			&cli.StringFlag{
+				Name:     "shard",
+				Usage:    "Only scan shard i of n of the targets and ports of a stateless scan (e.g. 2/3). Requires --seed",
+				Value:    "1/1",
+				Category: "TIMING AND PERFORMANCE:",
+			},
+			&cli.IntFlag{
+				Name:     "max-parallelism",
+				Usage:    "Maximum number of probes in flight at once per target (0 for no limit)",
+				Value:    1000,
+				Category: "TIMING AND PERFORMANCE:",
+			},
+			&cli.IntFlag{
+				Name:     "max-retries",
+				Usage:    "Number of times a probe that got no reply is sent again",
+				Value:    0,
+				Category: "TIMING AND PERFORMANCE:",
+			},
+			&cli.DurationFlag{
+				Name:     "stats-every",
+				Usage:    "Print a status line at this interval (e.g. 10s)",
+				Category: "TIMING AND PERFORMANCE:",
+			},
+			&cli.BoolFlag{
+				Name:     "traceroute",
+				Usage:    "Trace the route to each host with probes to a port the scan found, skipping hops shared with earlier routes",
+				Category: "MISC:",
+			},
+			&cli.BoolFlag{
+				Name:     "firewalk",
+				Usage:    "Find the router each filtered TCP port is blocked at with probes that expire past each hop, for up to 32 ports per host. Implies --traceroute",
+				Category: "MISC:",
+			},
+			&cli.PathFlag{
+				Name:     "state-file",
+				Usage:    "Periodically save the scan state to this file so it can be resumed (default: gomap-resume.json, removed once the scan finishes)",
+				Category: "MISC:",
+			},
+			&cli.PathFlag{
+				Name:     "resume",
+				Usage:    "Resume an interrupted scan from its state file",
+				Category: "MISC:",
+			},
+			&cli.BoolFlag{
+				Name:     "verbose",
+				Aliases:  []string{"v"},
+				Usage:    "Increase verbosity, e.g. print open ports as they're found. Use twice for more",
+				Category: "OUTPUT MODES:",
+			},
+			&cli.BoolFlag{
+				Name:     "reason",
+				Usage:    "Show why each port is in its state, and the TTL, window and TCP options of the SYN/ACKs of open ports",
+				Category: "OUTPUT MODES:",
+			},
+			&cli.BoolFlag{
+				Name:     "packet-trace",
+				Usage:    "Show all packets sent and received",
+				Category: "OUTPUT MODES:",
+			},
+			&cli.PathFlag{
+				Name:     "pcap-out",
+				Usage:    "Write all packets sent and received to a pcapng file",
+				Category: "OUTPUT MODES:",
+			},
 			&cli.BoolFlag{
 				Name:     "service",
 				Aliases:  []string{"sV"},
@@ -53,11 +193,128 @@ func main() {
 				Value:    false,
 				Category: "SERVICE/VERSION DETECTION:",
 			},
+			&cli.IntFlag{
+				Name:     "version-workers",
+				Usage:    "Number of open ports probed at once during version detection",
+				Value:    20,
+				Category: "SERVICE/VERSION DETECTION:",
+			},
+			&cli.DurationFlag{
+				Name:     "connect-timeout",
+				Usage:    "Timeout for connecting to each open port during version detection",
+				Value:    5 * time.Second,
+				Category: "SERVICE/VERSION DETECTION:",
+			},
+			&cli.DurationFlag{
+				Name:     "read-timeout",
+				Usage:    "Timeout for reading a reply from each open port during version detection",
+				Value:    5 * time.Second,
+				Category: "SERVICE/VERSION DETECTION:",
+			},
+			&cli.IntFlag{
+				Name:     "version-intensity",
+				Usage:    "Only send probes up to this rarity (0-9). Higher is slower but identifies more services",
+				Value:    services.DefaultIntensity,
+				Category: "SERVICE/VERSION DETECTION:",
+			},
+			&cli.PathFlag{
+				Name:     "service-probes",
+				Usage:    "Use this nmap-service-probes file instead of the built-in probes",
+				Category: "SERVICE/VERSION DETECTION:",
+			},
+			&cli.PathFlag{
+				Name:     "vulners-db",
+				Usage:    "Match detected versions against this offline CVE feed (JSON or CSV) and list the CVEs affecting them",
+				Category: "SERVICE/VERSION DETECTION:",
+			},
+			&cli.Float64Flag{
+				Name:     "min-cvss",
+				Usage:    "Only list CVEs with at least this CVSS score",
+				Category: "SERVICE/VERSION DETECTION:",
+			},
+			&cli.BoolFlag{
+				Name:     "db-logins",
+				Usage:    "Let -sV try logging in to MySQL as root and PostgreSQL as postgres with an empty password. These show up in auth logs",
+				Category: "SERVICE/VERSION DETECTION:",
+			},
+			&cli.BoolFlag{
+				Name:     "os",
+				Aliases:  []string{"O"},
+				Usage:    "Enable OS detection, fingerprinting the TCP/IP stack of hosts with an open port",
+				Category: "OS DETECTION:",
+			},
+			&cli.PathFlag{
+				Name:     "os-db",
+				Usage:    "Use this nmap-os-db file instead of the built-in OS fingerprints",
+				Category: "OS DETECTION:",
+			},
+			&cli.DurationFlag{
+				Name:     "os-timeout",
+				Usage:    "How long to wait for replies after the last OS detection probe",
+				Value:    2 * time.Second,
+				Category: "OS DETECTION:",
+			},
+			&cli.BoolFlag{
+				Name:     "default-scripts",
+				Aliases:  []string{"sC"},
+				Usage:    "Run the scripts of the default category, same as --script default",
+				Category: "SCRIPT SCAN:",
+			},
+			&cli.StringFlag{
+				Name:     "script",
+				Usage:    "Comma separated list of scripts to run: categories (default, safe, discovery, vuln), script names, files, directories or all",
+				Category: "SCRIPT SCAN:",
+			},
+			&cli.StringFlag{
+				Name:     "script-args",
+				Usage:    "Arguments for the scripts, e.g. http-robots.limit=50,ftp-anon.password=guest@",
+				Category: "SCRIPT SCAN:",
+			},
+			&cli.DurationFlag{
+				Name:     "script-timeout",
+				Usage:    "Timeout for a single script against a single port or host",
+				Value:    30 * time.Second,
+				Category: "SCRIPT SCAN:",
+			},
+			&cli.IntFlag{
+				Name:     "script-workers",
+				Usage:    "Number of scripts and checks run at once",
+				Value:    20,
+				Category: "SCRIPT SCAN:",
+			},
+			&cli.PathFlag{
+				Name:     "checks",
+				Usage:    "Run the YAML checks in this directory, or this single check file, against open ports",
+				Category: "SCRIPT SCAN:",
+			},
+			&cli.DurationFlag{
+				Name:     "check-timeout",
+				Usage:    "Timeout for connecting, each read and HTTP requests of the checks",
+				Value:    5 * time.Second,
+				Category: "SCRIPT SCAN:",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "replay",
+				Usage: "Rebuild port states from a recorded capture",
+				Flags: []cli.Flag{
+					&cli.PathFlag{
+						Name:     "pcap",
+						Usage:    "The pcap or pcapng file to replay",
+						Required: true,
+					},
+				},
+				Action: gomapcli.ReplayRunner,
+			},
 		},
 		Before: func(c *cli.Context) error {
 			if !c.Bool("quiet") {
 				PrintBanner()
-				ScanInfo(c)
+				// Subcommands don't scan a target, so there's no scan info to print
+				if !c.Args().Present() {
+					ScanInfo(c)
+				}
 			}
 			return nil
 		},
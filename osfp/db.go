@@ -0,0 +1,275 @@
+package osfp
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// builtinDB is a subset of nmap-os-db covering the common general purpose systems
+//
+//go:embed nmap-os-db
+var builtinDB []byte
+
+// Class is the classification of a reference fingerprint, like Linux | Linux | 5.X | general purpose
+type Class struct {
+	Vendor     string `json:"vendor"`
+	Family     string `json:"family"`
+	Generation string `json:"generation,omitempty"`
+	DeviceType string `json:"device_type"`
+}
+
+// Reference is a fingerprint of a known system
+type Reference struct {
+	Name        string
+	Classes     []Class
+	CPEs        []string
+	Fingerprint Fingerprint
+}
+
+// DB is a database of reference fingerprints, and how many points each attribute is worth when matching
+type DB struct {
+	matchPoints map[string]map[string]int
+	references  []*Reference
+}
+
+// Match is a reference fingerprint a host matched
+type Match struct {
+	Name string `json:"name"`
+	// Accuracy is the share of the points of the compared attributes that matched, in percent
+	Accuracy int      `json:"accuracy"`
+	Classes  []Class  `json:"classes,omitempty"`
+	CPEs     []string `json:"cpe,omitempty"`
+}
+
+var (
+	defaultDB     *DB
+	defaultDBErr  error
+	defaultDBOnce sync.Once
+)
+
+// DefaultDB returns the built-in database, parsing it on first use
+func DefaultDB() (*DB, error) {
+	defaultDBOnce.Do(func() {
+		defaultDB, defaultDBErr = Parse(builtinDB)
+	})
+	return defaultDB, defaultDBErr
+}
+
+// LoadDB reads a database in the nmap-os-db format
+func LoadDB(path string) (*DB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OS database: %w", err)
+	}
+	db, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing OS database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Parse parses a database in the nmap-os-db format: a MatchPoints block followed by Fingerprint blocks,
+// each with its Class and CPE lines and one line per test
+func Parse(data []byte) (*DB, error) {
+	db := &DB{}
+	var current *Reference
+	inMatchPoints := false
+	var matchPoints Fingerprint
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyword, rest, _ := strings.Cut(line, " ")
+		switch keyword {
+		case "MatchPoints":
+			inMatchPoints, current = true, nil
+		case "Fingerprint":
+			inMatchPoints = false
+			current = &Reference{Name: strings.TrimSpace(rest)}
+			db.references = append(db.references, current)
+		case "Class":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: Class outside of a fingerprint", lineNumber)
+			}
+			fields := strings.Split(rest, "|")
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("line %d: invalid class '%s'", lineNumber, rest)
+			}
+			current.Classes = append(current.Classes, Class{
+				Vendor:     strings.TrimSpace(fields[0]),
+				Family:     strings.TrimSpace(fields[1]),
+				Generation: strings.TrimSpace(fields[2]),
+				DeviceType: strings.TrimSpace(fields[3]),
+			})
+		case "CPE":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: CPE outside of a fingerprint", lineNumber)
+			}
+			// The auto flag marks CPEs nmap generated from the class
+			current.CPEs = append(current.CPEs, strings.TrimSuffix(strings.TrimSpace(rest), " auto"))
+		default:
+			test, err := parseTest(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			switch {
+			case inMatchPoints:
+				matchPoints.Tests = append(matchPoints.Tests, test)
+			case current != nil:
+				current.Fingerprint.Tests = append(current.Fingerprint.Tests, test)
+			default:
+				return nil, fmt.Errorf("line %d: test outside of a fingerprint", lineNumber)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(matchPoints.Tests) == 0 {
+		return nil, fmt.Errorf("missing MatchPoints")
+	}
+	db.matchPoints = make(map[string]map[string]int)
+	for _, test := range matchPoints.Tests {
+		db.matchPoints[test.Name] = make(map[string]int)
+		for _, attr := range test.Attrs {
+			points, err := strconv.Atoi(attr.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid points '%s' for %s.%s", attr.Value, test.Name, attr.Name)
+			}
+			db.matchPoints[test.Name][attr.Name] = points
+		}
+	}
+	return db, nil
+}
+
+// parseTest parses a test line like T1(R=Y%DF=Y%T=40)
+func parseTest(line string) (Test, error) {
+	open := strings.IndexByte(line, '(')
+	if open <= 0 || !strings.HasSuffix(line, ")") {
+		return Test{}, fmt.Errorf("invalid test '%s'", line)
+	}
+
+	test := Test{Name: line[:open]}
+	body := line[open+1 : len(line)-1]
+	if body == "" {
+		return test, nil
+	}
+	for _, attr := range strings.Split(body, "%") {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok || name == "" {
+			return Test{}, fmt.Errorf("invalid attribute '%s' in test %s", attr, test.Name)
+		}
+		test.Attrs = append(test.Attrs, Attr{Name: name, Value: value})
+	}
+	return test, nil
+}
+
+// Len returns the number of reference fingerprints
+func (db *DB) Len() int {
+	return len(db.references)
+}
+
+// Match compares a fingerprint against every reference and returns the ones scoring at least minAccuracy percent,
+// best first
+func (db *DB) Match(fp *Fingerprint, minAccuracy int) []Match {
+	var matches []Match
+	for _, reference := range db.references {
+		accuracy := db.score(fp, &reference.Fingerprint)
+		if accuracy < minAccuracy {
+			continue
+		}
+		matches = append(matches, Match{
+			Name:     reference.Name,
+			Accuracy: accuracy,
+			Classes:  reference.Classes,
+			CPEs:     reference.CPEs,
+		})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Accuracy > matches[j].Accuracy
+	})
+	return matches
+}
+
+// score returns the share of the points of the attributes present in both fingerprints that matched, in percent
+func (db *DB) score(fp, reference *Fingerprint) int {
+	possible, matched := 0, 0
+	for _, refTest := range reference.Tests {
+		test := fp.test(refTest.Name)
+		if test == nil {
+			continue
+		}
+		for _, refAttr := range refTest.Attrs {
+			value, ok := test.attr(refAttr.Name)
+			if !ok {
+				continue
+			}
+			points := db.matchPoints[refTest.Name][refAttr.Name]
+			possible += points
+			if matchExpr(refAttr.Value, value) {
+				matched += points
+			}
+		}
+	}
+	if possible == 0 {
+		return 0
+	}
+	return matched * 100 / possible
+}
+
+// attr returns the value of an attribute of the test
+func (t *Test) attr(name string) (string, bool) {
+	for _, attr := range t.Attrs {
+		if attr.Name == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// matchExpr matches a value against an expression of a reference fingerprint: alternatives separated by |,
+// each one a literal, a hex range like 3B-45, or a hex bound like >10 or <10
+func matchExpr(expr, value string) bool {
+	for _, alternative := range strings.Split(expr, "|") {
+		if alternative == value {
+			return true
+		}
+		n, err := strconv.ParseUint(value, 16, 64)
+		if err != nil || alternative == "" {
+			continue
+		}
+
+		switch {
+		case alternative[0] == '>':
+			if bound, err := strconv.ParseUint(alternative[1:], 16, 64); err == nil && n > bound {
+				return true
+			}
+		case alternative[0] == '<':
+			if bound, err := strconv.ParseUint(alternative[1:], 16, 64); err == nil && n < bound {
+				return true
+			}
+		case strings.Contains(alternative, "-"):
+			low, high, _ := strings.Cut(alternative, "-")
+			lowN, lowErr := strconv.ParseUint(low, 16, 64)
+			highN, highErr := strconv.ParseUint(high, 16, 64)
+			if lowErr == nil && highErr == nil && n >= lowN && n <= highN {
+				return true
+			}
+		}
+	}
+	return false
+}
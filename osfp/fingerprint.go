@@ -0,0 +1,622 @@
+package osfp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// Attr is a single attribute of a test, like W=FFFF. In a reference fingerprint the value is an expression
+type Attr struct {
+	Name, Value string
+}
+
+// Test is a line of a fingerprint, like WIN(W1=FFFF%W2=FFFF)
+type Test struct {
+	Name  string
+	Attrs []Attr
+}
+
+// Fingerprint is a list of tests, in the order nmap prints them
+type Fingerprint struct {
+	Tests []Test
+}
+
+// String formats the fingerprint the way nmap prints the fingerprint of a host it couldn't identify
+func (f *Fingerprint) String() string {
+	var lines []string
+	for _, test := range f.Tests {
+		var attrs []string
+		for _, attr := range test.Attrs {
+			attrs = append(attrs, attr.Name+"="+attr.Value)
+		}
+		lines = append(lines, test.Name+"("+strings.Join(attrs, "%")+")")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// test returns the test of the given name, or nil if the fingerprint doesn't have it
+func (f *Fingerprint) test(name string) *Test {
+	for i := range f.Tests {
+		if f.Tests[i].Name == name {
+			return &f.Tests[i]
+		}
+	}
+	return nil
+}
+
+// add appends an attribute to the test, skipping values that couldn't be computed
+func (t *Test) add(name, value string) {
+	if value != "" {
+		t.Attrs = append(t.Attrs, Attr{Name: name, Value: value})
+	}
+}
+
+// hex formats a number the way fingerprints do
+func hex(n uint64) string {
+	return fmt.Sprintf("%X", n)
+}
+
+// reply is what the tests read from the reply to a probe
+type reply struct {
+	ip   *layers.IPv4
+	tcp  *layers.TCP
+	icmp *layers.ICMPv4
+}
+
+// replyOf decodes the reply to a probe, or returns nil if it got none
+func replyOf(probe *Probe) *reply {
+	if probe == nil || probe.Reply == nil {
+		return nil
+	}
+	ip, ok := probe.Reply.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return nil
+	}
+	r := &reply{ip: ip}
+	r.tcp, _ = probe.Reply.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	r.icmp, _ = probe.Reply.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	return r
+}
+
+// Compute builds the fingerprint of a host from the replies to the probes
+func Compute(probes []*Probe) *Fingerprint {
+	byName := make(map[string]*Probe)
+	for _, probe := range probes {
+		byName[probe.Name] = probe
+	}
+
+	// The hop distance, from the TTL the target saw on U1, turns reply TTLs into initial TTLs
+	distance := 0
+	if r := replyOf(byName["U1"]); r != nil && r.icmp != nil {
+		if header, _ := quoted(r.icmp); header != nil && header[8] <= u1TTL {
+			distance = int(u1TTL-header[8]) + 1
+		}
+	}
+
+	fp := &Fingerprint{}
+	var seqProbes []*Probe
+	for i := 1; i <= 6; i++ {
+		seqProbes = append(seqProbes, byName[fmt.Sprintf("SEQ%d", i)])
+	}
+
+	if seq := seqTest(seqProbes, byName); len(seq.Attrs) > 0 {
+		fp.Tests = append(fp.Tests, seq)
+	}
+
+	ops, win := Test{Name: "OPS"}, Test{Name: "WIN"}
+	for i, probe := range seqProbes {
+		if r := replyOf(probe); r != nil && r.tcp != nil && r.tcp.SYN && r.tcp.ACK {
+			ops.Attrs = append(ops.Attrs, Attr{Name: fmt.Sprintf("O%d", i+1), Value: options(r.tcp)})
+			win.add(fmt.Sprintf("W%d", i+1), hex(uint64(r.tcp.Window)))
+		}
+	}
+	if len(ops.Attrs) > 0 {
+		fp.Tests = append(fp.Tests, ops, win)
+	}
+
+	fp.Tests = append(fp.Tests, ecnTest(byName["ECN"], distance))
+	// T1 is the reply to the first SEQ probe
+	fp.Tests = append(fp.Tests, tcpTest("T1", seqProbes[0], distance))
+	for i := 2; i <= 7; i++ {
+		name := fmt.Sprintf("T%d", i)
+		fp.Tests = append(fp.Tests, tcpTest(name, byName[name], distance))
+	}
+	fp.Tests = append(fp.Tests, u1Test(byName["U1"], distance), ieTest(byName["IE1"], byName["IE2"], distance))
+	return fp
+}
+
+// seqTest computes the ISN, IP ID and timestamp sequence tests from the replies to the SEQ probes
+func seqTest(seqProbes []*Probe, byName map[string]*Probe) Test {
+	test := Test{Name: "SEQ"}
+
+	var isns []uint32
+	var sent []time.Time
+	var tcpIDs []uint16
+	var tsvals []uint32
+	timestamps := true
+	for _, probe := range seqProbes {
+		r := replyOf(probe)
+		if r == nil || r.tcp == nil || !r.tcp.SYN || !r.tcp.ACK {
+			continue
+		}
+		isns = append(isns, r.tcp.Seq)
+		sent = append(sent, probe.Sent)
+		tcpIDs = append(tcpIDs, r.ip.Id)
+		if tsval, ok := tsval(r.tcp); ok {
+			tsvals = append(tsvals, tsval)
+		} else {
+			timestamps = false
+		}
+	}
+
+	if len(isns) >= 2 {
+		var diffs []uint32
+		var rates []float64
+		gcd := uint32(0)
+		for i := 1; i < len(isns); i++ {
+			diff := modDiff(isns[i], isns[i-1])
+			diffs = append(diffs, diff)
+			gcd = gcdOf(gcd, diff)
+			elapsed := sent[i].Sub(sent[i-1]).Seconds()
+			if elapsed <= 0 {
+				elapsed = seqInterval.Seconds()
+			}
+			rates = append(rates, float64(diff)/elapsed)
+		}
+
+		var sum float64
+		for _, rate := range rates {
+			sum += rate
+		}
+		average := sum / float64(len(rates))
+
+		// SP is the standard deviation of the rates, after dividing them by the GCD when it's above 9
+		if len(isns) >= 4 {
+			divisor := 1.0
+			if gcd > 9 {
+				divisor = float64(gcd)
+			}
+			var variance float64
+			for _, rate := range rates {
+				variance += math.Pow(rate/divisor-average/divisor, 2)
+			}
+			deviation := math.Sqrt(variance / float64(len(rates)))
+			sp := 0
+			if deviation > 1 {
+				sp = int(math.Round(8 * math.Log2(deviation)))
+			}
+			test.add("SP", hex(uint64(sp)))
+		}
+
+		test.add("GCD", hex(uint64(gcd)))
+		isr := 0
+		if average >= 1 {
+			isr = int(math.Round(8 * math.Log2(average)))
+		}
+		test.add("ISR", hex(uint64(isr)))
+	}
+
+	var closedIDs, icmpIDs []uint16
+	for _, name := range []string{"T5", "T6", "T7"} {
+		if r := replyOf(byName[name]); r != nil {
+			closedIDs = append(closedIDs, r.ip.Id)
+		}
+	}
+	for _, name := range []string{"IE1", "IE2"} {
+		if r := replyOf(byName[name]); r != nil {
+			icmpIDs = append(icmpIDs, r.ip.Id)
+		}
+	}
+
+	ti, ci, ii := "", "", ""
+	if len(tcpIDs) >= 3 {
+		ti = ipIDSequence(tcpIDs, true)
+	}
+	if len(closedIDs) >= 2 {
+		ci = ipIDSequence(closedIDs, true)
+	}
+	if len(icmpIDs) == 2 {
+		ii = ipIDSequence(icmpIDs, false)
+	}
+	test.add("TI", ti)
+	test.add("CI", ci)
+	test.add("II", ii)
+
+	// SS tells whether ICMP shares the IP ID sequence of TCP
+	if ti != "" && ti == ii && (ti == "RI" || ti == "BI" || ti == "I") {
+		average := float64(uint16(tcpIDs[len(tcpIDs)-1]-tcpIDs[0])) / float64(len(tcpIDs)-1)
+		if float64(uint16(icmpIDs[0]-tcpIDs[len(tcpIDs)-1])) < 3*average {
+			test.add("SS", "S")
+		} else {
+			test.add("SS", "O")
+		}
+	}
+
+	if len(isns) > 0 {
+		test.add("TS", timestampRate(tsvals, sent, timestamps))
+	}
+	return test
+}
+
+// modDiff returns the distance between two sequence numbers, whichever way it wraps
+func modDiff(a, b uint32) uint32 {
+	return min(a-b, b-a)
+}
+
+// gcdOf returns the greatest common divisor of two numbers
+func gcdOf(a, b uint32) uint32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// ipIDSequence classifies a sequence of IP IDs. RD doesn't apply to the two ICMP replies, they're too few to tell
+func ipIDSequence(ids []uint16, allowRandom bool) string {
+	zero, same := true, true
+	var diffs []uint16
+	for i, id := range ids {
+		zero = zero && id == 0
+		if i > 0 {
+			diffs = append(diffs, ids[i]-ids[i-1])
+			same = same && id == ids[0]
+		}
+	}
+
+	switch {
+	case zero:
+		return "Z"
+	case allowRandom && anyDiff(diffs, func(d uint16) bool { return d >= 20000 }):
+		return "RD"
+	case same:
+		return hex(uint64(ids[0]))
+	case anyDiff(diffs, func(d uint16) bool { return d > 1000 && d%256 != 0 }):
+		return "RI"
+	case !anyDiff(diffs, func(d uint16) bool { return d%256 != 0 || d > 5120 }):
+		return "BI"
+	case !anyDiff(diffs, func(d uint16) bool { return d >= 10 }):
+		return "I"
+	}
+	return ""
+}
+
+// anyDiff returns true if any of the differences satisfies the predicate
+func anyDiff(diffs []uint16, predicate func(uint16) bool) bool {
+	for _, diff := range diffs {
+		if predicate(diff) {
+			return true
+		}
+	}
+	return false
+}
+
+// tsval returns the TSval of the timestamp option of a segment
+func tsval(tcp *layers.TCP) (uint32, bool) {
+	for _, option := range tcp.Options {
+		if option.OptionType == layers.TCPOptionKindTimestamps && len(option.OptionData) >= 8 {
+			return binary.BigEndian.Uint32(option.OptionData), true
+		}
+	}
+	return 0, false
+}
+
+// timestampRate classifies how fast the TCP timestamp clock of the host ticks
+func timestampRate(tsvals []uint32, sent []time.Time, timestamps bool) string {
+	if !timestamps {
+		return "U"
+	}
+	for _, value := range tsvals {
+		if value == 0 {
+			return "0"
+		}
+	}
+	if len(tsvals) < 2 {
+		return ""
+	}
+
+	var sum float64
+	for i := 1; i < len(tsvals); i++ {
+		elapsed := sent[i].Sub(sent[i-1]).Seconds()
+		if elapsed <= 0 {
+			elapsed = seqInterval.Seconds()
+		}
+		sum += float64(tsvals[i]-tsvals[i-1]) / elapsed
+	}
+	average := sum / float64(len(tsvals)-1)
+
+	// The common clock rates of 1, 100 and 200 Hz get fixed values, the rest their binary logarithm
+	switch {
+	case average > 0 && average <= 5.66:
+		return "1"
+	case average > 70 && average <= 150:
+		return "7"
+	case average > 150 && average <= 350:
+		return "8"
+	case average <= 0:
+		return ""
+	}
+	return hex(uint64(math.Round(math.Log2(average))))
+}
+
+// options formats the options of a segment, like M5B4NW8ST11
+func options(tcp *layers.TCP) string {
+	var builder strings.Builder
+	for _, option := range tcp.Options {
+		switch option.OptionType {
+		case layers.TCPOptionKindEndList:
+			builder.WriteString("L")
+		case layers.TCPOptionKindNop:
+			builder.WriteString("N")
+		case layers.TCPOptionKindMSS:
+			if len(option.OptionData) == 2 {
+				builder.WriteString("M" + hex(uint64(binary.BigEndian.Uint16(option.OptionData))))
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(option.OptionData) == 1 {
+				builder.WriteString("W" + hex(uint64(option.OptionData[0])))
+			}
+		case layers.TCPOptionKindTimestamps:
+			if len(option.OptionData) == 8 {
+				builder.WriteString("T" + nonZero(option.OptionData[:4]) + nonZero(option.OptionData[4:]))
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			builder.WriteString("S")
+		}
+	}
+	return builder.String()
+}
+
+// nonZero returns 1 if any of the bytes is set, 0 otherwise
+func nonZero(data []byte) string {
+	for _, b := range data {
+		if b != 0 {
+			return "1"
+		}
+	}
+	return "0"
+}
+
+// ttlAttrs adds the initial TTL of a reply: exact when the hop distance is known, a guess otherwise
+func ttlAttrs(test *Test, ip *layers.IPv4, distance int) {
+	if distance > 0 {
+		test.add("T", hex(uint64(int(ip.TTL)+distance-1)))
+		return
+	}
+	for _, initial := range []uint8{32, 64, 128, 255} {
+		if ip.TTL <= initial {
+			test.add("TG", hex(uint64(initial)))
+			return
+		}
+	}
+}
+
+// dontFragment returns Y if the reply has DF set
+func dontFragment(ip *layers.IPv4) string {
+	if ip.Flags&layers.IPv4DontFragment != 0 {
+		return "Y"
+	}
+	return "N"
+}
+
+// ecnTest computes the test of the reply to the ECN probe
+func ecnTest(probe *Probe, distance int) Test {
+	test := Test{Name: "ECN"}
+	r := replyOf(probe)
+	if r == nil || r.tcp == nil {
+		test.add("R", "N")
+		return test
+	}
+
+	test.add("R", "Y")
+	test.add("DF", dontFragment(r.ip))
+	ttlAttrs(&test, r.ip, distance)
+	test.add("W", hex(uint64(r.tcp.Window)))
+	test.Attrs = append(test.Attrs, Attr{Name: "O", Value: options(r.tcp)})
+
+	switch {
+	case r.tcp.ECE && r.tcp.CWR:
+		test.add("CC", "S")
+	case r.tcp.ECE:
+		test.add("CC", "Y")
+	case r.tcp.CWR:
+		test.add("CC", "O")
+	default:
+		test.add("CC", "N")
+	}
+	test.Attrs = append(test.Attrs, Attr{Name: "Q", Value: quirks(r.tcp)})
+	return test
+}
+
+// tcpTest computes the test of the reply to T1-T7
+func tcpTest(name string, probe *Probe, distance int) Test {
+	test := Test{Name: name}
+	r := replyOf(probe)
+	if r == nil || r.tcp == nil {
+		test.add("R", "N")
+		return test
+	}
+
+	test.add("R", "Y")
+	test.add("DF", dontFragment(r.ip))
+	ttlAttrs(&test, r.ip, distance)
+	// T1 has its window and options in WIN and OPS
+	if name != "T1" {
+		test.add("W", hex(uint64(r.tcp.Window)))
+	}
+
+	switch r.tcp.Seq {
+	case 0:
+		test.add("S", "Z")
+	case probe.ack:
+		test.add("S", "A")
+	case probe.ack + 1:
+		test.add("S", "A+")
+	default:
+		test.add("S", "O")
+	}
+	switch r.tcp.Ack {
+	case 0:
+		test.add("A", "Z")
+	case probe.seq:
+		test.add("A", "S")
+	case probe.seq + 1:
+		test.add("A", "S+")
+	default:
+		test.add("A", "O")
+	}
+
+	var flags strings.Builder
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{{r.tcp.ECE, "E"}, {r.tcp.URG, "U"}, {r.tcp.ACK, "A"}, {r.tcp.PSH, "P"}, {r.tcp.RST, "R"}, {r.tcp.SYN, "S"}, {r.tcp.FIN, "F"}} {
+		if flag.set {
+			flags.WriteString(flag.name)
+		}
+	}
+	test.Attrs = append(test.Attrs, Attr{Name: "F", Value: flags.String()})
+	if name != "T1" {
+		test.Attrs = append(test.Attrs, Attr{Name: "O", Value: options(r.tcp)})
+	}
+
+	// RD is a checksum of the data some stacks put in their resets
+	rd := uint32(0)
+	if r.tcp.RST && len(r.tcp.Payload) > 0 {
+		rd = crc32.ChecksumIEEE(r.tcp.Payload)
+	}
+	test.add("RD", hex(uint64(rd)))
+	test.Attrs = append(test.Attrs, Attr{Name: "Q", Value: quirks(r.tcp)})
+	return test
+}
+
+// quirks lists the odd header values of a reply: R for a reserved bit set, U for an urgent pointer without URG
+func quirks(tcp *layers.TCP) string {
+	var q string
+	if len(tcp.Contents) > 12 && tcp.Contents[12]&0x0e != 0 {
+		q += "R"
+	}
+	if tcp.Urgent != 0 && !tcp.URG {
+		q += "U"
+	}
+	return q
+}
+
+// u1Test computes the test of the port unreachable the U1 probe got
+func u1Test(probe *Probe, distance int) Test {
+	test := Test{Name: "U1"}
+	r := replyOf(probe)
+	if r == nil || r.icmp == nil {
+		test.add("R", "N")
+		return test
+	}
+	header, udp := quoted(r.icmp)
+	if header == nil {
+		test.add("R", "N")
+		return test
+	}
+
+	test.add("R", "Y")
+	test.add("DF", dontFragment(r.ip))
+	ttlAttrs(&test, r.ip, distance)
+	test.add("IPL", hex(uint64(r.ip.Length)))
+	// The unused field of the ICMP header, which gopacket decodes as the ID and sequence
+	test.add("UN", hex(uint64(r.icmp.Id)<<16|uint64(r.icmp.Seq)))
+
+	sent := probe.Packet
+	if length := binary.BigEndian.Uint16(header[2:]); length == binary.BigEndian.Uint16(sent[2:]) {
+		test.add("RIPL", "G")
+	} else {
+		test.add("RIPL", hex(uint64(length)))
+	}
+	if id := binary.BigEndian.Uint16(header[4:]); id == u1ID {
+		test.add("RID", "G")
+	} else {
+		test.add("RID", hex(uint64(id)))
+	}
+
+	// The routers on the way changed the TTL, so the checksum is checked against the header as returned
+	switch checksum := binary.BigEndian.Uint16(header[10:]); {
+	case checksum == 0:
+		test.add("RIPCK", "Z")
+	case checksum == ipChecksum(header):
+		test.add("RIPCK", "G")
+	default:
+		test.add("RIPCK", "I")
+	}
+
+	if len(udp) >= 8 {
+		if checksum := binary.BigEndian.Uint16(udp[6:]); checksum == binary.BigEndian.Uint16(sent[26:]) {
+			test.add("RUCK", "G")
+		} else {
+			test.add("RUCK", hex(uint64(checksum)))
+		}
+		rud := "G"
+		for _, b := range udp[8:] {
+			if b != 'C' {
+				rud = "I"
+				break
+			}
+		}
+		test.add("RUD", rud)
+	}
+	return test
+}
+
+// ipChecksum computes the checksum an IPv4 header should have
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		if i == 10 {
+			continue
+		}
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// ieTest computes the test of the replies to the two echo requests
+func ieTest(first, second *Probe, distance int) Test {
+	test := Test{Name: "IE"}
+	r1, r2 := replyOf(first), replyOf(second)
+	if r1 == nil || r2 == nil || r1.icmp == nil || r2.icmp == nil {
+		test.add("R", "N")
+		return test
+	}
+
+	test.add("R", "Y")
+	df1, df2 := dontFragment(r1.ip) == "Y", dontFragment(r2.ip) == "Y"
+	switch {
+	case !df1 && !df2:
+		test.add("DFI", "N")
+	case df1 && !df2:
+		// Only the first probe had DF set, so the host echoes it
+		test.add("DFI", "S")
+	case df1 && df2:
+		test.add("DFI", "Y")
+	default:
+		test.add("DFI", "O")
+	}
+	ttlAttrs(&test, r1.ip, distance)
+
+	code1, code2 := r1.icmp.TypeCode.Code(), r2.icmp.TypeCode.Code()
+	switch {
+	case code1 == 0 && code2 == 0:
+		test.add("CD", "Z")
+	case code1 == 9 && code2 == 0:
+		test.add("CD", "S")
+	case code1 == code2:
+		test.add("CD", hex(uint64(code1)))
+	default:
+		test.add("CD", "O")
+	}
+	return test
+}
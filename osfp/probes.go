@@ -0,0 +1,233 @@
+// The osfp package fingerprints the TCP/IP stack of a host with nmap's OS detection probes and matches
+// the fingerprint against a database in the nmap-os-db format.
+package osfp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/0niSec/gomap/factory"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+const (
+	// SourcePorts is how many source ports [BuildProbes] needs, one per TCP and UDP probe
+	SourcePorts = 14
+	// seqInterval is the time between the SEQ probes, which the ISN and timestamp rates are measured over
+	seqInterval = 100 * time.Millisecond
+	// u1ID is the IP ID of the U1 probe, which the returned header is checked against
+	u1ID = 0x1042
+	// u1TTL is the TTL of the U1 probe, which the hop distance is measured from
+	u1TTL = 64
+)
+
+// Probe is one of the packets of the OS detection probe set, along with the first reply it got
+type Probe struct {
+	// Name is SEQ1-SEQ6, ECN, T2-T7, IE1, IE2 or U1
+	Name string
+	// Packet is the probe, starting at the IPv4 header
+	Packet []byte
+	// Delay is how long to wait after the previous probe before sending this one
+	Delay time.Duration
+
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	icmpID, icmpSeq  uint16
+
+	// Sent is when the probe was sent, and Received when Reply arrived
+	Sent     time.Time
+	Reply    gopacket.Packet
+	Received time.Time
+}
+
+// tcpProbe is the part of a TCP probe that differs between probes
+type tcpProbe struct {
+	name    string
+	closed  bool
+	window  uint16
+	df      bool
+	flags   string
+	options []layers.TCPOption
+}
+
+// Shorthands for the options of the probes
+var (
+	optNOP  = layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1}
+	optEOL  = layers.TCPOption{OptionType: layers.TCPOptionKindEndList, OptionLength: 1}
+	optSACK = layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2}
+	// optTS is a timestamp option with TSval 0xFFFFFFFF and TSecr 0
+	optTS = layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}}
+)
+
+// optMSS returns a maximum segment size option
+func optMSS(mss uint16) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: binary.BigEndian.AppendUint16(nil, mss)}
+}
+
+// optWS returns a window scale option
+func optWS(shift byte) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{shift}}
+}
+
+// tcpProbes are the TCP probes in the order they're sent. The SEQ probes go to the open port 100ms apart,
+// and each one offers different options to see how the stack orders and answers them.
+var tcpProbes = []tcpProbe{
+	{name: "SEQ1", window: 1, flags: "S", options: []layers.TCPOption{optWS(10), optNOP, optMSS(1460), optTS, optSACK}},
+	{name: "SEQ2", window: 63, flags: "S", options: []layers.TCPOption{optMSS(1400), optWS(0), optSACK, optTS, optEOL}},
+	{name: "SEQ3", window: 4, flags: "S", options: []layers.TCPOption{optTS, optNOP, optNOP, optWS(5), optNOP, optMSS(640)}},
+	{name: "SEQ4", window: 4, flags: "S", options: []layers.TCPOption{optSACK, optTS, optWS(10), optEOL}},
+	{name: "SEQ5", window: 16, flags: "S", options: []layers.TCPOption{optMSS(536), optSACK, optTS, optWS(10), optEOL}},
+	{name: "SEQ6", window: 512, flags: "S", options: []layers.TCPOption{optMSS(265), optSACK, optTS}},
+	{name: "ECN", window: 3, flags: "SEC", options: []layers.TCPOption{optWS(10), optNOP, optMSS(1460), optSACK, optNOP, optNOP}},
+	{name: "T2", window: 128, df: true, flags: "", options: tOptions(10)},
+	{name: "T3", window: 256, flags: "SFUP", options: tOptions(10)},
+	{name: "T4", window: 1024, df: true, flags: "A", options: tOptions(10)},
+	{name: "T5", closed: true, window: 31337, flags: "S", options: tOptions(10)},
+	{name: "T6", closed: true, window: 32768, df: true, flags: "A", options: tOptions(10)},
+	{name: "T7", closed: true, window: 65535, flags: "FPU", options: tOptions(15)},
+}
+
+// tOptions are the options of the T2-T7 probes
+func tOptions(shift byte) []layers.TCPOption {
+	return []layers.TCPOption{optWS(shift), optNOP, optMSS(265), optTS, optSACK}
+}
+
+// BuildProbes builds the probe set: the TCP probes to an open and a closed TCP port, two ICMP echo requests
+// and a UDP datagram to a closed UDP port. Each TCP and UDP probe is sent from its own source port, so
+// replies can be told apart.
+func BuildProbes(srcIP, dstIP net.IP, openPort, closedPort, closedUDPPort uint16, srcPorts [SourcePorts]uint16) ([]*Probe, error) {
+	var probes []*Probe
+	seq, ack := rand.Uint32(), rand.Uint32()
+
+	for i, spec := range tcpProbes {
+		dstPort := openPort
+		if spec.closed {
+			dstPort = closedPort
+		}
+
+		tcp := &layers.TCP{
+			SrcPort: layers.TCPPort(srcPorts[i]),
+			DstPort: layers.TCPPort(dstPort),
+			Seq:     seq + uint32(i),
+			Window:  spec.window,
+			Options: spec.options,
+		}
+		for _, flag := range spec.flags {
+			switch flag {
+			case 'S':
+				tcp.SYN = true
+			case 'A':
+				tcp.ACK = true
+				tcp.Ack = ack
+			case 'F':
+				tcp.FIN = true
+			case 'P':
+				tcp.PSH = true
+			case 'U':
+				tcp.URG = true
+			case 'E':
+				tcp.ECE = true
+			case 'C':
+				// ECN also sets the reserved bit before CWR
+				tcp.CWR = true
+				tcp.NS = true
+			}
+		}
+		if spec.name == "ECN" {
+			tcp.Urgent = 0xF7F5
+		}
+
+		packet, err := factory.CreateTCPProbe(srcIP, dstIP, factory.IPFields{ID: uint16(rand.Uint32()), DF: spec.df}, tcp)
+		if err != nil {
+			return nil, err
+		}
+
+		probe := &Probe{Name: spec.name, Packet: packet, srcPort: srcPorts[i], dstPort: dstPort, seq: tcp.Seq, ack: tcp.Ack}
+		if i > 0 && i < 6 {
+			probe.Delay = seqInterval
+		}
+		probes = append(probes, probe)
+	}
+
+	// Two echo requests with different TOS, codes and sizes, the first one with DF set
+	icmpID := uint16(rand.Uint32())
+	for i, spec := range []struct {
+		tos, code uint8
+		size      int
+		df        bool
+	}{{0, 9, 120, true}, {4, 0, 150, false}} {
+		icmp := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, spec.code),
+			Id:       icmpID + uint16(i),
+			Seq:      295 + uint16(i),
+		}
+		packet, err := factory.CreateICMPProbe(srcIP, dstIP, factory.IPFields{ID: uint16(rand.Uint32()), TOS: spec.tos, DF: spec.df}, icmp, make([]byte, spec.size))
+		if err != nil {
+			return nil, err
+		}
+		probes = append(probes, &Probe{Name: "IE" + string(rune('1'+i)), Packet: packet, icmpID: icmp.Id, icmpSeq: icmp.Seq})
+	}
+
+	// 300 Cs to a closed UDP port, whose port unreachable quotes the datagram back
+	udpSrcPort := srcPorts[len(tcpProbes)]
+	packet, err := factory.CreateUDPProbe(srcIP, dstIP, factory.IPFields{ID: u1ID, TTL: u1TTL}, udpSrcPort, closedUDPPort, bytes.Repeat([]byte{'C'}, 300))
+	if err != nil {
+		return nil, err
+	}
+	probes = append(probes, &Probe{Name: "U1", Packet: packet, srcPort: udpSrcPort, dstPort: closedUDPPort})
+
+	return probes, nil
+}
+
+// Assign records packet as the reply to the probe it answers, unless that probe already got one.
+// It returns false if the packet doesn't answer any of the probes.
+func Assign(probes []*Probe, packet gopacket.Packet, received time.Time) bool {
+	for _, probe := range probes {
+		if probe.Reply == nil && probe.answeredBy(packet) {
+			probe.Reply = packet
+			probe.Received = received
+			return true
+		}
+	}
+	return false
+}
+
+// answeredBy returns true if the packet is a reply to the probe
+func (p *Probe) answeredBy(packet gopacket.Packet) bool {
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		return p.icmpSeq == 0 && p.Name != "U1" && uint16(tcp.SrcPort) == p.dstPort && uint16(tcp.DstPort) == p.srcPort
+	}
+
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok {
+		return false
+	}
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv4TypeEchoReply:
+		return p.icmpSeq != 0 && icmp.Id == p.icmpID && icmp.Seq == p.icmpSeq
+	case layers.ICMPv4TypeDestinationUnreachable:
+		if p.Name != "U1" {
+			return false
+		}
+		_, udp := quoted(icmp)
+		return len(udp) >= 4 && binary.BigEndian.Uint16(udp) == p.srcPort && binary.BigEndian.Uint16(udp[2:]) == p.dstPort
+	}
+	return false
+}
+
+// quoted splits the datagram an ICMP error quotes into its IP header and what follows it
+func quoted(icmp *layers.ICMPv4) ([]byte, []byte) {
+	data := icmp.Payload
+	if len(data) < 20 {
+		return nil, nil
+	}
+	headerLength := int(data[0]&0x0f) * 4
+	if headerLength < 20 || len(data) < headerLength {
+		return nil, nil
+	}
+	return data[:headerLength], data[headerLength:]
+}
@@ -0,0 +1,168 @@
+// The progress package keeps track of how far along a scan is.
+//
+// The counters are global, like the logger, so the scan engines can update them from any goroutine
+// without threading a tracker through every function.
+package progress
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	probesSent      atomic.Uint64
+	probesTotal     atomic.Uint64
+	replies         atomic.Uint64
+	retransmissions atomic.Uint64
+	hostsDone       atomic.Uint64
+	hostsTotal      atomic.Uint64
+
+	verbosity atomic.Int32
+	debugging atomic.Int32
+
+	startTime  time.Time
+	startMutex sync.Mutex
+)
+
+// Start resets the counters for a new scan of totalProbes probes over totalHosts hosts
+func Start(totalProbes, totalHosts uint64) {
+	startMutex.Lock()
+	startTime = time.Now()
+	startMutex.Unlock()
+
+	probesSent.Store(0)
+	replies.Store(0)
+	retransmissions.Store(0)
+	hostsDone.Store(0)
+	probesTotal.Store(totalProbes)
+	hostsTotal.Store(totalHosts)
+}
+
+// AddHost grows the scan by a host found while scanning, with its probes
+func AddHost(probes uint64) {
+	probesTotal.Add(probes)
+	hostsTotal.Add(1)
+}
+
+// ProbeSent counts a port scan probe put on the wire, including retransmissions.
+// A probe is one attempt at a port, however many packets it takes. Packets sent after the port scan, like the
+// OS detection and traceroute probes, aren't counted.
+func ProbeSent() {
+	probesSent.Add(1)
+}
+
+// Retransmission counts a probe that was sent again because the first one got no reply
+func Retransmission() {
+	retransmissions.Add(1)
+}
+
+// ReplyReceived counts a reply that matched one of our probes
+func ReplyReceived() {
+	replies.Add(1)
+}
+
+// HostDone counts a host whose scan is finished
+func HostDone() {
+	hostsDone.Add(1)
+}
+
+// Discovered is called for every port a reply was received from, protocol being "tcp" or "udp".
+// Open ports are printed right away when verbosity is raised, so they show up long before the final report.
+func Discovered(target string, port uint16, protocol, status string) {
+	if status == "open" && Verbosity() > 0 {
+		fmt.Printf("Discovered open port %d/%s on %s\n", port, protocol, target)
+	}
+}
+
+// Verbosity returns the current verbosity level
+func Verbosity() int {
+	return int(verbosity.Load())
+}
+
+// SetVerbosity sets the verbosity level
+func SetVerbosity(level int) {
+	verbosity.Store(int32(level))
+}
+
+// IncreaseVerbosity raises the verbosity level by one and returns the new level
+func IncreaseVerbosity() int {
+	return int(verbosity.Add(1))
+}
+
+// Debugging returns the current debugging level
+func Debugging() int {
+	return int(debugging.Load())
+}
+
+// SetDebugging sets the debugging level
+func SetDebugging(level int) {
+	debugging.Store(int32(level))
+}
+
+// IncreaseDebugging raises the debugging level by one and returns the new level
+func IncreaseDebugging() int {
+	return int(debugging.Add(1))
+}
+
+// Status returns a one line summary of the scan, e.g.
+//
+//	Stats: 0:00:12 elapsed; 1/3 hosts completed; 1234/3000 probes sent (41.13%); 56 replies; 2 retransmissions; ETA: 0:00:17
+func Status() string {
+	startMutex.Lock()
+	elapsed := time.Since(startTime)
+	startMutex.Unlock()
+
+	sent := probesSent.Load() - retransmissions.Load()
+	total := probesTotal.Load()
+
+	var percent float64
+	if total > 0 {
+		percent = float64(sent) / float64(total) * 100
+	}
+
+	// Assume the rest of the probes go out as fast as the ones so far
+	eta := "unknown"
+	if sent > 0 && total >= sent {
+		remaining := time.Duration(float64(elapsed) * float64(total-sent) / float64(sent))
+		eta = formatDuration(remaining)
+	}
+
+	return fmt.Sprintf("Stats: %s elapsed; %d/%d hosts completed; %d/%d probes sent (%.2f%%); %d replies; %d retransmissions; ETA: %s",
+		formatDuration(elapsed), hostsDone.Load(), hostsTotal.Load(), sent, total, percent, replies.Load(), retransmissions.Load(), eta)
+}
+
+// PrintStatus prints the status line
+func PrintStatus() {
+	fmt.Println(Status())
+}
+
+// Report prints the status line every interval until done is closed
+func Report(interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			PrintStatus()
+		}
+	}
+}
+
+// formatDuration formats d as h:mm:ss
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	hours := d / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+
+	return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+}
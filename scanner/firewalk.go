@@ -0,0 +1,302 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/0niSec/gomap/factory"
+	"github.com/0niSec/gomap/logger"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// firewalkHeader introduces where the filtered ports of a host are blocked
+const firewalkHeader = "FIREWALK (where the filtered ports are blocked)"
+
+const (
+	// firewalkInterval is the least time between two probes expiring at the same router, since routers
+	// rate limit the time exceeded messages they send
+	firewalkInterval = 20 * time.Millisecond
+	// maxFirewalkPorts bounds how many filtered ports of a host are probed, the lowest first
+	maxFirewalkPorts = 32
+)
+
+// firewalkProbe is a probe to a port expiring at the router with the TTL
+type firewalkProbe struct {
+	port uint16
+	ttl  int
+}
+
+// FirewalkResult is how far the probes to a filtered port got on the way to the host
+type FirewalkResult struct {
+	// Hop is the TTL of the farthest router the probes reached, 0 when they didn't reach any
+	Hop int `json:"hop"`
+	// Gateway is that router. Unless the probes passed every router, it's where the port is blocked
+	Gateway string `json:"gateway,omitempty"`
+	// Passed is true when the probes reached the last router, so the port is filtered by it or by the host
+	Passed bool `json:"passed"`
+}
+
+// Firewalk finds where each filtered TCP port of the host is blocked. Probes to the port expire one hop after
+// each router on the route, and a router that says the probe expired there got it through every router before.
+// The route is traced first if it isn't known yet.
+func (t *Tracer) Firewalk(host *HostResult) error {
+	var filtered []int
+	for i, port := range host.Ports {
+		if port.Protocol == "tcp" && port.State == "filtered" {
+			filtered = append(filtered, i)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	if len(filtered) > maxFirewalkPorts {
+		logger.Debug("Only firewalking some of the filtered ports", "host", host.IP, "filtered", len(filtered), "max", maxFirewalkPorts)
+		filtered = filtered[:maxFirewalkPorts]
+	}
+
+	if host.Trace == nil {
+		if err := t.TraceHost(host); err != nil {
+			return err
+		}
+	}
+	if host.Trace == nil {
+		logger.Debug("Skipping firewalk without a route", "host", host.IP)
+		return nil
+	}
+
+	// The routers are every hop before the host, or every hop when the route never reached it
+	routers := host.Trace.Hops
+	if len(routers) > 0 && routers[len(routers)-1].IP == host.IP {
+		routers = routers[:len(routers)-1]
+	}
+	if len(routers) == 0 {
+		logger.Debug("Skipping firewalk of a host without routers on the way", "host", host.IP)
+		return nil
+	}
+
+	ports := make([]uint16, len(filtered))
+	for i, index := range filtered {
+		ports[i] = host.Ports[index].Port
+	}
+	reached, err := t.firewalkProbes(net.ParseIP(host.IP), ports, len(routers))
+	if err != nil {
+		return err
+	}
+
+	for _, index := range filtered {
+		port := &host.Ports[index]
+		result := &FirewalkResult{}
+		for ttl, router := range reached[port.Port] {
+			if ttl > result.Hop {
+				result.Hop, result.Gateway = ttl, router
+			}
+		}
+		result.Passed = result.Hop == len(routers)
+		port.Firewalk = result
+	}
+	return nil
+}
+
+// firewalkProbes sends the probes expiring at the routers and returns, for each port, the routers that
+// said its probe expired there, by TTL. The probes to the last router go first, and the ports they got past
+// every router with aren't probed any further. Probes nobody answered are sent once more, in case the
+// router dropped the probe or its reply.
+func (t *Tracer) firewalkProbes(dstIP net.IP, ports []uint16, routers int) (map[uint16]map[int]string, error) {
+	srcPort, err := factory.GenerateRandomPort()
+	if err != nil {
+		logger.Error("Failed to generate random port", "err", err)
+		return nil, fmt.Errorf("error generating random port: %w", err)
+	}
+	defer factory.ReleasePort(srcPort)
+
+	handle, err := openCapture(fmt.Sprintf("icmp and dst host %s and icmp[0] == 11", t.srcIP.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	fd, err := OpenRawSocket()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	// Every probe carries its TTL in its IP ID, which the time exceeded message quotes back with the port
+	idBase := uint16(rand.Uint32())
+	var mu sync.Mutex
+	reached := make(map[uint16]map[int]string)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+		for {
+			select {
+			case packet, ok := <-packetSource.Packets():
+				if !ok {
+					return
+				}
+				ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				icmp, isICMP := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+				if !ok || !isICMP || len(icmp.Payload) < 24 {
+					continue
+				}
+				quoted := icmp.Payload
+				if !net.IP(quoted[16:20]).Equal(dstIP) || binary.BigEndian.Uint16(quoted[20:]) != srcPort {
+					continue
+				}
+				ttl := int(binary.BigEndian.Uint16(quoted[4:]) - idBase)
+				port := binary.BigEndian.Uint16(quoted[22:])
+				if ttl < 1 || ttl > routers {
+					continue
+				}
+				traceReceived(packet, "")
+				mu.Lock()
+				if reached[port] == nil {
+					reached[port] = make(map[int]string)
+				}
+				reached[port][ttl] = ip.SrcIP.String()
+				mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Consecutive probes go to different routers, and the probes expiring at the same router are paced
+	send := func(probes []firewalkProbe) {
+		last := make(map[int]time.Time)
+		for _, probe := range probes {
+			if wait := firewalkInterval - time.Since(last[probe.ttl]); wait > 0 {
+				time.Sleep(wait)
+			}
+			last[probe.ttl] = time.Now()
+
+			fields := factory.IPFields{ID: idBase + uint16(probe.ttl), TTL: uint8(probe.ttl)}
+			packet, _, _, err := factory.CreateSYNPacketWithFields(t.srcIP, dstIP, srcPort, probe.port, rand.Uint32(), fields)
+			if err != nil {
+				logger.Error("Failed to build firewalk probe", "port", probe.port, "ttl", probe.ttl, "err", err)
+				continue
+			}
+			if err := SendRawPacket(fd, packet, dstIP); err != nil {
+				logger.Error("Failed to send firewalk probe", "port", probe.port, "ttl", probe.ttl, "err", err)
+			}
+		}
+		time.Sleep(hopTimeout)
+	}
+	unanswered := func(probes []firewalkProbe) []firewalkProbe {
+		mu.Lock()
+		defer mu.Unlock()
+		var missing []firewalkProbe
+		for _, probe := range probes {
+			if _, ok := reached[probe.port][probe.ttl]; !ok {
+				missing = append(missing, probe)
+			}
+		}
+		return missing
+	}
+	sendWithRetry := func(probes []firewalkProbe) {
+		send(probes)
+		if missing := unanswered(probes); len(missing) > 0 {
+			logger.Debug("Retransmitting unanswered firewalk probes", "dstIP", dstIP, "probes", len(missing))
+			send(missing)
+		}
+	}
+
+	lastRouter := make([]firewalkProbe, len(ports))
+	for i, port := range ports {
+		lastRouter[i] = firewalkProbe{port: port, ttl: routers}
+	}
+	sendWithRetry(lastRouter)
+
+	// Each blocked port is probed at every router before the next, so the probes expiring at a router are spread out
+	var earlier []firewalkProbe
+	for _, probe := range unanswered(lastRouter) {
+		for _, ttl := range hopRange(1, routers-1) {
+			earlier = append(earlier, firewalkProbe{port: probe.port, ttl: ttl})
+		}
+	}
+	if len(earlier) > 0 {
+		sendWithRetry(earlier)
+	}
+
+	close(done)
+	<-finished
+	return reached, nil
+}
+
+// FirewalkDetails returns where the filtered ports of the host are blocked, with the ports grouped by router
+func (h HostResult) FirewalkDetails() []string {
+	type group struct {
+		hop     int
+		gateway string
+		passed  bool
+		ports   []uint16
+	}
+	var groups []*group
+	for _, port := range h.Ports {
+		if port.Firewalk == nil {
+			continue
+		}
+		var found *group
+		for _, g := range groups {
+			if g.hop == port.Firewalk.Hop && g.gateway == port.Firewalk.Gateway {
+				found = g
+			}
+		}
+		if found == nil {
+			found = &group{hop: port.Firewalk.Hop, gateway: port.Firewalk.Gateway, passed: port.Firewalk.Passed}
+			groups = append(groups, found)
+		}
+		found.ports = append(found.ports, port.Port)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].hop < groups[j].hop })
+
+	var details []string
+	for _, g := range groups {
+		ports := formatPortRanges(g.ports)
+		switch {
+		case g.hop == 0:
+			details = append(details, "blocked before hop 1: "+ports)
+		case g.passed:
+			details = append(details, fmt.Sprintf("passed every router, filtered by hop %d, %s, or the host: %s", g.hop, h.hopName(g.hop, g.gateway), ports))
+		default:
+			details = append(details, fmt.Sprintf("blocked at hop %d, %s: %s", g.hop, h.hopName(g.hop, g.gateway), ports))
+		}
+	}
+	return prefixDetails(details)
+}
+
+// hopName returns the name traceroute found for a router, along with its IP
+func (h HostResult) hopName(ttl int, ip string) string {
+	if h.Trace != nil && ttl <= len(h.Trace.Hops) && h.Trace.Hops[ttl-1].IP == ip && h.Trace.Hops[ttl-1].Host != "" {
+		return fmt.Sprintf("%s (%s)", h.Trace.Hops[ttl-1].Host, ip)
+	}
+	return ip
+}
+
+// formatPortRanges formats sorted ports with runs collapsed into ranges, like 21-23,80,443
+func formatPortRanges(ports []uint16) string {
+	var ranges []string
+	for i := 0; i < len(ports); {
+		j := i
+		for j+1 < len(ports) && ports[j+1] == ports[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprint(ports[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", ports[i], ports[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
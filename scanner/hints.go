@@ -0,0 +1,194 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// showReasons toggles the REASON column and the stack hints of --reason and -v
+var showReasons atomic.Bool
+
+// SetShowReasons turns the REASON column and the stack hints under open ports on or off
+func SetShowReasons(enabled bool) {
+	showReasons.Store(enabled)
+}
+
+// StackHints are the TCP/IP stack details of the SYN/ACK an open port answered the scan with.
+// They hint at the OS of the host and how far away it is without sending anything more.
+type StackHints struct {
+	TTL uint8 `json:"ttl"`
+	// InitialTTL is the TTL the host most likely sent the reply with, the next common default above TTL
+	InitialTTL uint8 `json:"initial_ttl"`
+	// Hops is the estimated number of routers between the host and us
+	Hops   int    `json:"hops"`
+	DF     bool   `json:"df"`
+	Window uint16 `json:"window"`
+	MSS    uint16 `json:"mss,omitempty"`
+	// WindowScale is nil when the reply had no window scale option
+	WindowScale *uint8 `json:"window_scale,omitempty"`
+	// Options is the layout of the TCP options in p0f's notation, like mss,sok,ts,nop,ws
+	Options string `json:"options"`
+	// OS is the p0f-style guess of the OS from the initial TTL and the option layout
+	OS string `json:"os,omitempty"`
+	// TSval is the timestamp clock of the stack, zero when the reply had no timestamp option
+	TSval uint32 `json:"tsval,omitempty"`
+
+	// received is when the reply was captured, which the timestamp clocks of two replies are compared over
+	received time.Time
+}
+
+// passiveSignature ties an initial TTL and the option layout of a SYN/ACK to the stack that sends them
+type passiveSignature struct {
+	os         string
+	initialTTL uint8
+	options    string
+}
+
+// passiveSignatures are the SYN/ACK layouts of common stacks, in p0f's notation. Linux only drops the options
+// the SYN didn't offer, so it has a signature for the usual combinations.
+var passiveSignatures = []passiveSignature{
+	{"Linux 2.6.x-6.x", 64, "mss,sok,ts,nop,ws"},
+	{"Linux 2.6.x-6.x", 64, "mss,nop,nop,sok,nop,ws"},
+	{"Linux 2.6.x-6.x", 64, "mss,nop,nop,ts,nop,ws"},
+	{"Linux 2.6.x-6.x", 64, "mss,sok,ts"},
+	{"Linux 2.6.x-6.x", 64, "mss,nop,nop,sok"},
+	{"Linux 2.6.x-6.x", 64, "mss,nop,ws"},
+	{"Windows 7-11 / Server 2008-2022", 128, "mss,nop,ws,sok,ts"},
+	{"Windows 7-11 / Server 2008-2022", 128, "mss,nop,ws,nop,nop,sok"},
+	{"Windows 7-11 / Server 2008-2022", 128, "mss,nop,ws,nop,nop,ts"},
+	{"Windows XP / Server 2003", 128, "mss,nop,nop,sok"},
+	{"Windows", 128, "mss"},
+	{"FreeBSD 9.x-14.x", 64, "mss,nop,ws,sok,ts"},
+	{"FreeBSD 9.x-14.x", 64, "mss,nop,ws,sok,eol"},
+	{"OpenBSD", 64, "mss,nop,nop,sok,nop,ws,nop,nop,ts"},
+	{"macOS / iOS", 64, "mss,nop,ws,nop,nop,ts,sok,eol"},
+	{"macOS / iOS", 64, "mss,nop,ws,sok,eol"},
+	{"Solaris", 64, "nop,nop,ts,mss,nop,ws,nop,nop,sok"},
+	{"Solaris", 255, "nop,nop,ts,mss,nop,ws,nop,nop,sok"},
+	{"Cisco IOS or other network device", 255, "mss"},
+}
+
+// NewStackHints reads the stack hints of a SYN/ACK captured at received
+func NewStackHints(ip *layers.IPv4, tcp *layers.TCP, received time.Time) *StackHints {
+	hints := &StackHints{
+		TTL:        ip.TTL,
+		InitialTTL: initialTTL(ip.TTL),
+		DF:         ip.Flags&layers.IPv4DontFragment != 0,
+		Window:     tcp.Window,
+		received:   received,
+	}
+	hints.Hops = int(hints.InitialTTL) - int(ip.TTL)
+
+	var layout []string
+	for _, option := range tcp.Options {
+		switch option.OptionType {
+		case layers.TCPOptionKindEndList:
+			layout = append(layout, "eol")
+		case layers.TCPOptionKindNop:
+			layout = append(layout, "nop")
+		case layers.TCPOptionKindMSS:
+			layout = append(layout, "mss")
+			if len(option.OptionData) == 2 {
+				hints.MSS = binary.BigEndian.Uint16(option.OptionData)
+			}
+		case layers.TCPOptionKindWindowScale:
+			layout = append(layout, "ws")
+			if len(option.OptionData) == 1 {
+				scale := option.OptionData[0]
+				hints.WindowScale = &scale
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			layout = append(layout, "sok")
+		case layers.TCPOptionKindSACK:
+			layout = append(layout, "sack")
+		case layers.TCPOptionKindTimestamps:
+			layout = append(layout, "ts")
+			if len(option.OptionData) == 8 {
+				hints.TSval = binary.BigEndian.Uint32(option.OptionData)
+			}
+		default:
+			layout = append(layout, fmt.Sprintf("?%d", option.OptionType))
+		}
+	}
+	hints.Options = strings.Join(layout, ",")
+
+	for _, signature := range passiveSignatures {
+		if signature.initialTTL == hints.InitialTTL && signature.options == hints.Options {
+			hints.OS = signature.os
+			break
+		}
+	}
+	return hints
+}
+
+// initialTTL returns the common default TTL a host most likely used for a packet that arrived with ttl
+func initialTTL(ttl uint8) uint8 {
+	for _, initial := range []uint8{32, 64, 128} {
+		if ttl <= initial {
+			return initial
+		}
+	}
+	return 255
+}
+
+// Lines returns the stack hints as shown under the port
+func (h *StackHints) Lines() []string {
+	stack := fmt.Sprintf("stack: ttl %d (initial %d, %d hops), window %d", h.TTL, h.InitialTTL, h.Hops, h.Window)
+	if h.MSS != 0 {
+		stack += fmt.Sprintf(", mss %d", h.MSS)
+	}
+	if h.WindowScale != nil {
+		stack += fmt.Sprintf(", wscale %d", *h.WindowScale)
+	}
+	if h.DF {
+		stack += ", df"
+	}
+	if h.Options != "" {
+		stack += ", options " + h.Options
+	}
+
+	lines := []string{stack}
+	if h.OS != "" {
+		lines = append(lines, "passive os guess: "+h.OS)
+	}
+	return lines
+}
+
+// Reason returns why the port is in its state, like nmap's REASON column
+func (p PortResult) Reason() string {
+	switch {
+	case p.Hints != nil:
+		return fmt.Sprintf("syn-ack ttl %d", p.Hints.TTL)
+	case p.Protocol == "udp" && p.State == "open":
+		return "udp-response"
+	case p.Protocol == "udp" && p.State == "closed":
+		return "port-unreach"
+	case p.Protocol == "udp" && p.State == "filtered":
+		return "icmp-unreach"
+	case p.State == "open":
+		return "syn-ack"
+	case p.State == "closed":
+		return "reset"
+	case p.State == "filtered", p.State == "open|filtered":
+		return "no-response"
+	}
+	return ""
+}
+
+// AddStackHints attaches the stack hints of the SYN/ACKs to the open ports they came from
+func (h *HostResult) AddStackHints(hints map[uint16]*StackHints) {
+	for i := range h.Ports {
+		if hint, ok := hints[h.Ports[i].Port]; ok && h.Ports[i].Protocol == "tcp" && h.Ports[i].State == "open" {
+			h.Ports[i].Hints = hint
+		}
+	}
+	h.groupStacks()
+	if uptime := estimateUptime(h.hintSamples()); uptime != nil {
+		h.Uptime = uptime
+	}
+}
@@ -0,0 +1,220 @@
+package scanner
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/0niSec/gomap/factory"
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/osfp"
+	"github.com/0niSec/gomap/progress"
+	"github.com/gopacket/gopacket"
+)
+
+const (
+	// minOSAccuracy is the lowest accuracy of the OS guesses kept in the results
+	minOSAccuracy = 85
+	// maxOSMatches is how many OS guesses are kept in the results
+	maxOSMatches = 10
+)
+
+// OSResult is the outcome of OS detection (-O) against a host
+type OSResult struct {
+	// Matches are the reference fingerprints the host matched, best first
+	Matches []osfp.Match `json:"matches,omitempty"`
+	// Fingerprint is the fingerprint of the host, in the format of nmap-os-db
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Lines returns the OS detection output shown under the ports, like nmap's: the details of the exact matches,
+// or the best guesses and the fingerprint of the host when nothing matched exactly
+func (o *OSResult) Lines() []string {
+	var exact []osfp.Match
+	for _, match := range o.Matches {
+		if match.Accuracy == 100 {
+			exact = append(exact, match)
+		}
+	}
+
+	if len(exact) > 0 {
+		var deviceTypes, running, cpes, names []string
+		generations := make(map[string][]string)
+		for _, match := range exact {
+			names = append(names, match.Name)
+			for _, class := range match.Classes {
+				if !slices.Contains(deviceTypes, class.DeviceType) {
+					deviceTypes = append(deviceTypes, class.DeviceType)
+				}
+				family := class.Vendor + " " + class.Family
+				if class.Vendor == class.Family {
+					family = class.Family
+				}
+				if _, ok := generations[family]; !ok {
+					running = append(running, family)
+				}
+				if class.Generation != "" && !slices.Contains(generations[family], class.Generation) {
+					generations[family] = append(generations[family], class.Generation)
+				}
+			}
+			for _, cpe := range match.CPEs {
+				if !slices.Contains(cpes, cpe) {
+					cpes = append(cpes, cpe)
+				}
+			}
+		}
+		for i, family := range running {
+			if len(generations[family]) > 0 {
+				running[i] += " " + strings.Join(generations[family], "|")
+			}
+		}
+
+		lines := []string{
+			"Device type: " + strings.Join(deviceTypes, "|"),
+			"Running: " + strings.Join(running, ", "),
+		}
+		if len(cpes) > 0 {
+			lines = append(lines, "OS CPE: "+strings.Join(cpes, " "))
+		}
+		return append(lines, "OS details: "+strings.Join(names, ", "))
+	}
+
+	var lines []string
+	if len(o.Matches) > 0 {
+		var guesses []string
+		for _, match := range o.Matches {
+			guesses = append(guesses, fmt.Sprintf("%s (%d%%)", match.Name, match.Accuracy))
+		}
+		lines = append(lines, "Aggressive OS guesses: "+strings.Join(guesses, ", "), "No exact OS matches for host")
+	} else {
+		lines = append(lines, "No OS matches for host")
+	}
+	lines = append(lines, "TCP/IP fingerprint:")
+	return append(lines, strings.Split(o.Fingerprint, "\n")...)
+}
+
+// DetectOS fingerprints the host with the OS detection probes and matches it against the database.
+// It needs an open TCP port, and hosts without one are left as they are.
+func DetectOS(srcIP net.IP, host *HostResult, db *osfp.DB, timeout time.Duration) error {
+	var openPort, closedPort uint16
+	for _, port := range host.Ports {
+		if port.Protocol != "tcp" {
+			continue
+		}
+		if port.State == "open" && openPort == 0 {
+			openPort = port.Port
+		}
+		if port.State == "closed" && closedPort == 0 {
+			closedPort = port.Port
+		}
+	}
+	if openPort == 0 {
+		logger.Debug("Skipping OS detection without an open TCP port", "host", host.IP)
+		return nil
+	}
+
+	probes, err := OSScan(srcIP, net.ParseIP(host.IP), openPort, closedPort, timeout)
+	if err != nil {
+		return err
+	}
+
+	fingerprint := osfp.Compute(probes)
+	matches := db.Match(fingerprint, minOSAccuracy)
+	if len(matches) > maxOSMatches {
+		matches = matches[:maxOSMatches]
+	}
+	host.OS = &OSResult{Matches: matches, Fingerprint: fingerprint.String()}
+	// The SEQ probes are evenly spread, which measures the timestamp clock better than the scan did
+	if uptime := estimateUptime(probeSamples(probes)); uptime != nil {
+		host.Uptime = uptime
+	}
+	return nil
+}
+
+// OSScan sends the OS detection probes to dstIP and returns them along with the replies they got.
+// Without a known closed TCP port (0), the closed port probes go to a random high port, which is most likely closed.
+func OSScan(srcIP, dstIP net.IP, openPort, closedPort uint16, timeout time.Duration) ([]*osfp.Probe, error) {
+	logger.Debug("Starting OS detection", "dstIP", dstIP, "openPort", openPort, "closedPort", closedPort)
+
+	if closedPort == 0 {
+		closedPort = uint16(30000 + rand.Intn(30000))
+	}
+	closedUDPPort := uint16(30000 + rand.Intn(30000))
+
+	var srcPorts [osfp.SourcePorts]uint16
+	for i := range srcPorts {
+		port, err := factory.GenerateRandomPort()
+		if err != nil {
+			logger.Error("Failed to generate random port", "err", err)
+			return nil, fmt.Errorf("error generating random port: %w", err)
+		}
+		defer factory.ReleasePort(port)
+		srcPorts[i] = port
+	}
+
+	probes, err := osfp.BuildProbes(srcIP, dstIP, openPort, closedPort, closedUDPPort, srcPorts)
+	if err != nil {
+		return nil, fmt.Errorf("error building OS detection probes: %w", err)
+	}
+
+	// The replies are TCP segments, echo replies and the port unreachable of U1, all from the target
+	handle, err := openCapture(fmt.Sprintf("src host %s and dst host %s and (tcp or icmp)", dstIP.String(), srcIP.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	fd, err := OpenRawSocket()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	var mutex sync.Mutex
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+		packetSource.NoCopy = true
+		for {
+			select {
+			case packet := <-packetSource.Packets():
+				if packet == nil {
+					continue
+				}
+				mutex.Lock()
+				assigned := osfp.Assign(probes, packet, time.Now())
+				mutex.Unlock()
+				if assigned {
+					traceReceived(packet, "")
+					progress.ReplyReceived()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for _, probe := range probes {
+		time.Sleep(probe.Delay)
+		mutex.Lock()
+		probe.Sent = time.Now()
+		mutex.Unlock()
+		if err := SendRawPacket(fd, probe.Packet, dstIP); err != nil {
+			logger.Error("Failed to send OS detection probe", "probe", probe.Name, "err", err)
+		}
+	}
+
+	// Replies to the last probes are still on their way
+	time.Sleep(timeout)
+	close(done)
+	<-finished
+
+	return probes, nil
+}
@@ -0,0 +1,150 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// OutputFormats are the formats results can be written to a file in
+var OutputFormats = []string{"text", "json"}
+
+// WriteResults writes the results of every host to path in the given format
+func WriteResults(path, format string, hosts []HostResult) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	defer file.Close()
+
+	switch format {
+	case "text":
+		err = writeText(file, hosts)
+	case "json":
+		err = writeJSON(file, hosts)
+	default:
+		return fmt.Errorf("unknown output format '%s', expected one of %s", format, strings.Join(OutputFormats, ", "))
+	}
+	if err != nil {
+		return fmt.Errorf("error writing output file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// writeText writes the same tables as [PrettyPrintScanResults], without the colors
+func writeText(w io.Writer, hosts []HostResult) error {
+	for _, host := range hosts {
+		if _, err := fmt.Fprintf(w, "Gomap scan report for %s\n", host.Name()); err != nil {
+			return err
+		}
+		if err := writeHost(w, host, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeHost writes the ports table of host followed by everything else gomap learned about it.
+// The port states are colored when color is true.
+func writeHost(w io.Writer, host HostResult, color bool) error {
+	out := &lineWriter{w: w}
+
+	if host.Source != "" {
+		out.println("Found in the " + host.Source)
+	}
+	if len(host.OtherAddresses) > 0 {
+		out.println(host.otherAddressesLine())
+	}
+
+	// The VERSION column is only shown when there's something to put in it
+	showVersion := host.hasVersions()
+
+	header := fmt.Sprintf("%-10s%-10s%-15s%-15s", "PORT", "PROTOCOL", "STATE", "SERVICE")
+	if showReasons.Load() {
+		header += fmt.Sprintf("%-20s", "REASON")
+	}
+	if showVersion {
+		header += "VERSION"
+	}
+	out.println(strings.TrimRight(header, " "))
+
+	for _, port := range host.Ports {
+		// The state is padded before it's colored, since the escape codes take no room on the terminal
+		state := fmt.Sprintf("%-15s", port.State)
+		if color {
+			state = getColoredStatus(port.State) + state[len(port.State):]
+		}
+
+		row := fmt.Sprintf("%-10d%-10s%s%-15s", port.Port, port.Protocol, state, port.Service)
+		if showReasons.Load() {
+			row += fmt.Sprintf("%-20s", port.Reason())
+		}
+		if showVersion {
+			row += port.DisplayVersion()
+		}
+		out.println(strings.TrimRight(row, " "))
+		out.lines(port.Details())
+	}
+
+	if len(host.Stacks) > 0 {
+		out.println(stacksHeader)
+		out.lines(host.StackDetails())
+	}
+	if host.OS != nil {
+		out.lines(host.OS.Lines())
+	}
+	if host.Uptime != nil {
+		out.println(host.Uptime)
+	}
+	if len(host.Scripts) > 0 {
+		out.println("\nHost script results:")
+		out.lines(host.ScriptDetails())
+	}
+	if host.Trace != nil {
+		out.println()
+		out.lines(host.Trace.Lines())
+	}
+	if firewalk := host.FirewalkDetails(); len(firewalk) > 0 {
+		out.println("\n" + firewalkHeader)
+		out.lines(firewalk)
+	}
+
+	// Add a blank line to separate the results
+	out.println()
+
+	return out.err
+}
+
+// lineWriter writes lines to w and keeps the first error, so a report doesn't have to check every line it writes
+type lineWriter struct {
+	w   io.Writer
+	err error
+}
+
+// println writes a line made of a, like [fmt.Println]
+func (l *lineWriter) println(a ...any) {
+	if l.err == nil {
+		_, l.err = fmt.Fprintln(l.w, a...)
+	}
+}
+
+// lines writes every line
+func (l *lineWriter) lines(lines []string) {
+	for _, line := range lines {
+		l.println(line)
+	}
+}
+
+// writeJSON writes the hosts as an indented JSON document
+func writeJSON(w io.Writer, hosts []HostResult) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(struct {
+		Hosts []HostResult `json:"hosts"`
+	}{hosts})
+}
@@ -0,0 +1,154 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// pcapng block types and option codes
+// See https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	pcapngBlockSectionHeader   uint32 = 0x0A0D0D0A
+	pcapngBlockInterface       uint32 = 0x00000001
+	pcapngBlockEnhancedPacket  uint32 = 0x00000006
+	pcapngByteOrderMagic       uint32 = 0x1A2B3C4D
+	pcapngOptionComment        uint16 = 1
+	pcapngOptionInterfaceName  uint16 = 2
+	pcapngOptionTimestampResol uint16 = 9
+)
+
+// pcapngWriter writes packets to a pcapng file.
+//
+// [github.com/gopacket/gopacket/pcapgo.NgWriter] can't attach comments to single packets,
+// which is the whole point of --pcap-out, so we write the handful of blocks we need ourselves.
+// Every packet is written as a raw IPv4 packet (LINKTYPE_RAW) on a single interface.
+type pcapngWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// newPcapngWriter creates the file at path and writes the section header and interface description blocks
+func newPcapngWriter(path string) (*pcapngWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating pcapng file: %w", err)
+	}
+
+	pw := &pcapngWriter{file: file, w: bufio.NewWriter(file)}
+
+	// Section Header Block. The section length is unknown, so it's set to -1
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1) // Major version
+	binary.LittleEndian.PutUint16(shb[6:8], 0) // Minor version
+	binary.LittleEndian.PutUint64(shb[8:16], 0xFFFFFFFFFFFFFFFF)
+	if err := pw.writeBlock(pcapngBlockSectionHeader, shb, nil); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Interface Description Block. Timestamps are written in nanoseconds (tsresol = 9)
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], uint16(layers.LinkTypeRaw))
+	binary.LittleEndian.PutUint32(idb[4:8], 65536) // Snaplen
+	options := []pcapngOption{
+		{code: pcapngOptionInterfaceName, value: []byte("gomap")},
+		{code: pcapngOptionTimestampResol, value: []byte{9}},
+	}
+	if err := pw.writeBlock(pcapngBlockInterface, idb, options); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// pcapngOption is a single option attached to a pcapng block
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+// WritePacket writes data as an Enhanced Packet Block with the given timestamp and comment
+func (pw *pcapngWriter) WritePacket(ts time.Time, data []byte, comment string) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	nanos := uint64(ts.UnixNano())
+
+	epb := make([]byte, 20, 20+len(data)+3)
+	binary.LittleEndian.PutUint32(epb[0:4], 0) // Interface ID
+	binary.LittleEndian.PutUint32(epb[4:8], uint32(nanos>>32))
+	binary.LittleEndian.PutUint32(epb[8:12], uint32(nanos))
+	binary.LittleEndian.PutUint32(epb[12:16], uint32(len(data))) // Captured length
+	binary.LittleEndian.PutUint32(epb[16:20], uint32(len(data))) // Original length
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, pad4(len(data)))...)
+
+	var options []pcapngOption
+	if comment != "" {
+		options = append(options, pcapngOption{code: pcapngOptionComment, value: []byte(comment)})
+	}
+
+	return pw.writeBlock(pcapngBlockEnhancedPacket, epb, options)
+}
+
+// Close flushes any buffered packets and closes the file
+func (pw *pcapngWriter) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if err := pw.w.Flush(); err != nil {
+		pw.file.Close()
+		return fmt.Errorf("error flushing pcapng file: %w", err)
+	}
+
+	return pw.file.Close()
+}
+
+// writeBlock writes a block of the given type. The body must already be padded to 32 bits.
+func (pw *pcapngWriter) writeBlock(blockType uint32, body []byte, options []pcapngOption) error {
+	var opts []byte
+	for _, option := range options {
+		header := make([]byte, 4)
+		binary.LittleEndian.PutUint16(header[0:2], option.code)
+		binary.LittleEndian.PutUint16(header[2:4], uint16(len(option.value)))
+		opts = append(opts, header...)
+		opts = append(opts, option.value...)
+		opts = append(opts, make([]byte, pad4(len(option.value)))...)
+	}
+	if len(opts) > 0 {
+		// opt_endofopt (code 0, length 0)
+		opts = append(opts, 0, 0, 0, 0)
+	}
+
+	// Block type, block total length, body, options and the trailing block total length
+	length := uint32(12 + len(body) + len(opts))
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], blockType)
+	binary.LittleEndian.PutUint32(header[4:8], length)
+
+	trailer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(trailer, length)
+
+	for _, part := range [][]byte{header, body, opts, trailer} {
+		if _, err := pw.w.Write(part); err != nil {
+			return fmt.Errorf("error writing pcapng block: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// pad4 returns the number of bytes needed to pad n to a 32-bit boundary
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
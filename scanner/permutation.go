@@ -0,0 +1,196 @@
+package scanner
+
+import (
+	"fmt"
+	"math/big"
+	"math/bits"
+	"math/rand"
+	"net"
+)
+
+// Permutation walks every index in [0, n) exactly once in a pseudo-random order.
+//
+// The order comes from a cyclic multiplicative group modulo the smallest prime p > n: starting from an element x,
+// repeatedly multiplying by a generator g of the group visits every element of {1, ..., p-1} exactly once.
+// Element x maps to index x-1 and elements past the end of the space are skipped. The generator and the starting
+// element are picked from the seed, so the same seed always gives the same order.
+//
+// The walk can be split into shards. Shard i of n takes every n-th step of the walk starting at step i,
+// so shards of the same seed never overlap and together cover the whole space.
+type Permutation struct {
+	size    uint64 // number of indexes in the space
+	prime   uint64 // smallest prime greater than size
+	stride  uint64 // generator raised to the number of shards, the step between two elements of this shard
+	current uint64 // the next group element to visit
+	left    uint64 // number of group elements this shard still has to visit
+}
+
+// NewPermutation creates a permutation over [0, size) for the given seed.
+// The shard is zero based and must be less than shards.
+func NewPermutation(size uint64, seed int64, shard, shards uint64) (*Permutation, error) {
+	if shards == 0 || shard >= shards {
+		return nil, fmt.Errorf("invalid shard %d of %d", shard+1, shards)
+	}
+
+	p := &Permutation{size: size}
+	if size == 0 {
+		return p, nil
+	}
+
+	p.prime = nextPrime(size)
+	order := p.prime - 1
+
+	rng := rand.New(rand.NewSource(seed))
+	generator := findGenerator(p.prime, rng)
+	start := uint64(rng.Int63n(int64(order))) + 1
+
+	// Jump to the first element of this shard and step over the elements of the other shards from there
+	p.current = mulMod(start, powMod(generator, shard, p.prime), p.prime)
+	p.stride = powMod(generator, shards, p.prime)
+	if order > shard {
+		p.left = (order - shard + shards - 1) / shards
+	}
+
+	return p, nil
+}
+
+// Next returns the next index of the permutation. It returns false once the shard has been fully walked.
+func (p *Permutation) Next() (uint64, bool) {
+	for p.left > 0 {
+		element := p.current
+		p.current = mulMod(p.current, p.stride, p.prime)
+		p.left--
+
+		if element-1 < p.size {
+			return element - 1, true
+		}
+	}
+
+	return 0, false
+}
+
+// Skip advances the permutation past the next n indexes, e.g. to resume an interrupted scan
+func (p *Permutation) Skip(n uint64) {
+	for i := uint64(0); i < n; i++ {
+		if _, ok := p.Next(); !ok {
+			return
+		}
+	}
+}
+
+// probeAt maps an index of the permutation over targets×ports to its target and port
+func probeAt(index uint64, targets []net.IP, ports []uint16) (net.IP, uint16) {
+	count := uint64(len(targets))
+	return targets[index%count], ports[index/count]
+}
+
+// PermutedPorts walks the permutation over targets×ports and returns the ports of every target in the order they
+// were visited. Targets that have no ports in this shard get an empty list.
+// This is how stateful scans, which scan one host at a time, use the permutation: the order of the hosts is kept
+// and only the order of the ports of each host is random.
+func PermutedPorts(targets []net.IP, ports []uint16, perm *Permutation) [][]uint16 {
+	result := make([][]uint16, len(targets))
+	count := uint64(len(targets))
+
+	for {
+		index, ok := perm.Next()
+		if !ok {
+			break
+		}
+		result[index%count] = append(result[index%count], ports[index/count])
+	}
+
+	return result
+}
+
+// ParseShard parses a shard in the form "i/n", where i is between 1 and n.
+// It returns the zero based shard index and the number of shards.
+func ParseShard(shard string) (uint64, uint64, error) {
+	var index, count uint64
+	if _, err := fmt.Sscanf(shard, "%d/%d", &index, &count); err != nil {
+		return 0, 0, fmt.Errorf("invalid shard '%s', expected in form %s", shard, "i/n")
+	}
+
+	if count == 0 || index == 0 || index > count {
+		return 0, 0, fmt.Errorf("invalid shard '%s', i must be between 1 and n", shard)
+	}
+
+	return index - 1, count, nil
+}
+
+// nextPrime returns the smallest prime greater than n
+func nextPrime(n uint64) uint64 {
+	for candidate := n + 1; ; candidate++ {
+		if new(big.Int).SetUint64(candidate).ProbablyPrime(20) {
+			return candidate
+		}
+	}
+}
+
+// findGenerator returns a random generator of the multiplicative group modulo prime.
+// g is a generator if g^((p-1)/q) != 1 for every prime factor q of p-1.
+func findGenerator(prime uint64, rng *rand.Rand) uint64 {
+	order := prime - 1
+	if order == 1 {
+		return 1
+	}
+
+	factors := primeFactors(order)
+	for {
+		candidate := uint64(rng.Int63n(int64(order-1))) + 2
+
+		isGenerator := true
+		for _, factor := range factors {
+			if powMod(candidate, order/factor, prime) == 1 {
+				isGenerator = false
+				break
+			}
+		}
+
+		if isGenerator {
+			return candidate
+		}
+	}
+}
+
+// primeFactors returns the distinct prime factors of n
+func primeFactors(n uint64) []uint64 {
+	var factors []uint64
+
+	for factor := uint64(2); factor*factor <= n; factor++ {
+		if n%factor != 0 {
+			continue
+		}
+		factors = append(factors, factor)
+		for n%factor == 0 {
+			n /= factor
+		}
+	}
+	if n > 1 {
+		factors = append(factors, n)
+	}
+
+	return factors
+}
+
+// mulMod returns (a * b) mod m without overflowing
+func mulMod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	_, rem := bits.Div64(hi%m, lo, m)
+	return rem
+}
+
+// powMod returns (base ^ exp) mod m
+func powMod(base, exp, m uint64) uint64 {
+	result := uint64(1) % m
+	base %= m
+	for exp > 0 {
+		if exp&1 == 1 {
+			result = mulMod(result, base, m)
+		}
+		base = mulMod(base, base, m)
+		exp >>= 1
+	}
+
+	return result
+}
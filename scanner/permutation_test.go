@@ -0,0 +1,146 @@
+package scanner
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+// walk returns every index of the permutation in the order they're visited
+func walk(t *testing.T, size uint64, seed int64, shard, shards uint64) []uint64 {
+	t.Helper()
+	perm, err := NewPermutation(size, seed, shard, shards)
+	if err != nil {
+		t.Fatalf("NewPermutation(%d, %d, %d, %d) error = %v", size, seed, shard, shards, err)
+	}
+	var indexes []uint64
+	for {
+		index, ok := perm.Next()
+		if !ok {
+			return indexes
+		}
+		indexes = append(indexes, index)
+	}
+}
+
+func TestPermutationShardsCoverSpace(t *testing.T) {
+	for _, size := range []uint64{0, 1, 2, 3, 7, 10, 64, 257} {
+		for _, shards := range []uint64{1, 2, 3, 5, 8} {
+			for _, seed := range []int64{1, 42, -7} {
+				seen := make(map[uint64]uint64)
+				for shard := uint64(0); shard < shards; shard++ {
+					for _, index := range walk(t, size, seed, shard, shards) {
+						if index >= size {
+							t.Fatalf("size %d, %d shards, seed %d: shard %d visited %d, out of range", size, shards, seed, shard+1, index)
+						}
+						if other, ok := seen[index]; ok {
+							t.Fatalf("size %d, %d shards, seed %d: index %d visited by shards %d and %d", size, shards, seed, index, other+1, shard+1)
+						}
+						seen[index] = shard
+					}
+				}
+				if uint64(len(seen)) != size {
+					t.Errorf("size %d, %d shards, seed %d: shards visited %d indexes, want %d", size, shards, seed, len(seen), size)
+				}
+			}
+		}
+	}
+}
+
+func TestPermutationIsDeterministic(t *testing.T) {
+	first := walk(t, 100, 1234, 0, 1)
+	if second := walk(t, 100, 1234, 0, 1); !slices.Equal(first, second) {
+		t.Errorf("same seed gave different orders:\n%v\n%v", first, second)
+	}
+	if other := walk(t, 100, 4321, 0, 1); slices.Equal(first, other) {
+		t.Error("different seeds gave the same order")
+	}
+}
+
+func TestPermutationSkip(t *testing.T) {
+	all := walk(t, 50, 99, 1, 3)
+
+	for _, skip := range []uint64{0, 1, 5, uint64(len(all)), uint64(len(all)) + 10} {
+		perm, err := NewPermutation(50, 99, 1, 3)
+		if err != nil {
+			t.Fatalf("NewPermutation() error = %v", err)
+		}
+		perm.Skip(skip)
+
+		var rest []uint64
+		for index, ok := perm.Next(); ok; index, ok = perm.Next() {
+			rest = append(rest, index)
+		}
+		want := all[min(skip, uint64(len(all))):]
+		if !slices.Equal(rest, want) {
+			t.Errorf("Skip(%d) left %v, want %v", skip, rest, want)
+		}
+	}
+}
+
+func TestNewPermutationInvalidShard(t *testing.T) {
+	tests := []struct {
+		shard, shards uint64
+	}{
+		{0, 0},
+		{3, 3},
+		{5, 2},
+	}
+
+	for _, test := range tests {
+		if _, err := NewPermutation(10, 1, test.shard, test.shards); err == nil {
+			t.Errorf("NewPermutation(10, 1, %d, %d) error = nil, want an error", test.shard, test.shards)
+		}
+	}
+}
+
+func TestPermutedPorts(t *testing.T) {
+	targets := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+	ports := []uint16{22, 80, 443, 8080}
+
+	got := make([][]uint16, len(targets))
+	for shard := uint64(0); shard < 2; shard++ {
+		perm, err := NewPermutation(uint64(len(targets)*len(ports)), 7, shard, 2)
+		if err != nil {
+			t.Fatalf("NewPermutation() error = %v", err)
+		}
+		for i, shardPorts := range PermutedPorts(targets, ports, perm) {
+			got[i] = append(got[i], shardPorts...)
+		}
+	}
+
+	for i := range targets {
+		slices.Sort(got[i])
+		if !slices.Equal(got[i], ports) {
+			t.Errorf("ports of %s across shards = %v, want %v", targets[i], got[i], ports)
+		}
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		shard         string
+		index, shards uint64
+		wantErr       bool
+	}{
+		{"1/1", 0, 1, false},
+		{"2/3", 1, 3, false},
+		{"3/3", 2, 3, false},
+		{"0/3", 0, 0, true},
+		{"4/3", 0, 0, true},
+		{"1/0", 0, 0, true},
+		{"half", 0, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.shard, func(t *testing.T) {
+			index, shards, err := ParseShard(test.shard)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseShard(%q) error = %v, want error: %v", test.shard, err, test.wantErr)
+			}
+			if !test.wantErr && (index != test.index || shards != test.shards) {
+				t.Errorf("ParseShard(%q) = %d, %d, want %d, %d", test.shard, index, shards, test.index, test.shards)
+			}
+		})
+	}
+}
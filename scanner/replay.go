@@ -0,0 +1,157 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/0niSec/gomap/logger"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// flowKey identifies one direction of a TCP conversation
+type flowKey struct {
+	srcIP, dstIP     string
+	srcPort, dstPort uint16
+}
+
+// reverse returns the key of the opposite direction of the conversation
+func (k flowKey) reverse() flowKey {
+	return flowKey{srcIP: k.dstIP, dstIP: k.srcIP, srcPort: k.dstPort, dstPort: k.srcPort}
+}
+
+// captureReader reads the packets of a pcap or pcapng file
+type captureReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// openCaptureFile opens a pcap or pcapng file, telling them apart by the magic number they start with.
+// Captures are read without libpcap, so replaying one works on any machine.
+func openCaptureFile(path string) (captureReader, func() error, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening capture file: %w", err)
+	}
+
+	r := bufio.NewReader(file)
+	magic, err := r.Peek(4)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error reading capture file: %w", err)
+	}
+
+	var reader captureReader
+	if binary.LittleEndian.Uint32(magic) == pcapngBlockSectionHeader {
+		reader, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	} else {
+		reader, err = pcapgo.NewReader(r)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error opening capture file: %w", err)
+	}
+	return reader, file.Close, nil
+}
+
+// ReplayCapture rebuilds port states from a recorded pcap or pcapng capture.
+//
+// Every SYN in the capture is treated as a probe. The first reply to a probe is classified with
+// [ClassifyReply], the same classifier the live scanner uses, and replies that don't acknowledge the probe are ignored.
+// Probes that never got a reply are filtered.
+// The returned map is keyed by the probed IP address.
+func ReplayCapture(path string) (map[string]map[uint16]string, error) {
+	reader, closeFile, err := openCaptureFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+
+	results := make(map[string]map[uint16]string)
+	// probes tracks the sequence numbers of every probe and whether it already got its reply,
+	// so stale replies don't change the result
+	probes := make(map[flowKey]*replayProbe)
+
+	packetSource := gopacket.NewPacketSource(reader, reader.LinkType())
+	for {
+		packet, err := packetSource.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading capture file: %w", err)
+		}
+
+		ip, tcp := packetLayers(packet)
+		if ip == nil || tcp == nil {
+			continue
+		}
+
+		key := flowKey{
+			srcIP:   ip.SrcIP.String(),
+			dstIP:   ip.DstIP.String(),
+			srcPort: uint16(tcp.SrcPort),
+			dstPort: uint16(tcp.DstPort),
+		}
+
+		// A SYN without ACK is a probe. It stays filtered until a reply shows up
+		if tcp.SYN && !tcp.ACK {
+			if probe, ok := probes[key]; ok {
+				// A retransmission may have a new sequence number, and the reply can answer either one
+				if !probe.answered && !slices.Contains(probe.seqs, tcp.Seq) {
+					probe.seqs = append(probe.seqs, tcp.Seq)
+				}
+				continue
+			}
+			probes[key] = &replayProbe{seqs: []uint32{tcp.Seq}}
+			if results[key.dstIP] == nil {
+				results[key.dstIP] = make(map[uint16]string)
+			}
+			if _, ok := results[key.dstIP][key.dstPort]; !ok {
+				results[key.dstIP][key.dstPort] = "filtered"
+			}
+			continue
+		}
+
+		// Anything else is only interesting if it answers a probe we've seen
+		probeKey := key.reverse()
+		probe, ok := probes[probeKey]
+		if !ok || probe.answered {
+			continue
+		}
+
+		// Same as the live scanner, replies that acknowledge something else are ignored
+		if tcp.ACK && !probe.acknowledgedBy(tcp) {
+			logger.Debug("Ignoring reply with wrong ack", "dstIP", probeKey.dstIP, "dstPort", probeKey.dstPort, "seqs", probe.seqs, "actualAck", tcp.Ack)
+			continue
+		}
+		probe.answered = true
+
+		status := ClassifyReply(tcp)
+		logger.Debug("Replayed reply", "dstIP", probeKey.dstIP, "dstPort", probeKey.dstPort, "flags", tcpFlags(tcp), "status", status)
+		results[probeKey.dstIP][probeKey.dstPort] = status
+	}
+
+	return results, nil
+}
+
+// replayProbe is a SYN probe seen in a replayed capture, along with its retransmissions
+type replayProbe struct {
+	seqs     []uint32
+	answered bool
+}
+
+// acknowledgedBy returns true if the reply acknowledges the probe or any of its retransmissions
+func (p *replayProbe) acknowledgedBy(tcp *layers.TCP) bool {
+	for _, seq := range p.seqs {
+		if IsValidReply(tcp, seq) {
+			return true
+		}
+	}
+	return false
+}
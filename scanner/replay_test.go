@@ -0,0 +1,103 @@
+package scanner
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// replayFixture is a capture of a SYN scan of 10.0.0.2 and 10.0.0.3, written by --pcap-out
+const replayFixture = "testdata/replay.pcapng"
+
+// replayWant are the port states the probes and replies in the fixture add up to
+var replayWant = map[string]map[uint16]string{
+	"10.0.0.2": {
+		22:   "open",     // SYN/ACK
+		23:   "closed",   // RST
+		80:   "filtered", // no reply
+		443:  "open",     // SYN/ACK to the retransmission, which has a new sequence number
+		8080: "filtered", // only a SYN/ACK acknowledging something else
+		3306: "closed",   // RST, then a SYN/ACK that comes too late to count
+		8443: "open",     // SYN/ACK to the first SYN, arriving after its retransmission
+	},
+	"10.0.0.3": {
+		22: "open",
+	},
+}
+
+func TestReplayCapture(t *testing.T) {
+	got, err := ReplayCapture(replayFixture)
+	if err != nil {
+		t.Fatalf("ReplayCapture() error = %v", err)
+	}
+	assertReplay(t, got)
+}
+
+func TestReplayCapturePcap(t *testing.T) {
+	// The same packets in the older pcap format
+	reader, closeFile, err := openCaptureFile(replayFixture)
+	if err != nil {
+		t.Fatalf("openCaptureFile() error = %v", err)
+	}
+	defer closeFile()
+
+	path := filepath.Join(t.TempDir(), "replay.pcap")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriterNanos(file)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+		if err := writer.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReplayCapture(path)
+	if err != nil {
+		t.Fatalf("ReplayCapture() error = %v", err)
+	}
+	assertReplay(t, got)
+}
+
+func TestReplayCaptureErrors(t *testing.T) {
+	dir := t.TempDir()
+	notCapture := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(notCapture, []byte("not a capture"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing.pcapng"), notCapture} {
+		if _, err := ReplayCapture(path); err == nil {
+			t.Errorf("ReplayCapture(%q) error = nil, want an error", path)
+		}
+	}
+}
+
+// assertReplay compares the replayed port states with the ones of the fixture
+func assertReplay(t *testing.T, got map[string]map[uint16]string) {
+	t.Helper()
+	if len(got) != len(replayWant) {
+		t.Errorf("ReplayCapture() = %v, want %v", got, replayWant)
+	}
+	for host, want := range replayWant {
+		if !maps.Equal(got[host], want) {
+			t.Errorf("ReplayCapture() ports of %s = %v, want %v", host, got[host], want)
+		}
+	}
+}
@@ -2,7 +2,13 @@ package scanner
 
 import (
 	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
 
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/services"
 	"github.com/charmbracelet/lipgloss"
 )
 
@@ -12,29 +18,227 @@ var (
 	filteredStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#FFEF00"))
 )
 
-func PrettyPrintScanResults(results map[uint16]string, services map[uint16]string) {
-	fmt.Println(lipgloss.JoinHorizontal(lipgloss.Left,
-		lipgloss.NewStyle().Width(10).Render("PORT"),
-		lipgloss.NewStyle().Width(10).Render("PROTOCOL"),
-		lipgloss.NewStyle().Width(10).Render("STATE"),
-		lipgloss.NewStyle().Width(10).Render("SERVICE"),
-	))
+// PortResult is everything gomap learned about a single port
+type PortResult struct {
+	Port     uint16 `json:"port"`
+	Protocol string `json:"protocol"`
+	State    string `json:"state"`
+	Service  string `json:"service"`
+	// Hints are the stack details of the SYN/ACK an open TCP port answered with
+	Hints *StackHints `json:"stack,omitempty"`
+	// ServiceVersion is only set when version detection (-sV) learned something about the service
+	*services.ServiceVersion
+	// Scripts is the output of the port scripts that ran against the port
+	Scripts []ScriptResult `json:"scripts,omitempty"`
+	// Vulns are the CVEs affecting the version of the service, the most severe first
+	Vulns []Vuln `json:"vulns,omitempty"`
+	// Checks are the YAML checks that matched the port
+	Checks []CheckResult `json:"checks,omitempty"`
+	// Firewalk is only set when --firewalk looked for the router a filtered TCP port is blocked at
+	Firewalk *FirewalkResult `json:"firewalk,omitempty"`
+}
+
+// HostResult is everything gomap learned about a single host
+type HostResult struct {
+	IP string `json:"ip"`
+	// Hostname is the name the host was given as a target, or the reverse DNS name of its IP
+	Hostname string `json:"hostname,omitempty"`
+	// Source is only set when target expansion added the host, and says where it was found
+	Source string `json:"source,omitempty"`
+	// OtherAddresses are the addresses the hostname resolved to that weren't scanned
+	OtherAddresses []string     `json:"other_addresses,omitempty"`
+	Ports          []PortResult `json:"ports"`
+	// Stacks are the TCP/IP stacks answering for the host, only set when its open ports are answered by several,
+	// like behind a NAT forwarding ports to other machines
+	Stacks []Stack `json:"stacks,omitempty"`
+	// OS is only set when OS detection (-O) ran against the host
+	OS *OSResult `json:"os,omitempty"`
+	// Uptime is only set when the TCP timestamps of the host gave away how long it's been up
+	Uptime *Uptime `json:"uptime,omitempty"`
+	// Scripts is the output of the host scripts that ran against the host
+	Scripts []ScriptResult `json:"scripts,omitempty"`
+	// Trace is only set when --traceroute traced the route to the host
+	Trace *Trace `json:"trace,omitempty"`
+}
+
+// Name returns the host as shown in reports, like nmap's hostname (ip), or just the IP when it has no name
+func (h HostResult) Name() string {
+	if h.Hostname == "" {
+		return h.IP
+	}
+	return fmt.Sprintf("%s (%s)", h.Hostname, h.IP)
+}
+
+// otherAddressesLine lists the addresses of the hostname that weren't scanned, like nmap does under the report header.
+// Since only IPv4 is scanned, even with --resolve-all, the line says so when IPv6 addresses are among them.
+func (h HostResult) otherAddressesLine() string {
+	line := fmt.Sprintf("Other addresses for %s (not scanned): %s", h.Hostname, strings.Join(h.OtherAddresses, " "))
+	for _, address := range h.OtherAddresses {
+		if strings.Contains(address, ":") {
+			return line + " (IPv6 addresses are never scanned)"
+		}
+	}
+	return line
+}
+
+// ScriptResult is the output of a script that ran against a port or a host
+type ScriptResult struct {
+	ID     string   `json:"id"`
+	Output []string `json:"output"`
+}
+
+// Lines returns the output of the script as shown in the results table, on a single line when it fits
+func (s ScriptResult) Lines() []string {
+	if len(s.Output) == 1 {
+		return []string{s.ID + ": " + s.Output[0]}
+	}
+
+	lines := []string{s.ID + ":"}
+	for _, line := range s.Output {
+		lines = append(lines, "  "+line)
+	}
+	return lines
+}
+
+// Vuln is a CVE affecting the product identified by CPE
+type Vuln struct {
+	ID   string  `json:"id"`
+	CVSS float64 `json:"cvss"`
+	CPE  string  `json:"cpe"`
+}
+
+// vulnLines returns the CVEs as shown in the results table, grouped under the CPE they affect
+func vulnLines(vulns []Vuln) []string {
+	lines := []string{"vulns:"}
+	var cpes []string
+	for _, vuln := range vulns {
+		if !slices.Contains(cpes, vuln.CPE) {
+			cpes = append(cpes, vuln.CPE)
+		}
+	}
+	for _, cpe := range cpes {
+		lines = append(lines, "  "+cpe+":")
+		for _, vuln := range vulns {
+			if vuln.CPE == cpe {
+				lines = append(lines, fmt.Sprintf("    %-18s %.1f", vuln.ID, vuln.CVSS))
+			}
+		}
+	}
+	return lines
+}
+
+// CheckResult is a check that matched a port, along with the values its extractors found
+type CheckResult struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	// Extracted are the values found by each named extractor, unnamed extractors are listed under "extracted"
+	Extracted map[string][]string `json:"extracted,omitempty"`
+}
+
+// Lines returns the check as shown in the results table, followed by the extracted values sorted by name
+func (c CheckResult) Lines() []string {
+	lines := []string{fmt.Sprintf("%s: [%s] %s", c.ID, c.Severity, c.Name)}
+
+	names := make([]string, 0, len(c.Extracted))
+	for name := range c.Extracted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  %s: %s", name, strings.Join(c.Extracted[name], ", ")))
+	}
+	return lines
+}
+
+// NewHostResult builds the result of a host from the statuses of its ports of the protocol ("tcp" or "udp"),
+// sorted by port number. The services map is used to name the service on each port.
+func NewHostResult(ip, protocol string, results map[uint16]string, services map[uint16]string) HostResult {
+	host := HostResult{IP: ip}
 
 	for port, status := range results {
-		coloredStatus := getColoredStatus(status)
 		service := services[port]
 		if service == "" {
 			service = "unknown"
 		}
-		fmt.Println(lipgloss.JoinHorizontal(lipgloss.Left,
-			lipgloss.NewStyle().Width(10).Render(fmt.Sprintf("%d", port)),
-			lipgloss.NewStyle().Width(10).Render("tcp"), // ? We may want to change this if we ever implement UDP scanning
-			lipgloss.NewStyle().Width(10).Render(coloredStatus),
-			lipgloss.NewStyle().Width(10).Render(service),
-		))
+		host.Ports = append(host.Ports, PortResult{
+			Port:     port,
+			Protocol: protocol,
+			State:    status,
+			Service:  service,
+		})
+	}
+
+	sort.Slice(host.Ports, func(i, j int) bool { return host.Ports[i].Port < host.Ports[j].Port })
+
+	return host
+}
+
+// DisplayVersion returns the version shown in the VERSION column, or an empty string if nothing was detected
+func (p PortResult) DisplayVersion() string {
+	if p.ServiceVersion == nil {
+		return ""
+	}
+	return p.ServiceVersion.Display()
+}
+
+// Details returns the extra lines shown under the port, prefixed like nmap's script output
+func (p PortResult) Details() []string {
+	var details []string
+	if p.Hints != nil && showReasons.Load() {
+		details = append(details, p.Hints.Lines()...)
+	}
+	if p.ServiceVersion != nil {
+		details = append(details, p.ServiceVersion.Details()...)
+	}
+	if len(p.Vulns) > 0 {
+		details = append(details, vulnLines(p.Vulns)...)
+	}
+	for _, script := range p.Scripts {
+		details = append(details, script.Lines()...)
+	}
+	for _, check := range p.Checks {
+		details = append(details, check.Lines()...)
+	}
+	return prefixDetails(details)
+}
+
+// ScriptDetails returns the output of the host scripts, prefixed like the details of a port
+func (h HostResult) ScriptDetails() []string {
+	var details []string
+	for _, script := range h.Scripts {
+		details = append(details, script.Lines()...)
+	}
+	return prefixDetails(details)
+}
+
+// prefixDetails prefixes the lines like nmap's script output, with the last line closing the block
+func prefixDetails(details []string) []string {
+	for i := range details {
+		if i == len(details)-1 {
+			details[i] = "|_" + details[i]
+		} else {
+			details[i] = "| " + details[i]
+		}
+	}
+	return details
+}
+
+// hasVersions returns true if version detection learned something about any port of the host
+func (h HostResult) hasVersions() bool {
+	for _, port := range h.Ports {
+		if port.DisplayVersion() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// PrettyPrintScanResults prints the report of host to the terminal, with the port states in color
+func PrettyPrintScanResults(host HostResult) {
+	if err := writeHost(os.Stdout, host, true); err != nil {
+		logger.Error("Failed to print scan results", "err", err)
 	}
-	// Add a blank line to separate the results
-	fmt.Println("")
 }
 
 func getColoredStatus(status string) string {
@@ -43,7 +247,7 @@ func getColoredStatus(status string) string {
 		return openStyle.Render(status)
 	case "closed":
 		return closedStyle.Render(status)
-	case "filtered":
+	case "filtered", "open|filtered":
 		return filteredStyle.Render(status)
 	default:
 		return status
@@ -0,0 +1,101 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stacksHeader introduces the stacks of a host whose open ports several stacks answer
+const stacksHeader = "Different stacks answer the open ports, likely port forwarding to other hosts:"
+
+// maxTimestampRate is the fastest common timestamp clock, 1000 Hz. Two replies whose clocks drifted apart
+// faster than this, plus a second of slack, come from different stacks.
+const maxTimestampRate = 1000
+
+// Stack is one of the TCP/IP stacks answering for a host, and the open ports it answered for
+type Stack struct {
+	Ports   []uint16 `json:"ports"`
+	TTL     uint8    `json:"ttl"`
+	Window  uint16   `json:"window"`
+	Options string   `json:"options"`
+	OS      string   `json:"os,omitempty"`
+
+	hints *StackHints
+}
+
+// groupStacks groups the open ports of the host by the stack that answered them. The groups are only kept when
+// there are several, which means the IP forwards ports to other machines, like a NAT or a load balancer does.
+func (h *HostResult) groupStacks() {
+	var stacks []Stack
+	for _, port := range h.Ports {
+		if port.Hints == nil {
+			continue
+		}
+
+		found := false
+		for i := range stacks {
+			if sameStack(stacks[i].hints, port.Hints) {
+				stacks[i].Ports = append(stacks[i].Ports, port.Port)
+				found = true
+				break
+			}
+		}
+		if !found {
+			stacks = append(stacks, Stack{
+				Ports:   []uint16{port.Port},
+				TTL:     port.Hints.TTL,
+				Window:  port.Hints.Window,
+				Options: port.Hints.Options,
+				OS:      port.Hints.OS,
+				hints:   port.Hints,
+			})
+		}
+	}
+
+	h.Stacks = nil
+	if len(stacks) > 1 {
+		h.Stacks = stacks
+	}
+}
+
+// sameStack returns true if two SYN/ACKs look like they came from the same stack: same TTL, window and options,
+// and timestamp clocks that could be the same clock
+func sameStack(a, b *StackHints) bool {
+	if a.TTL != b.TTL || a.Window != b.Window || a.Options != b.Options || a.MSS != b.MSS || a.DF != b.DF {
+		return false
+	}
+	if (a.WindowScale == nil) != (b.WindowScale == nil) || (a.WindowScale != nil && *a.WindowScale != *b.WindowScale) {
+		return false
+	}
+	if a.TSval == 0 || b.TSval == 0 {
+		return a.TSval == b.TSval
+	}
+
+	// The clock may wrap between the two replies
+	ticks := int64(int32(b.TSval - a.TSval))
+	if ticks < 0 {
+		ticks = -ticks
+	}
+	elapsed := b.received.Sub(a.received).Seconds()
+	if elapsed < 0 {
+		elapsed = -elapsed
+	}
+	return float64(ticks) <= (elapsed+1)*maxTimestampRate
+}
+
+// StackDetails returns the stacks answering for the host, prefixed like the details of a port
+func (h HostResult) StackDetails() []string {
+	var details []string
+	for i, stack := range h.Stacks {
+		ports := make([]string, len(stack.Ports))
+		for j, port := range stack.Ports {
+			ports[j] = fmt.Sprint(port)
+		}
+		line := fmt.Sprintf("stack %d: ttl %d, window %d, options %s", i+1, stack.TTL, stack.Window, stack.Options)
+		if stack.OS != "" {
+			line += " (" + stack.OS + ")"
+		}
+		details = append(details, line, "  ports: "+strings.Join(ports, ", "))
+	}
+	return prefixDetails(details)
+}
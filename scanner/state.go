@@ -0,0 +1,196 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/0niSec/gomap/logger"
+)
+
+// ScanState is a checkpoint of a scan. It's written to a state file while scanning and when the scan is
+// interrupted, so the scan can be continued with --resume.
+//
+// The scan order is a [Permutation], so the options below are enough to rebuild exactly the same order.
+type ScanState struct {
+	Target string `json:"target"`
+	// ResolveAll is true when every address of the names in Target is scanned, not just the first
+	ResolveAll bool `json:"resolve_all,omitempty"`
+	// ExpandDNS is true when the hosts named in the MX, NS and SRV records of the names in Target are scanned too
+	ExpandDNS bool   `json:"expand_dns,omitempty"`
+	Ports     string `json:"ports"`
+	Seed      int64  `json:"seed"`
+	Shard     string `json:"shard"`
+	Stateless bool   `json:"stateless"`
+	UDP       bool   `json:"udp"`
+	Rate      int    `json:"rate"`
+
+	// Position is the number of steps of the permutation whose replies have been collected.
+	// Only stateless scans use it, since they don't keep the result of probes that didn't get a reply.
+	Position uint64 `json:"position"`
+
+	// Results holds the status of every finished probe, keyed by target IP address and port
+	Results map[string]map[uint16]string `json:"results"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// NewScanState creates an empty state that is saved to path. An empty path means the state isn't saved
+// until [ScanState.SetPath] is called.
+func NewScanState(path string) *ScanState {
+	return &ScanState{
+		Results: make(map[string]map[uint16]string),
+		path:    path,
+	}
+}
+
+// LoadState reads the state file written by an earlier, interrupted scan
+func LoadState(path string) (*ScanState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+
+	state := NewScanState(path)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing state file '%s': %w", path, err)
+	}
+	if state.Results == nil {
+		state.Results = make(map[string]map[uint16]string)
+	}
+
+	return state, nil
+}
+
+// Path returns the file the state is saved to
+func (s *ScanState) Path() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.path
+}
+
+// SetPath changes the file the state is saved to
+func (s *ScanState) SetPath(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+}
+
+// Save writes the state to its file. It does nothing if the state has no file.
+// The state is written to a temporary file first, so a crash while saving never leaves a broken state file behind.
+func (s *ScanState) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".gomap-state-*")
+	if err != nil {
+		return fmt.Errorf("error creating state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+
+	return nil
+}
+
+// SetResult records the status of a finished probe. The first status recorded for a port wins.
+// Probes that failed with an error aren't recorded, so a resumed scan sends them again.
+func (s *ScanState) SetResult(target string, port uint16, status string) bool {
+	if status == "error" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Results[target] == nil {
+		s.Results[target] = make(map[uint16]string)
+	}
+	if _, ok := s.Results[target][port]; ok {
+		return false
+	}
+	s.Results[target][port] = status
+
+	return true
+}
+
+// AddResults records the results of a scan of target
+func (s *ScanState) AddResults(target string, results map[uint16]string) {
+	for port, status := range results {
+		s.SetResult(target, port, status)
+	}
+}
+
+// Done returns true if the probe of target:port already finished
+func (s *ScanState) Done(target string, port uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.Results[target][port]
+	return ok
+}
+
+// SetPosition records how many steps of the permutation are done
+func (s *ScanState) SetPosition(position uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Position = position
+}
+
+// GetPosition returns how many steps of the permutation are done
+func (s *ScanState) GetPosition() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Position
+}
+
+// Snapshot returns a copy of the results recorded so far
+func (s *ScanState) Snapshot() map[string]map[uint16]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make(map[string]map[uint16]string, len(s.Results))
+	for target, ports := range s.Results {
+		results[target] = make(map[uint16]string, len(ports))
+		for port, status := range ports {
+			results[target][port] = status
+		}
+	}
+
+	return results
+}
+
+// checkpoint saves state if the last save, at *last, is more than [checkpointInterval] ago
+func checkpoint(state *ScanState, last *time.Time) {
+	if time.Since(*last) < checkpointInterval {
+		return
+	}
+	*last = time.Now()
+
+	if err := state.Save(); err != nil {
+		logger.Error("Failed to save scan state", "err", err)
+	}
+}
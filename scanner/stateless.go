@@ -0,0 +1,233 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/0niSec/gomap/factory"
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/progress"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/pcap"
+)
+
+// checkpointInterval is how often a running scan saves its state
+const checkpointInterval = 30 * time.Second
+
+// StatelessScan performs a masscan/zmap style SYN scan of every port on every target.
+// The probes are sent in the order of perm, which must be a permutation over len(targets)*len(ports).
+//
+// No state is kept per probe. The sequence number of every SYN is a [factory.SYNCookie] of its destination,
+// and a reply is only accepted if it acknowledges that cookie. Probes are sent by a single transmit loop at
+// the given rate (packets per second, 0 for no limit) while a separate receive loop classifies replies.
+// Once every probe is sent, the scan waits for late replies before returning.
+//
+// Replies are recorded in state, and the scan continues from state's position in the permutation. The state is
+// saved every [checkpointInterval]. When ctx is cancelled, no new probes are sent, the replies to the probes
+// already sent are still collected and ctx's error is returned along with the partial results.
+//
+// Only ports that replied are part of the results, everything else should be considered filtered.
+// The returned maps are keyed by target IP address, the second one holding the stack hints of the SYN/ACKs
+// this run received. Ports found open by an earlier run have none.
+func StatelessScan(ctx context.Context, srcIP net.IP, targets []net.IP, ports []uint16, perm *Permutation, rate int, wait time.Duration, state *ScanState) (map[string]map[uint16]string, map[string]map[uint16]*StackHints, error) {
+	key, err := factory.NewCookieKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srcPort, err := factory.GenerateRandomPort()
+	if err != nil {
+		logger.Error("Failed to generate random port", "err", err)
+		return nil, nil, fmt.Errorf("error generating random port: %w", err)
+	}
+	defer factory.ReleasePort(srcPort)
+
+	// Every reply to every probe comes back to the same source port, so one capture is enough
+	handle, err := openCapture(fmt.Sprintf("tcp and dst host %s and dst port %d", srcIP.String(), srcPort))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer handle.Close()
+
+	fd, err := OpenRawSocket()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer syscall.Close(fd)
+
+	// Continue where an earlier run of this scan stopped
+	position := state.GetPosition()
+	perm.Skip(position)
+
+	done := make(chan struct{})
+	hints := make(map[string]map[uint16]*StackHints)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		receiveStatelessReplies(handle, key, state, hints, done)
+	}()
+
+	var sent atomic.Uint64
+	sent.Store(position)
+
+	checkpointDone := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		checkpointStatelessScan(state, &sent, wait, checkpointDone)
+	}()
+
+	transmitStatelessProbes(ctx, fd, key, srcIP, srcPort, targets, ports, perm, rate, &sent)
+	if ctx.Err() != nil {
+		fmt.Println("Scan interrupted, waiting for replies to probes already sent...")
+	}
+	logger.Debug("Stopped sending probes, waiting for late replies", "sent", sent.Load(), "wait", wait)
+
+	time.Sleep(wait)
+	close(done)
+	close(checkpointDone)
+	wg.Wait()
+
+	// Every probe sent so far had its chance to reply
+	state.SetPosition(sent.Load())
+
+	return state.Snapshot(), hints, ctx.Err()
+}
+
+// checkpointStatelessScan saves the state every [checkpointInterval] until done is closed.
+//
+// Replies can arrive up to wait after a probe was sent, so the saved position is the number of probes that were
+// sent at least wait ago. Probes after it are sent again when the scan is resumed.
+func checkpointStatelessScan(state *ScanState, sent *atomic.Uint64, wait time.Duration, done <-chan struct{}) {
+	type sample struct {
+		at   time.Time
+		sent uint64
+	}
+	var samples []sample
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastSave := time.Now()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			samples = append(samples, sample{at: now, sent: sent.Load()})
+
+			// Drop the samples we no longer need, keeping the newest one that's older than wait
+			for len(samples) > 1 && now.Sub(samples[1].at) >= wait {
+				samples = samples[1:]
+			}
+
+			if now.Sub(lastSave) < checkpointInterval || now.Sub(samples[0].at) < wait {
+				continue
+			}
+			lastSave = now
+
+			state.SetPosition(samples[0].sent)
+			if err := state.Save(); err != nil {
+				logger.Error("Failed to save scan state", "err", err)
+			}
+		}
+	}
+}
+
+// transmitStatelessProbes sends a SYN to every target and port visited by perm until the permutation is done or
+// ctx is cancelled. Every probe sent increments sent.
+// The permutation spreads consecutive probes over different hosts instead of hammering one host at a time.
+func transmitStatelessProbes(ctx context.Context, fd int, key []byte, srcIP net.IP, srcPort uint16, targets []net.IP, ports []uint16, perm *Permutation, rate int, sent *atomic.Uint64) {
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+
+	start := time.Now()
+	count := 0
+
+	for ctx.Err() == nil {
+		index, ok := perm.Next()
+		if !ok {
+			break
+		}
+		dstIP, dstPort := probeAt(index, targets, ports)
+
+		// Pace the probes against the start of the scan so the rate doesn't drift
+		if interval > 0 {
+			if delay := time.Until(start.Add(time.Duration(count) * interval)); delay > 0 {
+				time.Sleep(delay)
+			}
+		}
+		count++
+
+		// Whether or not the probe makes it out, this step of the permutation is done
+		cookie := factory.SYNCookie(key, dstIP, dstPort)
+		packetData, _, _, err := factory.CreateSYNPacket(srcIP, dstIP, srcPort, dstPort, cookie)
+		if err != nil {
+			logger.Error("Failed to create SYN packet", "err", err)
+			sent.Add(1)
+			continue
+		}
+
+		if err := SendRawPacket(fd, packetData, dstIP); err != nil {
+			logger.Error("Failed to send SYN packet", "dstIP", dstIP, "dstPort", dstPort, "err", err)
+		} else {
+			progress.ProbeSent()
+		}
+		sent.Add(1)
+	}
+}
+
+// receiveStatelessReplies records every reply that acknowledges a SYN cookie in state until done is closed,
+// and the stack hints of the SYN/ACKs in hints. Only the first reply from each port is recorded.
+func receiveStatelessReplies(handle *pcap.Handle, key []byte, state *ScanState, hints map[string]map[uint16]*StackHints, done <-chan struct{}) {
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packets := packetSource.Packets()
+
+	for {
+		select {
+		case <-done:
+			return
+		case packet, ok := <-packets:
+			if !ok {
+				return
+			}
+
+			ip, tcp := packetLayers(packet)
+			if ip == nil || tcp == nil {
+				continue
+			}
+
+			dstIP := ip.SrcIP
+			dstPort := uint16(tcp.SrcPort)
+
+			// Spoofed or stale replies don't acknowledge the cookie we sent to this destination
+			if !IsValidReply(tcp, factory.SYNCookie(key, dstIP, dstPort)) {
+				logger.Debug("Dropping reply with invalid cookie", "srcIP", dstIP, "srcPort", dstPort, "ack", tcp.Ack)
+				continue
+			}
+
+			status := ClassifyReply(tcp)
+			if !state.SetResult(dstIP.String(), dstPort, status) {
+				continue
+			}
+			if status == "open" {
+				if hints[dstIP.String()] == nil {
+					hints[dstIP.String()] = make(map[uint16]*StackHints)
+				}
+				hints[dstIP.String()][dstPort] = NewStackHints(ip, tcp, packet.Metadata().Timestamp)
+			}
+
+			traceReceived(packet, status)
+			progress.ReplyReceived()
+			progress.Discovered(dstIP.String(), dstPort, "tcp", status)
+		}
+	}
+}
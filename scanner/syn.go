@@ -1,7 +1,10 @@
 package scanner
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"syscall"
 	"time"
@@ -9,6 +12,7 @@ import (
 	"github.com/0niSec/gomap/factory"
 	"github.com/0niSec/gomap/logger"
 	"github.com/0niSec/gomap/network"
+	"github.com/0niSec/gomap/progress"
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcap"
@@ -18,28 +22,45 @@ import (
 // It creates a raw socket, binds it to the appropriate network interface, and sends the packet using the socket.
 // This function is used to initiate a TCP connection by sending a SYN packet.
 func SendSYNPacket(packetData []byte, srcIP, dstIP net.IP) error {
+	fd, err := OpenRawSocket()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	return SendRawPacket(fd, packetData, dstIP)
+}
+
+// OpenRawSocket creates a raw IPv4 socket bound to the interface used for scanning.
+// The caller is responsible for closing the returned file descriptor with [syscall.Close].
+func OpenRawSocket() (int, error) {
 	// Get the interface used for sending the packet
 	// ? Not sure if this is really needed but it's here just in case (1)
 	iface, err := network.GetValidInterface()
 	if err != nil {
-		return fmt.Errorf("error getting valid interface: %w", err)
+		return -1, fmt.Errorf("error getting valid interface: %w", err)
 	}
 
 	// Create a raw socket
 	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
 	if err != nil {
-		return fmt.Errorf("failed to create raw socket: %w", err)
+		return -1, fmt.Errorf("failed to create raw socket: %w", err)
 	}
-	defer syscall.Close(fd)
 
 	// Bind the socket to the interface
 	// ? (2)
 	err = syscall.BindToDevice(fd, iface.Name)
 	if err != nil {
+		syscall.Close(fd)
 		logger.Error("Failed to bind raw socket to interface", "err", err)
-		return fmt.Errorf("failed to bind raw socket to interface: %w", err)
+		return -1, fmt.Errorf("failed to bind raw socket to interface: %w", err)
 	}
 
+	return fd, nil
+}
+
+// SendRawPacket sends the packet data, starting at the IPv4 header, to dstIP over a socket opened with [OpenRawSocket]
+func SendRawPacket(fd int, packetData []byte, dstIP net.IP) error {
 	// Prepare the sockaddr_in structure
 	// We call [net/ipv4/To4()] to convert the IP address to a 4-byte array
 	// Calling just the bytes of dstIP results in the Ipv4 address being represented as Ipv6
@@ -49,11 +70,14 @@ func SendSYNPacket(packetData []byte, srcIP, dstIP net.IP) error {
 	}
 
 	// Send the packet
-	err = syscall.Sendto(fd, packetData, 0, &addr)
+	err := syscall.Sendto(fd, packetData, 0, &addr)
 	if err != nil {
 		return fmt.Errorf("failed to send packet: %w", err)
 	}
 
+	// Print the packet and write it to the pcap file if either was requested
+	traceSent(packetData)
+
 	return nil
 }
 
@@ -61,52 +85,66 @@ func SendSYNPacket(packetData []byte, srcIP, dstIP net.IP) error {
 func StartPacketCapture(srcIP, dstIP net.IP, srcPort, dstPort uint16) (*pcap.Handle, func(), error) {
 	logger.Debug("Starting packet capture", "srcIP", srcIP, "srcPort", srcPort, "dstIP", dstIP, "dstPort", dstPort)
 
+	// Set BPF filter to only capture relevant packets for this specific port
+	filter := fmt.Sprintf("tcp and src host %s and src port %d and dst host %s and dst port %d",
+		dstIP.String(), dstPort, srcIP.String(), srcPort)
+
+	handle, err := openCapture(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		logger.Debug("Closing packet capture handle", "srcIP", srcIP, "srcPort", srcPort, "dstIP", dstIP, "dstPort", dstPort)
+		handle.Close()
+	}
+
+	return handle, cleanup, nil
+
+}
+
+// openCapture opens a live capture on the scanning interface that only sees packets matching the BPF filter
+func openCapture(filter string) (*pcap.Handle, error) {
 	// Find the appropriate interface
 	iface, err := network.GetValidInterface()
 	if err != nil {
 		logger.Error("Failed to find interface", "err", err)
-		return nil, nil, fmt.Errorf("error finding interface: %w", err)
+		return nil, fmt.Errorf("error finding interface: %w", err)
 	}
 
 	// Open the device for capturing
 	handle, err := pcap.OpenLive(iface.Name, 65536, true, 10*time.Millisecond)
 	if err != nil {
 		logger.Error("Failed to open device", "err", err)
-		return nil, nil, fmt.Errorf("error opening device: %w", err)
+		return nil, fmt.Errorf("error opening device: %w", err)
 	}
 
-	// Set BPF filter to only capture relevant packets for this specific port
-	filter := fmt.Sprintf("tcp and src host %s and src port %d and dst host %s and dst port %d",
-		dstIP.String(), dstPort, srcIP.String(), srcPort)
 	logger.Debug("Setting BPF filter", "filter", filter)
 	err = handle.SetBPFFilter(filter)
 	if err != nil {
 		handle.Close()
 		logger.Error("Failed to set BPF filter", "err", err)
-		return nil, nil, fmt.Errorf("error setting BPF filter: %w", err)
-	}
-
-	cleanup := func() {
-		logger.Debug("Closing packet capture handle", "srcIP", srcIP, "srcPort", srcPort, "dstIP", dstIP, "dstPort", dstPort)
-		handle.Close()
+		return nil, fmt.Errorf("error setting BPF filter: %w", err)
 	}
 
-	return handle, cleanup, nil
-
+	return handle, nil
 }
 
-// ProcessCapturedPacket processes the captured packet and returns the status of the connection.
-func ProcessCapturedPacket(handle *pcap.Handle, srcIP, dstIP net.IP, srcPort, dstPort uint16, timeout time.Duration) (string, error) {
+// ProcessCapturedPacket processes the captured packet and returns the status of the connection, along with the
+// stack hints of the reply when it's a SYN/ACK.
+// The packets come from a single packet source on the capture of the probe, shared by all its retransmissions.
+// The seq is the sequence number of the SYN probe. Replies that acknowledge anything else are ignored.
+func ProcessCapturedPacket(packets <-chan gopacket.Packet, srcIP, dstIP net.IP, srcPort, dstPort uint16, seq uint32, timeout time.Duration) (string, *StackHints, error) {
 	logger.Debug("Processing captured packet", "srcIP", srcIP, "srcPort", srcPort, "dstIP", dstIP, "dstPort", dstPort)
 
-	// Create packet source
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packetSource.NoCopy = true
-
 	// Wait for a packet or timeout
+	deadline := time.After(timeout)
 	for {
 		select {
-		case packet := <-packetSource.Packets():
+		case packet, ok := <-packets:
+			if !ok {
+				return "", nil, fmt.Errorf("capture closed while waiting for a reply")
+			}
 			if packet == nil {
 				logger.Debug("Received nil packet")
 				continue
@@ -127,119 +165,202 @@ func ProcessCapturedPacket(handle *pcap.Handle, srcIP, dstIP net.IP, srcPort, ds
 				continue
 			}
 
-			if tcp.SYN && tcp.ACK {
-				logger.Debug("Port is open", "dstPort", dstPort)
-				return "open", nil
-			} else if tcp.RST {
-				logger.Debug("Port is closed", "dstPort", dstPort)
-				return "closed", nil
+			// Drop spoofed or stale replies that don't acknowledge our SYN
+			if tcp.ACK && !IsValidReply(tcp, seq) {
+				logger.Debug("Received reply with wrong ack", "expectedAck", seq+1, "actualAck", tcp.Ack)
+				continue
 			}
 
-			logger.Debug("Unexpected packet flags", "dstPort", dstPort)
-			return "filtered", nil
+			status := ClassifyReply(tcp)
+			logger.Debug("Port status", "dstPort", dstPort, "status", status)
 
-		case <-time.After(timeout):
+			// The SYN/ACK is already here, so what it says about the stack comes for free
+			var hints *StackHints
+			if ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok && status == "open" {
+				hints = NewStackHints(ip, tcp, packet.Metadata().Timestamp)
+			}
+
+			traceReceived(packet, status)
+			progress.ReplyReceived()
+			return status, hints, nil
+
+		case <-deadline:
 			logger.Debug("Timeout reached", "dstPort", dstPort)
-			return "filtered", nil
+			return "filtered", nil, nil
 		}
 
 	}
 }
 
+// ClassifyReply returns the port status implied by a TCP reply to a SYN probe.
+// A SYN/ACK means the port is open, a RST means it's closed and anything else is treated as filtered.
+func ClassifyReply(tcp *layers.TCP) string {
+	if tcp.SYN && tcp.ACK {
+		return "open"
+	} else if tcp.RST {
+		return "closed"
+	}
+
+	return "filtered"
+}
+
+// IsValidReply returns true if the reply acknowledges a SYN probe that was sent with the given sequence number
+func IsValidReply(tcp *layers.TCP, seq uint32) bool {
+	return tcp.ACK && tcp.Ack == seq+1
+}
+
+// ErrTargetDown is returned by [Scan] when the target doesn't answer the ICMP echo request
+var ErrTargetDown = errors.New("target is not alive")
+
 // Scan performs a SYN scan on the given source and destination IP addresses and ports.
 // It sends a SYN packet to each destination port and waits for a response.
 // The function returns a map of port statuses, where the key is the port number and the value is the status ("open", "closed", "filtered", or "error").
 // The scan will timeout after the specified duration.
-func Scan(srcIP, dstIP net.IP, ports []uint16, timeout time.Duration) (map[uint16]string, error) {
-	now := time.Now().Local()
-	date := time.Now().Format("2006-01-02")
-	fmt.Printf("Starting gomap at %s %02d:%02d:%02d\n", date, now.Hour(), now.Minute(), now.Second())
-	fmt.Println("Gomap scan report for", dstIP.String())
+// At most maxParallelism probes are in flight at once (0 for no limit).
+// Probes that get no reply are sent again up to maxRetries times.
+//
+// The stack hints of the SYN/ACKs are returned for the open ports.
+//
+// Every finished probe is recorded in state as soon as it's done, and state is saved every [checkpointInterval].
+// Probes that failed with an error or whose retries were cut short by an interrupt aren't recorded, so a
+// resumed scan sends them again.
+//
+// When ctx is cancelled, no new probes are sent. The probes already in flight still finish,
+// and their results are returned along with ctx's error.
+func Scan(ctx context.Context, srcIP, dstIP net.IP, ports []uint16, timeout time.Duration, maxParallelism, maxRetries int, state *ScanState) (map[uint16]string, map[uint16]*StackHints, error) {
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
 
 	// Send ICMP Request to Target
 	alive, err := factory.SendICMPRequest(dstIP)
 	if err != nil {
-		return nil, fmt.Errorf("error sending ICMP request: %w", err)
+		return nil, nil, fmt.Errorf("error sending ICMP request: %w", err)
 	}
 	if !alive {
-		return nil, fmt.Errorf("target is not alive")
+		return nil, nil, ErrTargetDown
 	}
 
 	srcPort, err := factory.GenerateRandomPort()
 	if err != nil {
 		logger.Error("Failed to generate random port", "err", err)
-		return nil, fmt.Errorf("error generating random port: %w", err)
+		return nil, nil, fmt.Errorf("error generating random port: %w", err)
 	}
 
 	results := make(map[uint16]string)
-	resultChan := make(chan struct {
-		port   uint16
-		status string
-	})
+	hints := make(map[uint16]*StackHints)
+	resultChan := make(chan portStatus, len(ports))
+
+	// Limit how many probes are in flight at once
+	if maxParallelism <= 0 || maxParallelism > len(ports) {
+		maxParallelism = len(ports)
+	}
+	slots := make(chan struct{}, maxParallelism)
+	launched := 0
 
 	for _, dstPort := range ports {
+		// Stop sending new probes once the scan is interrupted
+		select {
+		case <-ctx.Done():
+		case slots <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			logger.Debug("Scan interrupted, waiting for probes in flight", "launched", launched)
+			break
+		}
+		launched++
+
 		go func(dstPort uint16) {
+			defer func() { <-slots }()
 			logger.Debug("Starting goroutine", "dstPort", dstPort)
 			handle, cleanup, err := StartPacketCapture(srcIP, dstIP, srcPort, dstPort)
 			if err != nil {
 				logger.Error("Failed to start packet capture", "err", err)
-				resultChan <- struct {
-					port   uint16
-					status string
-				}{dstPort, "error"}
+				resultChan <- portStatus{port: dstPort, status: "error"}
 				return
 			}
 			defer cleanup()
 
+			// A single packet source reads the capture for every attempt, so a late reply to an earlier
+			// attempt isn't lost to a reader nobody listens to anymore
+			packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+			packetSource.NoCopy = true
+			packets := packetSource.Packets()
+
 			// Create the SYN Packet
-			packetData, _, _, err := factory.CreateSYNPacket(srcIP, dstIP, srcPort, dstPort)
+			seq := rand.Uint32()
+			packetData, _, _, err := factory.CreateSYNPacket(srcIP, dstIP, srcPort, dstPort, seq)
 			if err != nil {
 				logger.Error("Failed to create SYN packet", "err", err)
-				resultChan <- struct {
-					port   uint16
-					status string
-				}{dstPort, "error"}
+				resultChan <- portStatus{port: dstPort, status: "error"}
 				return
 			}
 
-			// Send the SYN Packet
-			err = SendSYNPacket(packetData, srcIP, dstIP)
-			if err != nil {
-				logger.Error("Failed to send SYN packet", "err", err)
-				resultChan <- struct {
-					port   uint16
-					status string
-				}{dstPort, "error"}
-				return
+			var status string
+			var replyHints *StackHints
+			attempt := 0
+			for ; attempt <= maxRetries; attempt++ {
+				if attempt > 0 {
+					logger.Debug("Retransmitting SYN packet", "dstPort", dstPort, "attempt", attempt)
+					progress.Retransmission()
+				}
+
+				// Send the SYN Packet
+				err = SendSYNPacket(packetData, srcIP, dstIP)
+				if err != nil {
+					logger.Error("Failed to send SYN packet", "err", err)
+					resultChan <- portStatus{port: dstPort, status: "error"}
+					return
+				}
+				progress.ProbeSent()
+
+				status, replyHints, err = ProcessCapturedPacket(packets, srcIP, dstIP, srcPort, dstPort, seq, timeout)
+				if err != nil {
+					logger.Error("Failed to process captured packet", "err", err)
+					resultChan <- portStatus{port: dstPort, status: "error"}
+					return
+				}
+
+				// Only probes that went unanswered are worth sending again, and not once the scan is interrupted
+				if status != "filtered" || ctx.Err() != nil {
+					break
+				}
 			}
 
-			status, err := ProcessCapturedPacket(handle, srcIP, dstIP, srcPort, dstPort, timeout)
-			if err != nil {
-				logger.Error("Failed to process captured packet", "err", err)
-				resultChan <- struct {
-					port   uint16
-					status string
-				}{dstPort, "error"}
-				return
-			}
+			progress.Discovered(dstIP.String(), dstPort, "tcp", status)
 
-			resultChan <- struct {
-				port   uint16
-				status string
-			}{dstPort, status}
+			// A probe whose retries were cut short by the interrupt isn't done, so a resumed scan sends it again
+			resultChan <- portStatus{port: dstPort, status: status, hints: replyHints, unfinished: status == "filtered" && attempt < maxRetries}
 		}(dstPort)
 	}
 
-	for range ports {
+	lastSave := time.Now()
+	for i := 0; i < launched; i++ {
 		result, ok := <-resultChan
 		if !ok {
 			logger.Error("Failed to receive result from resultChan")
 			break
 		}
 		results[result.port] = result.status
+		if !result.unfinished {
+			state.SetResult(dstIP.String(), result.port, result.status)
+			checkpoint(state, &lastSave)
+		}
+		if result.hints != nil {
+			hints[result.port] = result.hints
+		}
 	}
 
 	// TODO: Sort the results by port number
 
-	return results, nil
+	return results, hints, ctx.Err()
+}
+
+// portStatus is the outcome of probing a single port
+type portStatus struct {
+	port   uint16
+	status string
+	hints  *StackHints
+	// unfinished is true when the scan was interrupted before every retry was sent
+	unfinished bool
 }
@@ -0,0 +1,64 @@
+package scanner
+
+import (
+	"net"
+	"testing"
+
+	"github.com/0niSec/gomap/factory"
+	"github.com/gopacket/gopacket/layers"
+)
+
+func TestIsValidReply(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	dstIP := net.ParseIP("192.0.2.10")
+	cookie := factory.SYNCookie(key, dstIP, 80)
+
+	tests := []struct {
+		name  string
+		reply layers.TCP
+		want  bool
+	}{
+		{"SYN/ACK acknowledging the cookie", layers.TCP{SYN: true, ACK: true, Ack: cookie + 1}, true},
+		{"RST acknowledging the cookie", layers.TCP{RST: true, ACK: true, Ack: cookie + 1}, true},
+		{"ack of the cookie itself", layers.TCP{SYN: true, ACK: true, Ack: cookie}, false},
+		{"ack of another port's cookie", layers.TCP{SYN: true, ACK: true, Ack: factory.SYNCookie(key, dstIP, 81) + 1}, false},
+		{"ack of another key's cookie", layers.TCP{SYN: true, ACK: true, Ack: factory.SYNCookie([]byte("fedcba9876543210"), dstIP, 80) + 1}, false},
+		{"right ack number without the ACK flag", layers.TCP{RST: true, Ack: cookie + 1}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsValidReply(&test.reply, cookie); got != test.want {
+				t.Errorf("IsValidReply() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsValidReplyWraps(t *testing.T) {
+	reply := layers.TCP{SYN: true, ACK: true, Ack: 0}
+	if !IsValidReply(&reply, 0xffffffff) {
+		t.Error("IsValidReply() = false for an ack that wrapped around, want true")
+	}
+}
+
+func TestClassifyReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply layers.TCP
+		want  string
+	}{
+		{"SYN/ACK", layers.TCP{SYN: true, ACK: true}, "open"},
+		{"RST", layers.TCP{RST: true}, "closed"},
+		{"RST/ACK", layers.TCP{RST: true, ACK: true}, "closed"},
+		{"bare ACK", layers.TCP{ACK: true}, "filtered"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ClassifyReply(&test.reply); got != test.want {
+				t.Errorf("ClassifyReply() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0niSec/gomap/logger"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+var (
+	// packetTrace toggles the one line per packet output of --packet-trace
+	packetTrace atomic.Bool
+	// traceStart is the time the relative timestamps in the packet trace are measured from
+	traceStart = time.Now()
+
+	// pcapOut is the writer for --pcap-out. It's nil when no pcap file was requested
+	pcapOut   *pcapngWriter
+	pcapMutex sync.Mutex
+)
+
+// SetPacketTrace turns the packet trace on or off
+func SetPacketTrace(enabled bool) {
+	packetTrace.Store(enabled)
+}
+
+// PacketTraceEnabled returns true if every sent and received packet is being printed
+func PacketTraceEnabled() bool {
+	return packetTrace.Load()
+}
+
+// OpenPcapOut creates a pcapng file at path that every sent and matched received packet is written to.
+// The returned function flushes and closes the file and must be called once the scan is done.
+func OpenPcapOut(path string) (func() error, error) {
+	writer, err := newPcapngWriter(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pcapMutex.Lock()
+	pcapOut = writer
+	pcapMutex.Unlock()
+
+	closer := func() error {
+		pcapMutex.Lock()
+		defer pcapMutex.Unlock()
+		pcapOut = nil
+		return writer.Close()
+	}
+
+	return closer, nil
+}
+
+// traceSent records a probe we just put on the wire. The packet data starts at the IPv4 header.
+func traceSent(packetData []byte) {
+	if !PacketTraceEnabled() && !pcapOutEnabled() {
+		return
+	}
+
+	packet := gopacket.NewPacket(packetData, layers.LayerTypeIPv4, gopacket.NoCopy)
+	ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if ip == nil {
+		return
+	}
+	summary, ok := summarizePacket(packet, ip)
+	if !ok {
+		return
+	}
+
+	tracePacket("SENT", packetData, summary, sentProbeName(packet, ip))
+}
+
+// traceReceived records a reply that matched one of our probes. The status is what the reply says
+// about the port, or empty for replies that aren't about a port, like those to OS detection or traceroute probes.
+func traceReceived(packet gopacket.Packet, status string) {
+	if !PacketTraceEnabled() && !pcapOutEnabled() {
+		return
+	}
+
+	ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if ip == nil {
+		return
+	}
+	summary, ok := summarizePacket(packet, ip)
+	if !ok {
+		return
+	}
+
+	// The capture includes the link layer, but everything in the pcap file is raw IPv4
+	data := append(append([]byte{}, ip.Contents...), ip.Payload...)
+	comment := "reply to " + answeredProbeName(packet, ip, status)
+	if status != "" {
+		comment += fmt.Sprintf(" (%s)", status)
+	}
+
+	tracePacket("RCVD", data, summary, comment)
+}
+
+// tracePacket prints the packet if packet tracing is on and writes it to the pcap file if one is open
+func tracePacket(direction string, data []byte, summary, comment string) {
+	now := time.Now()
+
+	if PacketTraceEnabled() {
+		fmt.Printf("%s (%.4fs) %s\n", direction, now.Sub(traceStart).Seconds(), summary)
+	}
+
+	pcapMutex.Lock()
+	defer pcapMutex.Unlock()
+	if pcapOut == nil {
+		return
+	}
+	if err := pcapOut.WritePacket(now, data, comment); err != nil {
+		logger.Error("Failed to write packet to pcap file", "err", err)
+	}
+}
+
+// pcapOutEnabled returns true if a pcap file is open
+func pcapOutEnabled() bool {
+	pcapMutex.Lock()
+	defer pcapMutex.Unlock()
+	return pcapOut != nil
+}
+
+// packetLayers returns the IPv4 and TCP layers of the packet, or nil if it doesn't have them
+func packetLayers(packet gopacket.Packet) (*layers.IPv4, *layers.TCP) {
+	ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	return ip, tcp
+}
+
+// probeName names the probe of the protocol sent to the given destination, e.g. "SYN probe to 10.0.0.1:443".
+// ICMP probes have no port and are named by their destination alone.
+func probeName(protocol, dstIP string, dstPort uint16) string {
+	if protocol == "ICMP" {
+		return fmt.Sprintf("ICMP probe to %s", dstIP)
+	}
+	return fmt.Sprintf("%s probe to %s:%d", protocol, dstIP, dstPort)
+}
+
+// sentProbeName names a probe we sent. TCP probes are only called SYN probes when they're a bare SYN.
+func sentProbeName(packet gopacket.Packet, ip *layers.IPv4) string {
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		if transport.SYN && !transport.ACK {
+			return probeName("SYN", ip.DstIP.String(), uint16(transport.DstPort))
+		}
+		return probeName("TCP", ip.DstIP.String(), uint16(transport.DstPort))
+	case *layers.UDP:
+		return probeName("UDP", ip.DstIP.String(), uint16(transport.DstPort))
+	}
+	return probeName("ICMP", ip.DstIP.String(), 0)
+}
+
+// answeredProbeName names the probe a reply answers. TCP replies with a port status answer a port scan SYN.
+// ICMP errors are about the probe they quote, which may have been sent to another host than the one answering.
+func answeredProbeName(packet gopacket.Packet, ip *layers.IPv4, status string) string {
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		if status != "" {
+			return probeName("SYN", ip.SrcIP.String(), uint16(tcp.SrcPort))
+		}
+		return probeName("TCP", ip.SrcIP.String(), uint16(tcp.SrcPort))
+	}
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		return probeName("UDP", ip.SrcIP.String(), uint16(udp.SrcPort))
+	}
+
+	// The ICMP error quotes the IP header and the first 8 bytes of the probe it's about
+	icmp, _ := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if icmp == nil || !isICMPError(icmp) || len(icmp.Payload) < 20 {
+		return probeName("ICMP", ip.SrcIP.String(), 0)
+	}
+	quoted := icmp.Payload
+	headerLength := int(quoted[0]&0x0f) * 4
+	dstIP := net.IP(quoted[16:20]).String()
+	if len(quoted) < headerLength+4 {
+		return probeName("ICMP", dstIP, 0)
+	}
+	dstPort := binary.BigEndian.Uint16(quoted[headerLength+2:])
+	switch layers.IPProtocol(quoted[9]) {
+	case layers.IPProtocolTCP:
+		return probeName("TCP", dstIP, dstPort)
+	case layers.IPProtocolUDP:
+		return probeName("UDP", dstIP, dstPort)
+	}
+	return probeName("ICMP", dstIP, 0)
+}
+
+// isICMPError returns true if the ICMP message reports an error about a packet it quotes
+func isICMPError(icmp *layers.ICMPv4) bool {
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect,
+		layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// summarizePacket formats a TCP, UDP or ICMP packet on a single line in the spirit of nmap's --packet-trace.
+// It returns false for packets of any other protocol.
+func summarizePacket(packet gopacket.Packet, ip *layers.IPv4) (string, bool) {
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		return fmt.Sprintf("TCP %s:%d > %s:%d %s ttl=%d id=%d iplen=%d seq=%d ack=%d win=%d",
+			ip.SrcIP, tcp.SrcPort, ip.DstIP, tcp.DstPort, tcpFlags(tcp), ip.TTL, ip.Id, ip.Length, tcp.Seq, tcp.Ack, tcp.Window), true
+	}
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		return fmt.Sprintf("UDP %s:%d > %s:%d ttl=%d id=%d iplen=%d",
+			ip.SrcIP, udp.SrcPort, ip.DstIP, udp.DstPort, ip.TTL, ip.Id, ip.Length), true
+	}
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		return fmt.Sprintf("ICMP [%s > %s %s] ttl=%d id=%d iplen=%d",
+			ip.SrcIP, ip.DstIP, icmp.TypeCode, ip.TTL, ip.Id, ip.Length), true
+	}
+	return "", false
+}
+
+// tcpFlags returns the set TCP flags as letters (e.g. "SA" for SYN/ACK)
+func tcpFlags(tcp *layers.TCP) string {
+	var flags strings.Builder
+	for _, flag := range []struct {
+		set    bool
+		letter string
+	}{
+		{tcp.FIN, "F"},
+		{tcp.SYN, "S"},
+		{tcp.RST, "R"},
+		{tcp.PSH, "P"},
+		{tcp.ACK, "A"},
+		{tcp.URG, "U"},
+		{tcp.ECE, "E"},
+		{tcp.CWR, "C"},
+	} {
+		if flag.set {
+			flags.WriteString(flag.letter)
+		}
+	}
+
+	if flags.Len() == 0 {
+		return "-"
+	}
+
+	return flags.String()
+}
@@ -0,0 +1,441 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/0niSec/gomap/dns"
+	"github.com/0niSec/gomap/factory"
+	"github.com/0niSec/gomap/logger"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+)
+
+const (
+	// maxHops is the highest TTL traceroute probes with
+	maxHops = 30
+	// hopTimeout is how long traceroute waits for the replies to a round of probes
+	hopTimeout = time.Second
+)
+
+// Hop is a router on the way to a host, or the host itself as the last hop
+type Hop struct {
+	TTL int `json:"ttl"`
+	// IP is empty when nothing answered the probe with this TTL
+	IP   string  `json:"ip,omitempty"`
+	Host string  `json:"host,omitempty"`
+	RTT  float64 `json:"rtt_ms,omitempty"`
+}
+
+// Trace is the route to a host, found with probes to one of its ports
+type Trace struct {
+	Protocol string `json:"protocol"`
+	Port     uint16 `json:"port"`
+	Hops     []Hop  `json:"hops"`
+	// SharedWith is the host whose route the first SharedHops hops were taken from instead of traced again
+	SharedWith string `json:"shared_with,omitempty"`
+	SharedHops int    `json:"shared_hops,omitempty"`
+}
+
+// Lines returns the route as shown under the host, like nmap's TRACEROUTE section
+func (t *Trace) Lines() []string {
+	lines := []string{
+		fmt.Sprintf("TRACEROUTE (using port %d/%s)", t.Port, t.Protocol),
+		fmt.Sprintf("%-4s%-11s%s", "HOP", "RTT", "ADDRESS"),
+	}
+	switch {
+	case t.SharedHops == 1:
+		lines = append(lines, fmt.Sprintf("%-4s%s", "-", "Hop 1 is the same as for "+t.SharedWith))
+	case t.SharedHops > 1:
+		lines = append(lines, fmt.Sprintf("%-4sHops 1-%d are the same as for %s", "-", t.SharedHops, t.SharedWith))
+	}
+
+	for _, hop := range t.Hops[min(t.SharedHops, len(t.Hops)):] {
+		if hop.IP == "" {
+			lines = append(lines, fmt.Sprintf("%-4d%s", hop.TTL, "..."))
+			continue
+		}
+		address := hop.IP
+		if hop.Host != "" {
+			address = fmt.Sprintf("%s (%s)", hop.Host, hop.IP)
+		}
+		lines = append(lines, fmt.Sprintf("%-4d%-11s%s", hop.TTL, fmt.Sprintf("%.2f ms", hop.RTT), address))
+	}
+	return lines
+}
+
+// Tracer traces the routes to hosts one after the other. The hops a route shares with an earlier one
+// aren't probed again.
+type Tracer struct {
+	srcIP    net.IP
+	routes   []tracedRoute
+	resolver *dns.Resolver
+}
+
+// tracedRoute is an earlier route the next ones can share hops with
+type tracedRoute struct {
+	host string
+	hops []Hop
+}
+
+// NewTracer returns a tracer sending its probes from srcIP. The hops are named with resolver, unless it's nil.
+func NewTracer(srcIP net.IP, resolver *dns.Resolver) *Tracer {
+	return &Tracer{srcIP: srcIP, resolver: resolver}
+}
+
+// TraceHost traces the route to the host with probes to the port the scan found most likely to pass firewalls:
+// an open port, a closed one when nothing is open, or else a filtered one, whose route ends at the last router
+// that answered. Hosts without any of them are left as they are.
+func (t *Tracer) TraceHost(host *HostResult) error {
+	var protocol string
+	var port uint16
+	for _, state := range []string{"open", "closed", "filtered"} {
+		for _, p := range host.Ports {
+			if p.State == state {
+				protocol, port = p.Protocol, p.Port
+				break
+			}
+		}
+		if port != 0 {
+			break
+		}
+	}
+	if port == 0 {
+		logger.Debug("Skipping traceroute without an open, closed or filtered port", "host", host.IP)
+		return nil
+	}
+
+	// The hop count of a SYN/ACK says where to start looking for the host
+	distance := 0
+	for _, p := range host.Ports {
+		if p.Hints != nil {
+			distance = p.Hints.Hops + 1
+			break
+		}
+	}
+
+	trace, err := t.Trace(net.ParseIP(host.IP), protocol, port, distance)
+	if err != nil {
+		return err
+	}
+	host.Trace = trace
+	return nil
+}
+
+// Trace traces the route to dstIP with TTL-limited probes to the port. With a guess of the distance (0 for none),
+// the probes start there and walk back until they reach a hop an earlier route has at the same TTL.
+func (t *Tracer) Trace(dstIP net.IP, protocol string, port uint16, distance int) (*Trace, error) {
+	session, err := newTraceSession(t.srcIP, dstIP, protocol, port)
+	if err != nil {
+		return nil, err
+	}
+	defer session.close()
+
+	trace := &Trace{Protocol: protocol, Port: port}
+	var shared *tracedRoute
+	if distance <= 0 || distance > maxHops {
+		session.probe(hopRange(1, maxHops))
+	} else {
+		session.probe([]int{distance})
+		if !session.reachedBy(distance) {
+			session.probe(hopRange(distance+1, maxHops))
+		}
+		for ttl := distance - 1; ttl >= 1; ttl-- {
+			session.probe([]int{ttl})
+			reply, ok := session.replies[ttl]
+			if !ok || reply.destination {
+				continue
+			}
+			if route := t.sharedRoute(ttl, reply.ip.String()); route != nil {
+				shared = route
+				trace.SharedWith, trace.SharedHops = route.host, ttl
+				break
+			}
+		}
+	}
+
+	last := session.destinationTTL()
+	if last == 0 {
+		// The host never answered, so the route ends at the farthest router that did
+		for ttl := range session.replies {
+			last = max(last, ttl)
+		}
+	}
+
+	for ttl := 1; ttl <= last; ttl++ {
+		if shared != nil && ttl < trace.SharedHops && ttl <= len(shared.hops) {
+			trace.Hops = append(trace.Hops, shared.hops[ttl-1])
+			continue
+		}
+		hop := Hop{TTL: ttl}
+		if reply, ok := session.replies[ttl]; ok {
+			hop.IP = reply.ip.String()
+			hop.RTT = float64(reply.rtt.Microseconds()) / 1000
+		}
+		trace.Hops = append(trace.Hops, hop)
+	}
+	t.nameHops(trace.Hops)
+
+	t.routes = append(t.routes, tracedRoute{host: dstIP.String(), hops: trace.Hops})
+	return trace, nil
+}
+
+// sharedRoute returns an earlier route that went through ip at the same TTL
+func (t *Tracer) sharedRoute(ttl int, ip string) *tracedRoute {
+	for i := range t.routes {
+		if len(t.routes[i].hops) >= ttl && t.routes[i].hops[ttl-1].IP == ip {
+			return &t.routes[i]
+		}
+	}
+	return nil
+}
+
+// nameHops looks up the reverse DNS names of the hops that answered and aren't named yet, all at once
+func (t *Tracer) nameHops(hops []Hop) {
+	if t.resolver == nil {
+		return
+	}
+	var ips []string
+	for _, hop := range hops {
+		if hop.IP != "" && hop.Host == "" {
+			ips = append(ips, hop.IP)
+		}
+	}
+	names := t.resolver.LookupAddrs(ips)
+	for i := range hops {
+		if hops[i].Host == "" {
+			hops[i].Host = names[hops[i].IP]
+		}
+	}
+}
+
+// hopRange returns the TTLs from first to last
+func hopRange(first, last int) []int {
+	var ttls []int
+	for ttl := first; ttl <= last; ttl++ {
+		ttls = append(ttls, ttl)
+	}
+	return ttls
+}
+
+// traceReply is the first reply to the probe with a TTL
+type traceReply struct {
+	ttl int
+	ip  net.IP
+	rtt time.Duration
+	// destination is true when the host itself answered, rather than a router on the way
+	destination bool
+}
+
+// traceSession is the capture, socket and replies of the probes tracing the route to a single host.
+// Every probe carries its TTL in its IP ID, and in its sequence number for TCP, which the replies echo back.
+type traceSession struct {
+	srcIP, dstIP     net.IP
+	protocol         string
+	srcPort, dstPort uint16
+	idBase           uint16
+	seqBase          uint32
+
+	fd      int
+	handle  *pcap.Handle
+	sent    map[int]time.Time
+	replies map[int]traceReply
+	packets chan gopacket.Packet
+	done    chan struct{}
+}
+
+// newTraceSession opens the capture and socket for tracing the route to dstIP
+func newTraceSession(srcIP, dstIP net.IP, protocol string, dstPort uint16) (*traceSession, error) {
+	srcPort, err := factory.GenerateRandomPort()
+	if err != nil {
+		logger.Error("Failed to generate random port", "err", err)
+		return nil, fmt.Errorf("error generating random port: %w", err)
+	}
+
+	// Routers answer with ICMP, the host with ICMP or on the protocol of the probes
+	handle, err := openCapture(fmt.Sprintf("dst host %s and (icmp or (src host %s and %s and dst port %d))",
+		srcIP.String(), dstIP.String(), protocol, srcPort))
+	if err != nil {
+		factory.ReleasePort(srcPort)
+		return nil, err
+	}
+
+	fd, err := OpenRawSocket()
+	if err != nil {
+		handle.Close()
+		factory.ReleasePort(srcPort)
+		return nil, err
+	}
+
+	s := &traceSession{
+		srcIP:    srcIP,
+		dstIP:    dstIP,
+		protocol: protocol,
+		srcPort:  srcPort,
+		dstPort:  dstPort,
+		idBase:   uint16(rand.Uint32()),
+		seqBase:  rand.Uint32(),
+		fd:       fd,
+		handle:   handle,
+		sent:     make(map[int]time.Time),
+		replies:  make(map[int]traceReply),
+		packets:  make(chan gopacket.Packet, 64),
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+		for {
+			select {
+			case packet, ok := <-packetSource.Packets():
+				if !ok {
+					return
+				}
+				select {
+				case s.packets <- packet:
+				case <-s.done:
+					return
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// close stops the capture and releases the socket and port of the session
+func (s *traceSession) close() {
+	close(s.done)
+	s.handle.Close()
+	syscall.Close(s.fd)
+	factory.ReleasePort(s.srcPort)
+}
+
+// probe sends a probe with each TTL and waits until they're all answered or [hopTimeout] passes
+func (s *traceSession) probe(ttls []int) {
+	for _, ttl := range ttls {
+		packet, err := s.buildProbe(ttl)
+		if err != nil {
+			logger.Error("Failed to build traceroute probe", "ttl", ttl, "err", err)
+			continue
+		}
+		s.sent[ttl] = time.Now()
+		if err := SendRawPacket(s.fd, packet, s.dstIP); err != nil {
+			logger.Error("Failed to send traceroute probe", "ttl", ttl, "err", err)
+		}
+	}
+
+	deadline := time.After(hopTimeout)
+	for !s.answered(ttls) {
+		select {
+		case packet := <-s.packets:
+			if reply, ok := s.match(packet); ok {
+				if _, seen := s.replies[reply.ttl]; !seen {
+					s.replies[reply.ttl] = reply
+					traceReceived(packet, "")
+				}
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// buildProbe builds the probe with a TTL: a SYN like the scan sends for TCP, a datagram with the payload-less
+// probe of the UDP scan for UDP
+func (s *traceSession) buildProbe(ttl int) ([]byte, error) {
+	fields := factory.IPFields{ID: s.idBase + uint16(ttl), TTL: uint8(ttl)}
+	if s.protocol == "udp" {
+		return factory.CreateUDPProbe(s.srcIP, s.dstIP, fields, s.srcPort, s.dstPort, nil)
+	}
+	packet, _, _, err := factory.CreateSYNPacketWithFields(s.srcIP, s.dstIP, s.srcPort, s.dstPort, s.seqBase+uint32(ttl), fields)
+	return packet, err
+}
+
+// answered returns true once every TTL got a reply, or the host answered a lower one
+func (s *traceSession) answered(ttls []int) bool {
+	for _, ttl := range ttls {
+		if _, ok := s.replies[ttl]; !ok && (s.destinationTTL() == 0 || ttl < s.destinationTTL()) {
+			return false
+		}
+	}
+	return true
+}
+
+// reachedBy returns true if the probe with the TTL reached the host
+func (s *traceSession) reachedBy(ttl int) bool {
+	reply, ok := s.replies[ttl]
+	return ok && reply.destination
+}
+
+// destinationTTL returns the lowest TTL that reached the host, or 0 if none did yet
+func (s *traceSession) destinationTTL() int {
+	lowest := 0
+	for ttl, reply := range s.replies {
+		if reply.destination && (lowest == 0 || ttl < lowest) {
+			lowest = ttl
+		}
+	}
+	return lowest
+}
+
+// match returns the reply a packet is, and the TTL of the probe it answers
+func (s *traceSession) match(packet gopacket.Packet) (traceReply, bool) {
+	ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return traceReply{}, false
+	}
+
+	ttl := 0
+	destination := ip.SrcIP.Equal(s.dstIP)
+	switch {
+	case packet.Layer(layers.LayerTypeICMPv4) != nil:
+		icmp := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if t := icmp.TypeCode.Type(); t != layers.ICMPv4TypeTimeExceeded && t != layers.ICMPv4TypeDestinationUnreachable {
+			return traceReply{}, false
+		}
+		// The quoted header and the ports after it identify the probe
+		quoted := icmp.Payload
+		if len(quoted) < 28 || !net.IP(quoted[16:20]).Equal(s.dstIP) || binary.BigEndian.Uint16(quoted[20:]) != s.srcPort {
+			return traceReply{}, false
+		}
+		ttl = int(binary.BigEndian.Uint16(quoted[4:]) - s.idBase)
+		// Only the host itself says a port is unreachable, routers say time exceeded
+		destination = destination && icmp.TypeCode.Type() == layers.ICMPv4TypeDestinationUnreachable
+	case packet.Layer(layers.LayerTypeTCP) != nil:
+		tcp := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !destination || !tcp.ACK {
+			return traceReply{}, false
+		}
+		ttl = int(tcp.Ack - 1 - s.seqBase)
+	case packet.Layer(layers.LayerTypeUDP) != nil:
+		// UDP replies carry nothing of the probe, so they answer the lowest TTL no router answered
+		if !destination {
+			return traceReply{}, false
+		}
+		for ttl = 1; ttl <= maxHops; ttl++ {
+			if _, ok := s.replies[ttl]; !ok && !s.sent[ttl].IsZero() {
+				break
+			}
+		}
+	default:
+		return traceReply{}, false
+	}
+
+	sent, ok := s.sent[ttl]
+	if ttl < 1 || ttl > maxHops || !ok {
+		return traceReply{}, false
+	}
+	received := packet.Metadata().Timestamp
+	if received.IsZero() {
+		received = time.Now()
+	}
+	return traceReply{ttl: ttl, ip: ip.SrcIP, rtt: received.Sub(sent), destination: destination}, true
+}
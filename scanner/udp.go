@@ -0,0 +1,239 @@
+package scanner
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/0niSec/gomap/factory"
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/progress"
+	"github.com/0niSec/gomap/services"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+)
+
+// StartUDPCapture starts a packet capture of the UDP replies and ICMP unreachables to a UDP probe from srcPort.
+// Replies are matched on our port alone, since services like TFTP answer from another port.
+func StartUDPCapture(srcIP, dstIP net.IP, srcPort uint16) (*pcap.Handle, func(), error) {
+	logger.Debug("Starting UDP packet capture", "srcIP", srcIP, "srcPort", srcPort, "dstIP", dstIP)
+
+	// ICMP errors can come from a router on the way, so they're matched on the packet they quote instead
+	filter := fmt.Sprintf("(udp and src host %s and dst host %s and dst port %d) or (icmp and dst host %s and icmp[0] == 3)",
+		dstIP.String(), srcIP.String(), srcPort, srcIP.String())
+
+	handle, err := openCapture(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		logger.Debug("Closing UDP packet capture handle", "srcIP", srcIP, "srcPort", srcPort, "dstIP", dstIP)
+		handle.Close()
+	}
+
+	return handle, cleanup, nil
+}
+
+// ProcessUDPCapture waits for the reply to a UDP probe and returns the status of the port.
+// The packets come from a single packet source on the capture of the probe, shared by all its retransmissions.
+func ProcessUDPCapture(packets <-chan gopacket.Packet, dstIP net.IP, srcPort, dstPort uint16, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				return "", fmt.Errorf("capture closed while waiting for a reply")
+			}
+			if packet == nil {
+				continue
+			}
+
+			status := ClassifyUDPReply(packet, dstIP, srcPort, dstPort)
+			if status == "" {
+				continue
+			}
+			logger.Debug("Port status", "dstPort", dstPort, "status", status)
+
+			traceReceived(packet, status)
+			progress.ReplyReceived()
+			progress.Discovered(dstIP.String(), dstPort, "udp", status)
+			return status, nil
+
+		case <-deadline:
+			logger.Debug("Timeout reached", "dstPort", dstPort)
+			return "open|filtered", nil
+		}
+	}
+}
+
+// ClassifyUDPReply returns the port status implied by a reply to a UDP probe from srcPort to dstIP:dstPort,
+// or an empty string if the packet isn't a reply to it.
+// Any UDP reply means the port is open, an ICMP port unreachable means it's closed and any other ICMP
+// unreachable means it's filtered.
+func ClassifyUDPReply(packet gopacket.Packet, dstIP net.IP, srcPort, dstPort uint16) string {
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		if udp.DstPort == layers.UDPPort(srcPort) {
+			return "open"
+		}
+		return ""
+	}
+
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok || icmp.TypeCode.Type() != layers.ICMPv4TypeDestinationUnreachable {
+		return ""
+	}
+
+	// The ICMP error quotes the IP header and the first 8 bytes of the datagram it's about
+	quoted := icmp.Payload
+	if len(quoted) < 20 {
+		return ""
+	}
+	headerLength := int(quoted[0]&0x0f) * 4
+	if len(quoted) < headerLength+4 || quoted[9] != uint8(layers.IPProtocolUDP) || !net.IP(quoted[16:20]).Equal(dstIP) {
+		return ""
+	}
+	if binary.BigEndian.Uint16(quoted[headerLength:]) != srcPort || binary.BigEndian.Uint16(quoted[headerLength+2:]) != dstPort {
+		return ""
+	}
+
+	if icmp.TypeCode.Code() == layers.ICMPv4CodePort {
+		return "closed"
+	}
+	return "filtered"
+}
+
+// UDPScan performs a UDP scan of the ports of dstIP. Each port is sent the payloads its service answers, so
+// silent services still reply, and SNMP is asked with each of the communities.
+// Ports that don't answer are open|filtered, since an open port whose service ignores the payload looks
+// the same as a firewall dropping it.
+//
+// Timeouts, parallelism, retries, interruption and checkpoints work like [Scan].
+func UDPScan(ctx context.Context, srcIP, dstIP net.IP, ports []uint16, payloads *services.PayloadDB, communities []string, timeout time.Duration, maxParallelism, maxRetries int, state *ScanState) (map[uint16]string, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	alive, err := factory.SendICMPRequest(dstIP)
+	if err != nil {
+		return nil, fmt.Errorf("error sending ICMP request: %w", err)
+	}
+	if !alive {
+		return nil, ErrTargetDown
+	}
+
+	results := make(map[uint16]string)
+	resultChan := make(chan portStatus, len(ports))
+
+	if maxParallelism <= 0 || maxParallelism > len(ports) {
+		maxParallelism = len(ports)
+	}
+	slots := make(chan struct{}, maxParallelism)
+	launched := 0
+
+	for _, dstPort := range ports {
+		select {
+		case <-ctx.Done():
+		case slots <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			logger.Debug("Scan interrupted, waiting for probes in flight", "launched", launched)
+			break
+		}
+		launched++
+
+		go func(dstPort uint16) {
+			defer func() { <-slots }()
+			status, finished, err := probeUDPPort(ctx, srcIP, dstIP, dstPort, payloads.For(dstPort, communities), timeout, maxRetries)
+			if err != nil {
+				logger.Error("Failed to probe UDP port", "dstPort", dstPort, "err", err)
+				status = "error"
+			}
+			resultChan <- portStatus{port: dstPort, status: status, unfinished: !finished}
+		}(dstPort)
+	}
+
+	lastSave := time.Now()
+	for i := 0; i < launched; i++ {
+		result := <-resultChan
+		results[result.port] = result.status
+		if !result.unfinished {
+			state.SetResult(dstIP.String(), result.port, result.status)
+			checkpoint(state, &lastSave)
+		}
+	}
+
+	return results, ctx.Err()
+}
+
+// probeUDPPort sends the payloads to a single port and waits for a reply, sending them again up to maxRetries
+// times while nothing answers. Every payload is sent from the same port, so replies to any of them are caught,
+// unless the first payload has to be sent from a fixed port.
+// The returned bool is false when ctx was cancelled before every retry was sent.
+func probeUDPPort(ctx context.Context, srcIP, dstIP net.IP, dstPort uint16, payloads []services.UDPPayload, timeout time.Duration, maxRetries int) (string, bool, error) {
+	srcPort := payloads[0].SourcePort
+	if srcPort == 0 {
+		port, err := factory.GenerateRandomPort()
+		if err != nil {
+			return "", false, fmt.Errorf("error generating random port: %w", err)
+		}
+		defer factory.ReleasePort(port)
+		srcPort = port
+	}
+
+	handle, cleanup, err := StartUDPCapture(srcIP, dstIP, srcPort)
+	if err != nil {
+		return "", false, fmt.Errorf("error starting packet capture: %w", err)
+	}
+	defer cleanup()
+
+	fd, err := OpenRawSocket()
+	if err != nil {
+		return "", false, err
+	}
+	defer syscall.Close(fd)
+
+	// A single packet source reads the capture for every attempt, so a late reply to an earlier
+	// attempt isn't lost to a reader nobody listens to anymore
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.NoCopy = true
+	packets := packetSource.Packets()
+
+	var status string
+	attempt := 0
+	for ; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			logger.Debug("Retransmitting UDP payloads", "dstPort", dstPort, "attempt", attempt)
+			progress.Retransmission()
+		}
+
+		for _, payload := range payloads {
+			packetData, err := factory.CreateUDPProbe(srcIP, dstIP, factory.IPFields{}, srcPort, dstPort, payload.Data)
+			if err != nil {
+				return "", false, err
+			}
+			if err := SendRawPacket(fd, packetData, dstIP); err != nil {
+				return "", false, err
+			}
+		}
+		// All the payloads sent to the port together make up a single probe
+		progress.ProbeSent()
+
+		status, err = ProcessUDPCapture(packets, dstIP, srcPort, dstPort, timeout)
+		if err != nil {
+			return "", false, err
+		}
+
+		// Only probes that went unanswered are worth sending again, and not once the scan is interrupted
+		if status != "open|filtered" || ctx.Err() != nil {
+			break
+		}
+	}
+
+	// The probe isn't finished if the interrupt cut its retries short
+	return status, status != "open|filtered" || attempt >= maxRetries, nil
+}
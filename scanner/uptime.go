@@ -0,0 +1,220 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0niSec/gomap/factory"
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/osfp"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+const (
+	// minUptimeSpan is how far apart the first and last timestamp samples need to be for the clock rate to be measured
+	minUptimeSpan = 200 * time.Millisecond
+	// uptimeProbes is how many SYNs [HostResult.ProbeUptime] sends, uptimeProbeInterval apart, so that together
+	// they span more than minUptimeSpan
+	uptimeProbes        = 3
+	uptimeProbeInterval = 150 * time.Millisecond
+)
+
+// timestampRates are the rates the timestamp clocks of common stacks tick at, in Hz
+var timestampRates = []float64{2, 10, 100, 200, 250, 1000}
+
+// Uptime is the time since the host booted, guessed from its TCP timestamp clock
+type Uptime struct {
+	Seconds  int64     `json:"seconds"`
+	LastBoot time.Time `json:"last_boot"`
+	// ClockRate is the rate of the timestamp clock, in Hz
+	ClockRate int `json:"clock_rate"`
+}
+
+// String formats the uptime like nmap's Uptime guess
+func (u *Uptime) String() string {
+	return fmt.Sprintf("Uptime guess: %.3f days (since %s)", float64(u.Seconds)/86400, u.LastBoot.Local().Format(time.ANSIC))
+}
+
+// timestampSample is the TSval of a reply and when the reply was received
+type timestampSample struct {
+	tsval uint32
+	at    time.Time
+}
+
+// estimateUptime measures the rate of the timestamp clock from the samples and returns how long it's been
+// ticking, or nil if the samples are too few, too close together or tick at an unusual rate.
+// Stacks that start their clock at a random value, like Linux since 4.10, give meaningless guesses.
+func estimateUptime(samples []timestampSample) *Uptime {
+	var valid []timestampSample
+	for _, sample := range samples {
+		if sample.tsval != 0 && !sample.at.IsZero() {
+			valid = append(valid, sample)
+		}
+	}
+	if len(valid) < 2 {
+		return nil
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].at.Before(valid[j].at) })
+
+	first, last := valid[0], valid[len(valid)-1]
+	span := last.at.Sub(first.at)
+	ticks := int32(last.tsval - first.tsval)
+	if span < minUptimeSpan || ticks <= 0 {
+		return nil
+	}
+
+	// Snap the measured rate to the closest common one, since the capture times are off by some jitter
+	measured := float64(ticks) / span.Seconds()
+	rate := 0.0
+	for _, common := range timestampRates {
+		if math.Abs(math.Log(measured/common)) < math.Log(1.25) {
+			rate = common
+			break
+		}
+	}
+	if rate == 0 {
+		return nil
+	}
+
+	seconds := int64(float64(last.tsval) / rate)
+	return &Uptime{
+		Seconds:   seconds,
+		LastBoot:  last.at.Add(-time.Duration(seconds) * time.Second).Truncate(time.Second),
+		ClockRate: int(rate),
+	}
+}
+
+// hintSamples returns the timestamp samples of the SYN/ACKs of the host. When several stacks answer for it,
+// only the first stack's are used, since the clocks of the others run on other machines.
+func (h *HostResult) hintSamples() []timestampSample {
+	var samples []timestampSample
+	for _, port := range h.Ports {
+		if port.Hints == nil {
+			continue
+		}
+		if len(h.Stacks) > 0 && !sameStack(h.Stacks[0].hints, port.Hints) {
+			continue
+		}
+		samples = append(samples, timestampSample{tsval: port.Hints.TSval, at: port.Hints.received})
+	}
+	return samples
+}
+
+// ProbeUptime guesses the uptime of the host when the SYN/ACKs of the scan came back too close together to measure
+// its timestamp clock, which is common since the ports are probed in parallel. It sends a few spaced SYNs to an open
+// port and measures the clock from their SYN/ACKs along with the ones of the scan.
+// Hosts whose uptime is known, or whose SYN/ACKs have no timestamps, are left as they are.
+func (h *HostResult) ProbeUptime(srcIP net.IP, timeout time.Duration) {
+	if h.Uptime != nil {
+		return
+	}
+
+	// Probe the port of the first stack, since the clocks of the others run on other machines
+	var port uint16
+	for _, p := range h.Ports {
+		if p.Hints != nil && p.Hints.TSval != 0 && (len(h.Stacks) == 0 || sameStack(h.Stacks[0].hints, p.Hints)) {
+			port = p.Port
+			break
+		}
+	}
+	if port == 0 {
+		return
+	}
+
+	// Samples far enough apart already failed to give a common clock rate, and more of them won't help
+	samples := h.hintSamples()
+	if sampleSpan(samples) >= minUptimeSpan {
+		return
+	}
+
+	dstIP := net.ParseIP(h.IP)
+	for i := 0; i < uptimeProbes; i++ {
+		if i > 0 {
+			time.Sleep(uptimeProbeInterval)
+		}
+		hints, err := probeSYNAck(srcIP, dstIP, port, timeout)
+		if err != nil {
+			logger.Debug("Failed to probe timestamp clock", "dstIP", dstIP, "dstPort", port, "err", err)
+			continue
+		}
+		if hints != nil {
+			samples = append(samples, timestampSample{tsval: hints.TSval, at: hints.received})
+		}
+	}
+
+	h.Uptime = estimateUptime(samples)
+}
+
+// sampleSpan returns how far apart the first and last samples with a timestamp are
+func sampleSpan(samples []timestampSample) time.Duration {
+	var first, last time.Time
+	for _, sample := range samples {
+		if sample.tsval == 0 || sample.at.IsZero() {
+			continue
+		}
+		if first.IsZero() || sample.at.Before(first) {
+			first = sample.at
+		}
+		if sample.at.After(last) {
+			last = sample.at
+		}
+	}
+	return last.Sub(first)
+}
+
+// probeSYNAck sends a single SYN to an open port and returns the stack hints of the SYN/ACK, or nil without one
+func probeSYNAck(srcIP, dstIP net.IP, dstPort uint16, timeout time.Duration) (*StackHints, error) {
+	srcPort, err := factory.GenerateRandomPort()
+	if err != nil {
+		return nil, fmt.Errorf("error generating random port: %w", err)
+	}
+	defer factory.ReleasePort(srcPort)
+
+	handle, cleanup, err := StartPacketCapture(srcIP, dstIP, srcPort, dstPort)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.NoCopy = true
+
+	seq := rand.Uint32()
+	packetData, _, _, err := factory.CreateSYNPacket(srcIP, dstIP, srcPort, dstPort, seq)
+	if err != nil {
+		return nil, err
+	}
+	if err := SendSYNPacket(packetData, srcIP, dstIP); err != nil {
+		return nil, err
+	}
+
+	_, hints, err := ProcessCapturedPacket(packetSource.Packets(), srcIP, dstIP, srcPort, dstPort, seq, timeout)
+	return hints, err
+}
+
+// probeSamples returns the timestamp samples of the replies to the SEQ probes of OS detection, sent 100ms apart
+func probeSamples(probes []*osfp.Probe) []timestampSample {
+	var samples []timestampSample
+	for _, probe := range probes {
+		if !strings.HasPrefix(probe.Name, "SEQ") || probe.Reply == nil {
+			continue
+		}
+		tcp, ok := probe.Reply.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			continue
+		}
+		for _, option := range tcp.Options {
+			if option.OptionType == layers.TCPOptionKindTimestamps && len(option.OptionData) == 8 {
+				samples = append(samples, timestampSample{tsval: binary.BigEndian.Uint32(option.OptionData), at: probe.Received})
+			}
+		}
+	}
+	return samples
+}
@@ -0,0 +1,357 @@
+package scripts
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/services"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// socketType is the name of the metatable of sockets
+	socketType = "gomap.socket"
+	// defaultTimeout is how long connections and reads may take when a script doesn't say
+	defaultTimeout = 5 * time.Second
+	// maxReceive is the most a single receive returns
+	maxReceive = 64 * 1024
+	// maxBodySize is how much of an HTTP response body is read
+	maxBodySize = 1024 * 1024
+)
+
+// session is the Lua state a script runs in, along with the connections it opened so they can be
+// closed when the script is done
+type session struct {
+	L      *lua.LState
+	script *Script
+	conns  []net.Conn
+}
+
+// socket is a connection opened by a script
+type socket struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// newSession creates a Lua state with the safe standard libraries and the gomap API. Scripts get no io or os,
+// they can only talk to the network through the API.
+func newSession(script *Script, args map[string]string) *session {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	s := &session{L: L, script: script}
+
+	methods := L.NewTypeMetatable(socketType)
+	L.SetField(methods, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"send":          socketSend,
+		"receive":       socketReceive,
+		"receive_line":  socketReceiveLine,
+		"receive_bytes": socketReceiveBytes,
+		"certificate":   socketCertificate,
+		"close":         socketClose,
+	}))
+
+	api := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"connect":  s.connect,
+		"http":     httpRequest,
+		"http_get": httpGet,
+		"log":      s.log,
+	})
+	argsTable := L.NewTable()
+	for name, value := range args {
+		argsTable.RawSetString(name, lua.LString(value))
+	}
+	L.SetField(api, "args", argsTable)
+	L.SetGlobal("gomap", api)
+
+	return s
+}
+
+// Close closes the Lua state and every connection the script left open
+func (s *session) Close() {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.L.Close()
+}
+
+// fail returns nil and the error to Lua, the way Lua functions report errors that scripts are expected to handle
+func fail(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// hostArg returns the IP address in argument n, either a string or a host table
+func hostArg(L *lua.LState, n int) string {
+	if host, ok := L.Get(n).(*lua.LTable); ok {
+		return lua.LVAsString(host.RawGetString("ip"))
+	}
+	return L.CheckString(n)
+}
+
+// portArg returns the port number in argument n, either a number or a port table
+func portArg(L *lua.LState, n int) int {
+	if port, ok := L.Get(n).(*lua.LTable); ok {
+		return int(lua.LVAsNumber(port.RawGetString("number")))
+	}
+	return L.CheckInt(n)
+}
+
+// timeoutOpt returns the timeout in milliseconds of an options table, or the default one
+func timeoutOpt(opts *lua.LTable) time.Duration {
+	if ms, ok := opts.RawGetString("timeout").(lua.LNumber); ok && ms > 0 {
+		return time.Duration(float64(ms) * float64(time.Millisecond))
+	}
+	return defaultTimeout
+}
+
+// tlsOpt returns whether to use TLS: the tls option when it's given, and otherwise whether the port
+// argument at n is a port table of a TLS service
+func tlsOpt(L *lua.LState, n int, opts *lua.LTable) bool {
+	if useTLS, ok := opts.RawGetString("tls").(lua.LBool); ok {
+		return bool(useTLS)
+	}
+	if port, ok := L.Get(n).(*lua.LTable); ok {
+		return lua.LVAsBool(port.RawGetString("tls"))
+	}
+	return false
+}
+
+// connect opens a connection: gomap.connect(host, port, {protocol = "tcp" or "udp", tls = bool, timeout = ms})
+func (s *session) connect(L *lua.LState) int {
+	address := net.JoinHostPort(hostArg(L, 1), strconv.Itoa(portArg(L, 2)))
+	opts := L.OptTable(3, L.NewTable())
+	timeout := timeoutOpt(opts)
+
+	protocol := "tcp"
+	if value := opts.RawGetString("protocol"); value != lua.LNil {
+		protocol = value.String()
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		L.ArgError(3, "protocol must be tcp or udp")
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if protocol == "tcp" && tlsOpt(L, 2, opts) {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, services.TLSConfig())
+	} else {
+		conn, err = dialer.Dial(protocol, address)
+	}
+	if err != nil {
+		return fail(L, err)
+	}
+	s.conns = append(s.conns, conn)
+
+	ud := L.NewUserData()
+	ud.Value = &socket{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+	L.SetMetatable(ud, L.GetTypeMetatable(socketType))
+	L.Push(ud)
+	return 1
+}
+
+// checkSocket returns the socket the method was called on
+func checkSocket(L *lua.LState) *socket {
+	if sock, ok := L.CheckUserData(1).Value.(*socket); ok {
+		return sock
+	}
+	L.ArgError(1, "socket expected")
+	return nil
+}
+
+// socketSend sends data: sock:send(data)
+func socketSend(L *lua.LState) int {
+	sock := checkSocket(L)
+	sock.conn.SetWriteDeadline(time.Now().Add(sock.timeout))
+	if _, err := sock.conn.Write([]byte(L.CheckString(2))); err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// socketReceive returns whatever arrives next, or what's already buffered: sock:receive()
+func socketReceive(L *lua.LState) int {
+	sock := checkSocket(L)
+	sock.conn.SetReadDeadline(time.Now().Add(sock.timeout))
+	buf := make([]byte, maxReceive)
+	n, err := sock.reader.Read(buf)
+	if n == 0 && err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LString(buf[:n]))
+	return 1
+}
+
+// socketReceiveLine returns the next line without its line ending: sock:receive_line()
+func socketReceiveLine(L *lua.LState) int {
+	sock := checkSocket(L)
+	sock.conn.SetReadDeadline(time.Now().Add(sock.timeout))
+	line, err := sock.reader.ReadString('\n')
+	if line == "" && err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LString(strings.TrimRight(line, "\r\n")))
+	return 1
+}
+
+// socketReceiveBytes returns exactly n bytes: sock:receive_bytes(n)
+func socketReceiveBytes(L *lua.LState) int {
+	sock := checkSocket(L)
+	n := L.CheckInt(2)
+	if n < 0 || n > maxReceive {
+		L.ArgError(2, "byte count out of range")
+	}
+	sock.conn.SetReadDeadline(time.Now().Add(sock.timeout))
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(sock.reader, buf); err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LString(buf))
+	return 1
+}
+
+// socketCertificate returns the certificate of a TLS connection, or nil: sock:certificate()
+func socketCertificate(L *lua.LState) int {
+	conn, ok := checkSocket(L).conn.(*tls.Conn)
+	if !ok || len(conn.ConnectionState().PeerCertificates) == 0 {
+		L.Push(lua.LNil)
+		return 1
+	}
+	cert := conn.ConnectionState().PeerCertificates[0]
+
+	names := L.NewTable()
+	for _, name := range cert.DNSNames {
+		names.Append(lua.LString(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		names.Append(lua.LString(ip.String()))
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	table := L.NewTable()
+	table.RawSetString("subject", lua.LString(cert.Subject.String()))
+	table.RawSetString("issuer", lua.LString(cert.Issuer.String()))
+	table.RawSetString("not_before", lua.LString(cert.NotBefore.UTC().Format(time.RFC3339)))
+	table.RawSetString("not_after", lua.LString(cert.NotAfter.UTC().Format(time.RFC3339)))
+	table.RawSetString("names", names)
+	table.RawSetString("sha256", lua.LString(hex.EncodeToString(fingerprint[:])))
+	L.Push(table)
+	return 1
+}
+
+// socketClose closes the connection: sock:close()
+func socketClose(L *lua.LState) int {
+	checkSocket(L).conn.Close()
+	return 0
+}
+
+// httpRequest sends a request without following redirects:
+// gomap.http(method, host, port, path, {tls = bool, headers = table, body = string, timeout = ms}).
+// It returns a table with the status, the headers with lowercase names and the body.
+func httpRequest(L *lua.LState) int {
+	return doHTTP(L, L.CheckString(1), 2)
+}
+
+// httpGet sends a GET request: gomap.http_get(host, port, path, options)
+func httpGet(L *lua.LState) int {
+	return doHTTP(L, http.MethodGet, 1)
+}
+
+// doHTTP sends a request whose host, port, path and options are the arguments starting at n
+func doHTTP(L *lua.LState, method string, n int) int {
+	address := net.JoinHostPort(hostArg(L, n), strconv.Itoa(portArg(L, n+1)))
+	path := L.OptString(n+2, "/")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	opts := L.OptTable(n+3, L.NewTable())
+	timeout := timeoutOpt(opts)
+
+	scheme := "http"
+	if tlsOpt(L, n+1, opts) {
+		scheme = "https"
+	}
+
+	ctx := L.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+address+path, strings.NewReader(lua.LVAsString(opts.RawGetString("body"))))
+	if err != nil {
+		return fail(L, err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; gomap)")
+	req.Header.Set("Accept", "*/*")
+	if headers, ok := opts.RawGetString("headers").(*lua.LTable); ok {
+		headers.ForEach(func(name, value lua.LValue) {
+			req.Header.Set(name.String(), value.String())
+		})
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// Never send scan traffic through a proxy from the environment
+			Proxy:             nil,
+			TLSClientConfig:   services.TLSConfig(),
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fail(L, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return fail(L, err)
+	}
+
+	headers := L.NewTable()
+	for name, values := range resp.Header {
+		headers.RawSetString(strings.ToLower(name), lua.LString(strings.Join(values, ", ")))
+	}
+
+	table := L.NewTable()
+	table.RawSetString("status", lua.LNumber(resp.StatusCode))
+	table.RawSetString("headers", headers)
+	table.RawSetString("body", lua.LString(body))
+	L.Push(table)
+	return 1
+}
+
+// log writes a debug message: gomap.log(message)
+func (s *session) log(L *lua.LState) int {
+	logger.Debug("Script log", "script", s.script.ID, "message", L.CheckString(1))
+	return 0
+}
@@ -0,0 +1,30 @@
+description = [[
+Shows the banner a TCP service sends when a client connects, for services version detection didn't grab it from.
+]]
+
+categories = {"discovery", "safe"}
+
+portrule = function(host, port)
+  return port.protocol == "tcp" and not port.http and (port.banner == nil or port.banner == "")
+end
+
+action = function(host, port)
+  local sock = gomap.connect(host, port, {timeout = tonumber(gomap.args["banner.timeout"]) or 3000})
+  if not sock then
+    return nil
+  end
+  local data = sock:receive()
+  sock:close()
+  if not data then
+    return nil
+  end
+
+  local line = data:match("^[^\r\n]*"):gsub("%c", ".")
+  if #line > 80 then
+    line = line:sub(1, 77) .. "..."
+  end
+  if line == "" then
+    return nil
+  end
+  return line
+end
@@ -0,0 +1,29 @@
+description = [[
+Lists the services of a host that send credentials in cleartext, like Telnet, FTP and POP3 without TLS.
+]]
+
+categories = {"default", "safe"}
+
+local cleartext = {
+  ftp = true, telnet = true, pop3 = true, imap = true, rlogin = true, rsh = true, rexec = true,
+  vnc = true, snmp = true, ldap = true, tftp = true,
+}
+
+-- services returns the cleartext services among the open ports of the host
+local function services(host)
+  local found = {}
+  for _, port in ipairs(host.ports) do
+    if cleartext[port.service] and not port.tls then
+      table.insert(found, string.format("%d/%s %s", port.number, port.protocol, port.service))
+    end
+  end
+  return found
+end
+
+hostrule = function(host)
+  return #services(host) > 0
+end
+
+action = function(host)
+  return services(host)
+end
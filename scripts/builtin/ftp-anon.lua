@@ -0,0 +1,50 @@
+description = [[
+Checks whether an FTP server allows anonymous logins.
+The password sent can be changed with the ftp-anon.password argument.
+]]
+
+categories = {"default", "safe", "vuln"}
+
+portrule = function(host, port)
+  return port.service == "ftp" or port.service == "ftps" or port.number == 21
+end
+
+-- reply reads an FTP reply, skipping the lines of multiline replies, and returns its code
+local function reply(sock)
+  while true do
+    local line, err = sock:receive_line()
+    if not line then
+      return nil, err
+    end
+    local code, sep = line:match("^(%d%d%d)(.?)")
+    if code and sep ~= "-" then
+      return tonumber(code), line
+    end
+  end
+end
+
+action = function(host, port)
+  local sock = gomap.connect(host, port)
+  if not sock then
+    return nil
+  end
+
+  local code = reply(sock)
+  if code ~= 220 then
+    return nil
+  end
+
+  sock:send("USER anonymous\r\n")
+  code = reply(sock)
+  if code == 331 then
+    sock:send("PASS " .. (gomap.args["ftp-anon.password"] or "anonymous@") .. "\r\n")
+    code = reply(sock)
+  end
+  sock:send("QUIT\r\n")
+  sock:close()
+
+  if code == 230 then
+    return "Anonymous FTP login allowed (FTP code 230)"
+  end
+  return nil
+end
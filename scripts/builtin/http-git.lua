@@ -0,0 +1,32 @@
+description = [[
+Checks whether a web server exposes a Git repository at /.git/, which usually leaks the source code
+and sometimes credentials.
+]]
+
+categories = {"safe", "vuln"}
+
+portrule = function(host, port)
+  return port.http
+end
+
+action = function(host, port)
+  local response = gomap.http_get(host, port, "/.git/HEAD")
+  if not response or response.status ~= 200 then
+    return nil
+  end
+
+  local head = response.body:match("^ref: (%S+)") or response.body:match("^(%x+)%s*$")
+  if not head then
+    return nil
+  end
+
+  local output = {"VULNERABLE: Git repository found at /.git/", "HEAD: " .. head}
+  local config = gomap.http_get(host, port, "/.git/config")
+  if config and config.status == 200 then
+    local remote = config.body:match("url%s*=%s*(%S+)")
+    if remote then
+      table.insert(output, "Remote: " .. remote)
+    end
+  end
+  return output
+end
@@ -0,0 +1,46 @@
+description = [[
+Lists the entries disallowed by /robots.txt on web servers.
+The number of entries shown is limited by the http-robots.limit argument (20 by default).
+]]
+
+categories = {"default", "safe", "discovery"}
+
+portrule = function(host, port)
+  return port.http
+end
+
+action = function(host, port)
+  local response = gomap.http_get(host, port, "/robots.txt")
+  if not response or response.status ~= 200 then
+    return nil
+  end
+
+  local disallowed = {}
+  for line in response.body:gmatch("[^\r\n]+") do
+    local path = line:match("^%s*[Dd]isallow:%s*(%S+)")
+    if path then
+      table.insert(disallowed, path)
+    end
+  end
+  if #disallowed == 0 then
+    return nil
+  end
+
+  local limit = tonumber(gomap.args["http-robots.limit"]) or 20
+  local output = {string.format("%d disallowed %s", #disallowed, #disallowed == 1 and "entry" or "entries")}
+  local line = {}
+  for i = 1, math.min(#disallowed, limit) do
+    table.insert(line, disallowed[i])
+    if #line == 5 then
+      table.insert(output, table.concat(line, " "))
+      line = {}
+    end
+  end
+  if #line > 0 then
+    table.insert(output, table.concat(line, " "))
+  end
+  if #disallowed > limit then
+    table.insert(output, string.format("... %d more", #disallowed - limit))
+  end
+  return output
+end
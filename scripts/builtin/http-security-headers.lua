@@ -0,0 +1,33 @@
+description = [[
+Reports the security headers missing from the response to a request for /.
+Strict-Transport-Security is only expected over TLS.
+]]
+
+categories = {"default", "safe"}
+
+portrule = function(host, port)
+  return port.http
+end
+
+action = function(host, port)
+  local response = gomap.http_get(host, port, "/")
+  if not response then
+    return nil
+  end
+
+  local expected = {"content-security-policy", "x-frame-options", "x-content-type-options"}
+  if port.tls then
+    table.insert(expected, 1, "strict-transport-security")
+  end
+
+  local missing = {}
+  for _, name in ipairs(expected) do
+    if not response.headers[name] then
+      table.insert(missing, name)
+    end
+  end
+  if #missing == 0 then
+    return nil
+  end
+  return "Missing: " .. table.concat(missing, ", ")
+end
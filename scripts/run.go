@@ -0,0 +1,236 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0niSec/gomap/logger"
+	"github.com/0niSec/gomap/scanner"
+	"github.com/0niSec/gomap/services"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Options controls a script scan
+type Options struct {
+	Scripts []*Script
+	// Args are the arguments given with --script-args, available to scripts as gomap.args
+	Args map[string]string
+	// Workers is how many scripts run at once
+	Workers int
+	// Timeout is how long a single script may run against a single port or host, zero means no limit
+	Timeout time.Duration
+}
+
+// job is a script to run against a host, and against one of its ports for port scripts
+type job struct {
+	script *Script
+	host   int
+	// port is the index of the port in the host's ports, or -1 for host scripts
+	port int
+}
+
+// Run runs the scripts against the hosts and attaches their output to the results. Port scripts run against
+// every open port their portrule accepts, host scripts against every host their hostrule accepts.
+func Run(ctx context.Context, hosts []scanner.HostResult, opts Options) {
+	var jobs []job
+	for h, host := range hosts {
+		for p, port := range host.Ports {
+			if port.State != "open" {
+				continue
+			}
+			for _, script := range opts.Scripts {
+				if script.PortRule {
+					jobs = append(jobs, job{script: script, host: h, port: p})
+				}
+			}
+		}
+		for _, script := range opts.Scripts {
+			if script.HostRule {
+				jobs = append(jobs, job{script: script, host: h, port: -1})
+			}
+		}
+	}
+
+	workers := opts.Workers
+	if workers <= 0 || workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	// Every job writes its own slot, and the output is attached in order once they're all done
+	outputs := make([][]string, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				output, err := runJob(ctx, jobs[i], hosts, opts)
+				if err != nil {
+					logger.Debug("Script failed", "script", jobs[i].script.ID, "host", hosts[jobs[i].host].IP, "err", err)
+					continue
+				}
+				outputs[i] = output
+			}
+		}()
+	}
+	for i := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i, job := range jobs {
+		if len(outputs[i]) == 0 {
+			continue
+		}
+		result := scanner.ScriptResult{ID: job.script.ID, Output: outputs[i]}
+		if job.port < 0 {
+			hosts[job.host].Scripts = append(hosts[job.host].Scripts, result)
+		} else {
+			port := &hosts[job.host].Ports[job.port]
+			port.Scripts = append(port.Scripts, result)
+		}
+	}
+}
+
+// runJob runs a script against a host or a port in a fresh Lua state and returns its output,
+// or nothing if its rule didn't accept the target
+func runJob(ctx context.Context, j job, hosts []scanner.HostResult, opts Options) ([]string, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	session := newSession(j.script, opts.Args)
+	defer session.Close()
+	L := session.L
+	L.SetContext(ctx)
+
+	if err := j.script.load(L); err != nil {
+		return nil, err
+	}
+
+	rule := "hostrule"
+	args := []lua.LValue{hostTable(L, hosts[j.host])}
+	if j.port >= 0 {
+		rule = "portrule"
+		args = append(args, portTable(L, hosts[j.host].Ports[j.port]))
+	}
+
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal(rule), NRet: 1, Protect: true}, args...); err != nil {
+		return nil, fmt.Errorf("error running %s: %w", rule, err)
+	}
+	accepted := lua.LVAsBool(L.Get(-1))
+	L.Pop(1)
+	if !accepted {
+		return nil, nil
+	}
+
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("action"), NRet: 1, Protect: true}, args...); err != nil {
+		return nil, fmt.Errorf("error running action: %w", err)
+	}
+	output := formatOutput(L.Get(-1))
+	L.Pop(1)
+	return output, nil
+}
+
+// hostTable is the host as scripts see it: {ip, name, ports}, where ports are its open ports
+func hostTable(L *lua.LState, host scanner.HostResult) *lua.LTable {
+	ports := L.NewTable()
+	for _, port := range host.Ports {
+		if port.State == "open" {
+			ports.Append(portTable(L, port))
+		}
+	}
+
+	table := L.NewTable()
+	table.RawSetString("ip", lua.LString(host.IP))
+	table.RawSetString("name", lua.LString(host.Hostname))
+	table.RawSetString("ports", ports)
+	return table
+}
+
+// portTable is the port as scripts see it: {number, protocol, state, service, product, version, banner, tls, http}
+func portTable(L *lua.LState, port scanner.PortResult) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("number", lua.LNumber(port.Port))
+	table.RawSetString("protocol", lua.LString(port.Protocol))
+	table.RawSetString("state", lua.LString(port.State))
+	table.RawSetString("service", lua.LString(port.Service))
+
+	useTLS := port.Service == "https" || strings.HasPrefix(port.Service, "ssl/")
+	isHTTP := services.IsHTTP(port.Service)
+	if port.ServiceVersion != nil {
+		table.RawSetString("product", lua.LString(port.Product))
+		table.RawSetString("version", lua.LString(port.Version))
+		table.RawSetString("banner", lua.LString(port.Banner))
+		useTLS = useTLS || port.TLS != nil
+		isHTTP = isHTTP || port.HTTP != nil
+	}
+	table.RawSetString("tls", lua.LBool(useTLS))
+	table.RawSetString("http", lua.LBool(isHTTP))
+	return table
+}
+
+// formatOutput turns what an action returned into lines. Strings are split into lines, arrays give a line
+// per element and other tables a "key: value" line per key, sorted. Nested tables are indented.
+func formatOutput(value lua.LValue) []string {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil
+	case *lua.LTable:
+		var lines []string
+		if v.MaxN() > 0 {
+			for i := 1; i <= v.MaxN(); i++ {
+				lines = append(lines, formatElement("", v.RawGetInt(i))...)
+			}
+			return lines
+		}
+
+		values := make(map[string]lua.LValue)
+		var keys []string
+		v.ForEach(func(key, value lua.LValue) {
+			values[key.String()] = value
+			keys = append(keys, key.String())
+		})
+		sort.Strings(keys)
+		for _, key := range keys {
+			lines = append(lines, formatElement(key, values[key])...)
+		}
+		return lines
+	default:
+		text := strings.TrimRight(value.String(), "\r\n")
+		if text == "" {
+			return nil
+		}
+		return strings.Split(text, "\n")
+	}
+}
+
+// formatElement formats an element of a table returned by an action, under its key if it has one
+func formatElement(key string, value lua.LValue) []string {
+	if _, ok := value.(*lua.LTable); !ok {
+		if key == "" {
+			return formatOutput(value)
+		}
+		return []string{key + ": " + value.String()}
+	}
+
+	var lines []string
+	if key != "" {
+		lines = append(lines, key+":")
+	}
+	for _, line := range formatOutput(value) {
+		lines = append(lines, "  "+line)
+	}
+	return lines
+}
@@ -0,0 +1,216 @@
+// The scripts package runs Lua scripts against the hosts and ports found by a scan, like nmap's NSE.
+package scripts
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// builtinScripts are the scripts shipped with gomap
+//
+//go:embed builtin/*.lua
+var builtinScripts embed.FS
+
+// Categories are the categories built-in scripts belong to
+var Categories = []string{"default", "safe", "discovery", "vuln"}
+
+// Script is a compiled script and what it declared about itself
+type Script struct {
+	// ID is the file name of the script without the .lua extension
+	ID          string
+	Description string
+	Categories  []string
+	// PortRule and HostRule tell whether the script runs against ports or against hosts
+	PortRule bool
+	HostRule bool
+
+	proto *lua.FunctionProto
+}
+
+// Compile compiles the source of a script and reads its description, categories and rules.
+// A script has to define an action and either a portrule or a hostrule.
+func Compile(id, source string) (*Script, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), id)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing script %s: %w", id, err)
+	}
+	proto, err := lua.Compile(chunk, id)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling script %s: %w", id, err)
+	}
+
+	script := &Script{ID: id, proto: proto}
+
+	// Running the chunk only defines the globals, the rules and the action aren't called
+	session := newSession(script, nil)
+	defer session.Close()
+	L := session.L
+	if err := script.load(L); err != nil {
+		return nil, err
+	}
+
+	script.Description = strings.TrimSpace(lua.LVAsString(L.GetGlobal("description")))
+	if categories, ok := L.GetGlobal("categories").(*lua.LTable); ok {
+		categories.ForEach(func(_, value lua.LValue) {
+			script.Categories = append(script.Categories, value.String())
+		})
+	}
+	script.PortRule = L.GetGlobal("portrule").Type() == lua.LTFunction
+	script.HostRule = L.GetGlobal("hostrule").Type() == lua.LTFunction
+
+	if L.GetGlobal("action").Type() != lua.LTFunction {
+		return nil, fmt.Errorf("script %s doesn't define an action", id)
+	}
+	if script.PortRule == script.HostRule {
+		return nil, fmt.Errorf("script %s has to define either a portrule or a hostrule", id)
+	}
+
+	return script, nil
+}
+
+// load runs the compiled chunk in L, defining the globals of the script
+func (s *Script) load(L *lua.LState) error {
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return fmt.Errorf("error loading script %s: %w", s.ID, err)
+	}
+	return nil
+}
+
+// LoadFile compiles the script at path
+func LoadFile(path string) (*Script, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading script: %w", err)
+	}
+	return Compile(strings.TrimSuffix(filepath.Base(path), ".lua"), string(source))
+}
+
+// LoadDir compiles every .lua file in dir
+func LoadDir(dir string) ([]*Script, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.lua"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing scripts: %w", err)
+	}
+
+	var scripts []*Script
+	for _, path := range paths {
+		script, err := LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
+
+// Builtin returns the scripts shipped with gomap, sorted by ID
+func Builtin() ([]*Script, error) {
+	paths, err := fs.Glob(builtinScripts, "builtin/*.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	var scripts []*Script
+	for _, path := range paths {
+		source, err := builtinScripts.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		script, err := Compile(strings.TrimSuffix(filepath.Base(path), ".lua"), string(source))
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].ID < scripts[j].ID })
+	return scripts, nil
+}
+
+// Select returns the scripts named by spec, a comma separated list of categories, built-in script names,
+// script files and directories of scripts. "all" selects every built-in script.
+func Select(spec string) ([]*Script, error) {
+	builtin, err := Builtin()
+	if err != nil {
+		return nil, fmt.Errorf("error loading built-in scripts: %w", err)
+	}
+
+	var selected []*Script
+	add := func(scripts ...*Script) {
+		for _, script := range scripts {
+			if !slices.ContainsFunc(selected, func(s *Script) bool { return s.ID == script.ID }) {
+				selected = append(selected, script)
+			}
+		}
+	}
+
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, script := range builtin {
+			if name == "all" || name == script.ID || slices.Contains(script.Categories, name) {
+				add(script)
+				found = true
+			}
+		}
+		if found || name == "all" || slices.Contains(Categories, name) {
+			continue
+		}
+
+		// Anything else has to be a file or a directory
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown script, category or path '%s'", name)
+		}
+		if info.IsDir() {
+			scripts, err := LoadDir(name)
+			if err != nil {
+				return nil, err
+			}
+			add(scripts...)
+			continue
+		}
+		script, err := LoadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		add(script)
+	}
+
+	if len(selected) == 0 {
+		return nil, errors.New("no scripts selected")
+	}
+	return selected, nil
+}
+
+// ParseArgs parses the arguments given with --script-args, a comma separated list of name=value pairs
+func ParseArgs(spec string) (map[string]string, error) {
+	args := make(map[string]string)
+	for _, arg := range strings.Split(spec, ",") {
+		if strings.TrimSpace(arg) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(arg, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid script argument '%s', expected name=value", arg)
+		}
+		args[name] = strings.TrimSpace(value)
+	}
+	return args, nil
+}
@@ -0,0 +1,531 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DatabaseInfo is what a native client of a data store learned from it
+type DatabaseInfo struct {
+	Product string `json:"product"`
+	Version string `json:"version,omitempty"`
+	// Unauthenticated is true when gomap could run commands or read data without credentials
+	Unauthenticated bool `json:"unauthenticated"`
+	// Info is anything else the data store revealed, like its authentication method or cluster name
+	Info map[string]string `json:"info,omitempty"`
+}
+
+// databaseProbes are the native clients of each data store, by service name
+var databaseProbes = map[string]func(Target, *ServiceVersion, DetectOptions) (*DatabaseInfo, error){
+	"mysql":         probeMySQL,
+	"postgresql":    probePostgreSQL,
+	"redis":         probeRedis,
+	"mongodb":       probeMongoDB,
+	"memcached":     probeMemcached,
+	"elasticsearch": probeElasticsearch,
+}
+
+// databasePorts are the default ports of each data store, probed when nothing else was found on them
+var databasePorts = map[uint16]string{
+	3306:  "mysql",
+	5432:  "postgresql",
+	6379:  "redis",
+	27017: "mongodb",
+	11211: "memcached",
+	9200:  "elasticsearch",
+}
+
+// databaseService returns the data store to probe the port as, or an empty string if it isn't one
+func databaseService(port uint16, version *ServiceVersion) string {
+	if version == nil || version.Name == "" {
+		return databasePorts[port]
+	}
+
+	if _, ok := databaseProbes[version.Name]; ok {
+		return version.Name
+	}
+	// Elasticsearch is an HTTP API
+	if IsHTTP(version.Name) && (strings.HasPrefix(version.Product, "Elasticsearch") || databasePorts[port] == "elasticsearch") {
+		return "elasticsearch"
+	}
+	return ""
+}
+
+// dialService connects to the target with a deadline covering the whole conversation
+func dialService(target Target, opts DetectOptions) (net.Conn, error) {
+	address := net.JoinHostPort(target.IP.String(), strconv.Itoa(int(target.Port)))
+	conn, err := net.DialTimeout("tcp", address, opts.ConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", address, err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(opts.ConnectTimeout + opts.ReadTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// probeMySQL reads the server greeting. With [DetectOptions.TryLogins], it then tries to log in as root without a password.
+func probeMySQL(target Target, _ *ServiceVersion, opts DetectOptions) (*DatabaseInfo, error) {
+	conn, err := dialService(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	seq, greeting, err := readMySQLPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DatabaseInfo{Product: "MySQL", Info: make(map[string]string)}
+	if len(greeting) > 3 && greeting[0] == 0xff {
+		// The server refuses to talk to us at all, e.g. "Host '10.0.0.5' is not allowed to connect to this MySQL server"
+		info.Info["error"] = mysqlError(greeting)
+		if strings.Contains(info.Info["error"], "MariaDB") {
+			info.Product = "MariaDB"
+		}
+		return info, nil
+	}
+	if len(greeting) < 1 || greeting[0] != 0x0a {
+		return nil, fmt.Errorf("unexpected MySQL greeting")
+	}
+
+	// Protocol 10 greeting: version, thread id, auth data, capabilities, charset, status, auth data length,
+	// reserved bytes, the rest of the auth data and the auth plugin name
+	version, rest, ok := cutCString(greeting[1:])
+	if !ok {
+		return nil, fmt.Errorf("truncated MySQL greeting")
+	}
+	info.Version = version
+	if strings.Contains(version, "MariaDB") {
+		info.Product = "MariaDB"
+		info.Version = strings.TrimPrefix(version, "5.5.5-")
+	}
+
+	plugin := "mysql_native_password"
+	if len(rest) > 4+8+1+2+1+2+2+1+10 {
+		authLength := int(rest[4+8+1+2+1+2+2])
+		pluginOffset := 4 + 8 + 1 + 2 + 1 + 2 + 2 + 1 + 10 + max(13, authLength-8)
+		if pluginOffset < len(rest) {
+			plugin, _, _ = cutCString(rest[pluginOffset:])
+		}
+	}
+	info.Info["auth_plugin"] = plugin
+	if !opts.TryLogins {
+		return info, nil
+	}
+
+	// Log in as root with an empty password, which is an empty auth response for every plugin
+	const capabilities = 0x00000001 | 0x00000200 | 0x00008000 | 0x00080000 // long password, 4.1 protocol, secure connection, plugin auth
+	login := binary.LittleEndian.AppendUint32(nil, capabilities)
+	login = binary.LittleEndian.AppendUint32(login, 1<<24)
+	login = append(login, 33) // utf8_general_ci
+	login = append(login, make([]byte, 23)...)
+	login = append(login, "root\x00"...)
+	login = append(login, 0)
+	login = append(login, plugin+"\x00"...)
+	seq++
+	if err := writeMySQLPacket(conn, seq, login); err != nil {
+		return nil, err
+	}
+
+	for {
+		var reply []byte
+		seq, reply, err = readMySQLPacket(conn)
+		if err != nil || len(reply) == 0 {
+			return info, nil
+		}
+
+		switch {
+		case reply[0] == 0x00:
+			info.Unauthenticated = true
+			info.Info["login"] = "root with an empty password"
+			return info, nil
+		case reply[0] == 0xff:
+			info.Info["login"] = mysqlError(reply)
+			return info, nil
+		case reply[0] == 0xfe:
+			// Auth switch to another plugin, the empty password is still an empty response
+			seq++
+			if err := writeMySQLPacket(conn, seq, nil); err != nil {
+				return info, nil
+			}
+		case reply[0] == 0x01 && len(reply) > 1 && reply[1] == 0x03:
+			// caching_sha2_password fast auth succeeded, the OK packet follows
+		default:
+			// Full authentication needs TLS or the server's RSA key, so an empty password gets no further
+			return info, nil
+		}
+	}
+}
+
+// readMySQLPacket reads a MySQL packet and returns its sequence number and payload
+func readMySQLPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, fmt.Errorf("error reading MySQL packet: %w", err)
+	}
+
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("error reading MySQL packet: %w", err)
+	}
+
+	return header[3], payload, nil
+}
+
+// writeMySQLPacket writes a MySQL packet with the given sequence number
+func writeMySQLPacket(w io.Writer, seq byte, payload []byte) error {
+	packet := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	_, err := w.Write(append(packet, payload...))
+	return err
+}
+
+// mysqlError returns the message of a MySQL error packet
+func mysqlError(packet []byte) string {
+	// The 0xff marker is followed by a 2 byte error code
+	if len(packet) < 3 {
+		return "malformed error packet"
+	}
+	message := packet[3:]
+	// 4.1 errors have a # and a 5 character SQL state before the message
+	if len(message) >= 6 && message[0] == '#' {
+		message = message[6:]
+	}
+	return string(message)
+}
+
+// cutCString splits a NUL terminated string off the front of data
+func cutCString(data []byte) (string, []byte, bool) {
+	for i, b := range data {
+		if b == 0 {
+			return string(data[:i]), data[i+1:], true
+		}
+	}
+	return string(data), nil, false
+}
+
+// PostgreSQL authentication request codes
+var postgresAuthMethods = map[uint32]string{
+	2:  "Kerberos V5",
+	3:  "cleartext password",
+	5:  "MD5 password",
+	7:  "GSSAPI",
+	9:  "SSPI",
+	10: "SASL",
+}
+
+// probePostgreSQL asks whether the server supports SSL, then starts up with a protocol version no server speaks,
+// which the server rejects before authentication with the versions it does speak.
+// With [DetectOptions.TryLogins], it starts up as the postgres user without a password instead. Servers with trust
+// authentication let us in, the others say how they want us to authenticate or why they won't.
+func probePostgreSQL(target Target, _ *ServiceVersion, opts DetectOptions) (*DatabaseInfo, error) {
+	info := &DatabaseInfo{Product: "PostgreSQL", Info: make(map[string]string)}
+
+	conn, err := dialService(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	sslRequest := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), 80877103)
+	answer := make([]byte, 1)
+	_, err = conn.Write(sslRequest)
+	if err == nil {
+		_, err = io.ReadFull(conn, answer)
+	}
+	conn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error sending PostgreSQL SSLRequest: %w", err)
+	}
+	switch answer[0] {
+	case 'S':
+		info.Info["ssl"] = "supported"
+	case 'N':
+		info.Info["ssl"] = "not supported"
+	default:
+		return nil, fmt.Errorf("unexpected answer to PostgreSQL SSLRequest")
+	}
+
+	conn, err = dialService(target, opts)
+	if err != nil {
+		return info, nil
+	}
+	defer conn.Close()
+
+	parameters := "user\x00gomap\x00application_name\x00gomap\x00\x00"
+	protocol := uint32(0) // protocol 0.0
+	if opts.TryLogins {
+		parameters = "user\x00postgres\x00database\x00postgres\x00application_name\x00gomap\x00\x00"
+		protocol = 196608 // protocol 3.0
+	}
+	startup := binary.BigEndian.AppendUint32(nil, uint32(8+len(parameters)))
+	startup = binary.BigEndian.AppendUint32(startup, protocol)
+	startup = append(startup, parameters...)
+	if _, err := conn.Write(startup); err != nil {
+		return info, nil
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		kind, body, err := readPostgresMessage(reader)
+		if err != nil {
+			return info, nil
+		}
+
+		switch kind {
+		case 'R':
+			if len(body) < 4 {
+				return info, nil
+			}
+			code := binary.BigEndian.Uint32(body)
+			if code != 0 {
+				info.Info["auth"] = postgresAuthMethods[code]
+				return info, nil
+			}
+			info.Unauthenticated = true
+			info.Info["login"] = "postgres without a password"
+		case 'S':
+			// Parameter status, sent after a successful login
+			name, rest, _ := cutCString(body)
+			value, _, _ := cutCString(rest)
+			if name == "server_version" {
+				info.Version = value
+			}
+		case 'E':
+			info.Info["error"] = postgresError(body)
+			return info, nil
+		case 'Z':
+			// Ready for query, say goodbye
+			conn.Write([]byte{'X', 0, 0, 0, 4})
+			return info, nil
+		}
+	}
+}
+
+// readPostgresMessage reads a backend message and returns its type and body
+func readPostgresMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("invalid PostgreSQL message length %d", length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], body, nil
+}
+
+// postgresError returns the message of an ErrorResponse, like "no pg_hba.conf entry for host ..."
+func postgresError(body []byte) string {
+	for len(body) > 1 {
+		field := body[0]
+		value, rest, _ := cutCString(body[1:])
+		if field == 'M' {
+			return value
+		}
+		body = rest
+	}
+	return "unknown error"
+}
+
+// probeRedis sends PING to find out if commands work without AUTH, then reads the server section of INFO
+func probeRedis(target Target, _ *ServiceVersion, opts DetectOptions) (*DatabaseInfo, error) {
+	conn, err := dialService(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return nil, err
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading Redis reply: %w", err)
+	}
+	reply = strings.TrimSpace(reply)
+
+	info := &DatabaseInfo{Product: "Redis", Info: make(map[string]string)}
+	switch {
+	case reply == "+PONG":
+		info.Unauthenticated = true
+	case strings.HasPrefix(reply, "-NOAUTH"), strings.HasPrefix(reply, "-WRONGPASS"), strings.HasPrefix(reply, "-NOPERM"):
+		info.Info["auth"] = "required"
+		return info, nil
+	case strings.HasPrefix(reply, "-DENIED"):
+		info.Info["protected_mode"] = "yes"
+		return info, nil
+	default:
+		return nil, fmt.Errorf("unexpected Redis reply %q", reply)
+	}
+
+	if _, err := conn.Write([]byte("*2\r\n$4\r\nINFO\r\n$6\r\nserver\r\n")); err != nil {
+		return info, nil
+	}
+	header, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, "$") {
+		return info, nil
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if err != nil || length < 0 || length > 1<<20 {
+		return info, nil
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return info, nil
+	}
+
+	for _, line := range strings.Split(string(body), "\r\n") {
+		key, value, _ := strings.Cut(line, ":")
+		switch key {
+		case "redis_version":
+			info.Version = value
+		case "redis_mode", "os":
+			info.Info[key] = value
+		}
+	}
+
+	return info, nil
+}
+
+// probeMemcached asks for the version and stats over the text protocol, which never requires authentication
+func probeMemcached(target Target, _ *ServiceVersion, opts DetectOptions) (*DatabaseInfo, error) {
+	conn, err := dialService(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		return nil, err
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading Memcached reply: %w", err)
+	}
+	version, ok := strings.CutPrefix(strings.TrimSpace(reply), "VERSION ")
+	if !ok {
+		return nil, fmt.Errorf("unexpected Memcached reply %q", reply)
+	}
+
+	info := &DatabaseInfo{Product: "Memcached", Version: version, Unauthenticated: true, Info: make(map[string]string)}
+
+	if _, err := conn.Write([]byte("stats\r\n")); err != nil {
+		return info, nil
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if err != nil || line == "END" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "STAT" && (fields[1] == "curr_items" || fields[1] == "uptime") {
+			info.Info[fields[1]] = fields[2]
+		}
+	}
+
+	return info, nil
+}
+
+// probeElasticsearch reads the JSON of the root endpoint, which only answers without credentials when security is off
+func probeElasticsearch(target Target, version *ServiceVersion, opts DetectOptions) (*DatabaseInfo, error) {
+	scheme := "http"
+	if version != nil && version.TLS != nil {
+		scheme = "https"
+	}
+	root := &url.URL{Scheme: scheme, Host: net.JoinHostPort(target.IP.String(), strconv.Itoa(int(target.Port))), Path: "/"}
+
+	client := httpClient(opts, func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse })
+	resp, err := httpGet(client, root.String())
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %s: %w", root, err)
+	}
+	defer resp.Body.Close()
+
+	info := &DatabaseInfo{Product: "Elasticsearch", Info: make(map[string]string)}
+	if resp.StatusCode == http.StatusUnauthorized {
+		info.Info["security"] = "enabled"
+		return info, nil
+	}
+
+	var document struct {
+		Name        string `json:"name"`
+		ClusterName string `json:"cluster_name"`
+		Tagline     string `json:"tagline"`
+		Version     struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&document); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", root, err)
+	}
+	if document.Version.Number == "" {
+		return nil, errors.New("not an Elasticsearch root endpoint")
+	}
+
+	if document.Version.Distribution == "opensearch" {
+		info.Product = "OpenSearch"
+	}
+	info.Version = document.Version.Number
+	info.Unauthenticated = resp.StatusCode == http.StatusOK
+	info.Info["name"] = document.Name
+	info.Info["cluster_name"] = document.ClusterName
+
+	return info, nil
+}
+
+// Summary returns the short form shown in the VERSION column
+func (d *DatabaseInfo) Summary() string {
+	if d.Unauthenticated {
+		return "[no auth]"
+	}
+	return ""
+}
+
+// Details returns the lines shown under the port in the results table
+func (d *DatabaseInfo) Details() []string {
+	header := d.Product
+	if d.Version != "" {
+		header += " " + d.Version
+	}
+	lines := []string{header}
+
+	keys := make([]string, 0, len(d.Info))
+	for key := range d.Info {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+": "+d.Info[key])
+	}
+
+	if d.Unauthenticated {
+		lines = append(lines, "WARNING: unauthenticated access is possible")
+	}
+
+	return lines
+}
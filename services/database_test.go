@@ -0,0 +1,28 @@
+package services
+
+import "testing"
+
+func TestMySQLError(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string
+	}{
+		{"empty", nil, "malformed error packet"},
+		{"only the marker", []byte{0xff}, "malformed error packet"},
+		{"truncated error code", []byte{0xff, 0x15}, "malformed error packet"},
+		{"no message", []byte{0xff, 0x15, 0x04}, ""},
+		{"pre-4.1 message", []byte("\xff\x15\x04Access denied"), "Access denied"},
+		{"4.1 message", []byte("\xff\x15\x04#28000Access denied"), "Access denied"},
+		{"SQL state without a message", []byte("\xff\x15\x04#28000"), ""},
+		{"truncated SQL state", []byte("\xff\x15\x04#280"), "#280"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mysqlError(test.packet); got != test.want {
+				t.Errorf("mysqlError(%q) = %q, want %q", test.packet, got, test.want)
+			}
+		})
+	}
+}
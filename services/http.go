@@ -0,0 +1,240 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"io"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxRedirects is how many redirects are followed before the chain is cut off
+	maxRedirects = 5
+	// maxBodySize is how much of a page is read to find its title
+	maxBodySize = 256 * 1024
+	// maxTitleLength is the longest title kept
+	maxTitleLength = 80
+)
+
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// HTTPInfo is what an HTTP request to the service revealed
+type HTTPInfo struct {
+	StatusCode int    `json:"status_code"`
+	Server     string `json:"server,omitempty"`
+	PoweredBy  string `json:"x_powered_by,omitempty"`
+	Title      string `json:"title,omitempty"`
+	// Redirects are the locations that were redirected to, in order. Redirects to other hosts are recorded
+	// but not followed, so nothing outside the scan gets requested
+	Redirects []string `json:"redirects,omitempty"`
+	// FaviconHash is the MurmurHash3 of the base64 encoded /favicon.ico, the same hash Shodan uses
+	FaviconHash *int32 `json:"favicon_hash,omitempty"`
+}
+
+// IsHTTP returns true if the service name is HTTP, whether it's wrapped in TLS or not
+func IsHTTP(service string) bool {
+	switch strings.TrimPrefix(service, "ssl/") {
+	case "http", "https", "http-proxy", "http-alt":
+		return true
+	}
+	return false
+}
+
+// probeHTTP requests / from the target and follows its redirects, then hashes its favicon
+func probeHTTP(target Target, useTLS bool, opts DetectOptions) (*HTTPInfo, error) {
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	host := net.JoinHostPort(target.IP.String(), strconv.Itoa(int(target.Port)))
+	base := &url.URL{Scheme: scheme, Host: host, Path: "/"}
+
+	info := &HTTPInfo{}
+	client := httpClient(opts, func(req *http.Request, via []*http.Request) error {
+		info.Redirects = append(info.Redirects, req.URL.String())
+		if len(via) >= maxRedirects || req.URL.Host != via[0].URL.Host {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	})
+
+	resp, err := httpGet(client, base.String())
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %s: %w", base, err)
+	}
+	defer resp.Body.Close()
+
+	info.StatusCode = resp.StatusCode
+	info.Server = resp.Header.Get("Server")
+	info.PoweredBy = resp.Header.Get("X-Powered-By")
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err == nil {
+		info.Title = pageTitle(body)
+	}
+
+	// The favicon is looked up on the host we ended up on, which is always the target
+	favicon := resp.Request.URL.ResolveReference(&url.URL{Path: "/favicon.ico"})
+	if hash, ok := faviconHash(client, favicon.String()); ok {
+		info.FaviconHash = &hash
+	}
+
+	return info, nil
+}
+
+// httpClient returns a client for probing web services, with the version detection timeouts and
+// the given redirect policy
+func httpClient(opts DetectOptions, checkRedirect func(*http.Request, []*http.Request) error) *http.Client {
+	return &http.Client{
+		Timeout: opts.ConnectTimeout + opts.ReadTimeout,
+		Transport: &http.Transport{
+			// Never send scan traffic through a proxy from the environment
+			Proxy:             nil,
+			DialContext:       (&net.Dialer{Timeout: opts.ConnectTimeout}).DialContext,
+			TLSClientConfig:   TLSConfig(),
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// httpGet sends a GET request with a browser-like set of headers
+func httpGet(client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; gomap)")
+	req.Header.Set("Accept", "*/*")
+	return client.Do(req)
+}
+
+// pageTitle returns the contents of the <title> of an HTML page, with whitespace collapsed
+func pageTitle(body []byte) string {
+	match := titlePattern.FindSubmatch(body)
+	if match == nil {
+		return ""
+	}
+
+	title := strings.Join(strings.Fields(html.UnescapeString(string(match[1]))), " ")
+	if len(title) > maxTitleLength {
+		title = title[:maxTitleLength-3] + "..."
+	}
+	return title
+}
+
+// faviconHash downloads a favicon and returns its hash
+func faviconHash(client *http.Client, url string) (int32, bool) {
+	resp, err := httpGet(client, url)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, false
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil || len(data) == 0 {
+		return 0, false
+	}
+
+	return int32(murmur3(base64Lines(data))), true
+}
+
+// base64Lines encodes data as base64 with a newline after every 76 characters and at the end,
+// like Python's base64.encodebytes, which is what favicon hashes are computed over
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var out []byte
+	for len(encoded) > 76 {
+		out = append(out, encoded[:76]...)
+		out = append(out, '\n')
+		encoded = encoded[76:]
+	}
+	out = append(out, encoded...)
+	return append(out, '\n')
+}
+
+// murmur3 is the 32-bit MurmurHash3 of data with a seed of 0
+func murmur3(data []byte) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+
+	var h uint32
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
+
+// Summary returns the short form shown in the VERSION column, e.g. [200] Welcome to nginx!
+func (h *HTTPInfo) Summary() string {
+	summary := fmt.Sprintf("[%d]", h.StatusCode)
+	if h.Title != "" {
+		summary += " " + h.Title
+	}
+	return summary
+}
+
+// Details returns the lines shown under the port in the results table
+func (h *HTTPInfo) Details() []string {
+	lines := []string{fmt.Sprintf("HTTP: %d %s", h.StatusCode, http.StatusText(h.StatusCode))}
+	if len(h.Redirects) > 0 {
+		lines = append(lines, "Redirects: "+strings.Join(h.Redirects, " -> "))
+	}
+
+	if h.Server != "" {
+		lines = append(lines, "Server: "+h.Server)
+	}
+	if h.PoweredBy != "" {
+		lines = append(lines, "X-Powered-By: "+h.PoweredBy)
+	}
+	if h.Title != "" {
+		lines = append(lines, "Title: "+h.Title)
+	}
+	if h.FaviconHash != nil {
+		lines = append(lines, fmt.Sprintf("Favicon hash: %d", *h.FaviconHash))
+	}
+
+	return lines
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// latin1 maps every byte of data to the rune with the same value, so binary responses can be matched
+// byte for byte by Go's UTF-8 based regexp package
+func latin1(data []byte) string {
+	var b strings.Builder
+	b.Grow(len(data))
+	for _, c := range data {
+		b.WriteRune(rune(c))
+	}
+	return b.String()
+}
+
+// fromLatin1 reverses [latin1]
+func fromLatin1(s string) []byte {
+	out := make([]byte, 0, utf8.RuneCountInString(s))
+	for _, r := range s {
+		out = append(out, byte(r))
+	}
+	return out
+}
+
+// match tries the matches of the probe, then the matches of its fallback probes, on a response.
+// It returns the version info of the first match, or nil if nothing matched.
+func (p *Probe) match(response []byte) *ServiceVersion {
+	subject := latin1(response)
+
+	for _, probe := range append([]*Probe{p}, p.fallback...) {
+		for _, match := range probe.Matches {
+			if version := match.apply(subject); version != nil {
+				return version
+			}
+		}
+	}
+
+	return nil
+}
+
+// canMatch returns true if the probe, or one of its fallbacks, has a hard match for service.
+// Once a softmatch names the service, only those probes can tell us more.
+func (p *Probe) canMatch(service string) bool {
+	for _, probe := range append([]*Probe{p}, p.fallback...) {
+		for _, match := range probe.Matches {
+			if !match.Soft && match.Service == service {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply returns the version info of the match filled in from the subject, or nil if the pattern doesn't match
+func (m *Match) apply(subject string) *ServiceVersion {
+	groups := m.Pattern.FindStringSubmatch(subject)
+	if groups == nil {
+		return nil
+	}
+
+	version := &ServiceVersion{
+		Name:       m.Service,
+		Product:    expandTemplate(m.product, groups),
+		Version:    expandTemplate(m.version, groups),
+		Info:       expandTemplate(m.info, groups),
+		Hostname:   expandTemplate(m.hostname, groups),
+		OSType:     expandTemplate(m.osType, groups),
+		DeviceType: expandTemplate(m.deviceType, groups),
+		Soft:       m.Soft,
+	}
+	for _, cpe := range m.cpes {
+		version.CPEs = append(version.CPEs, expandTemplate(cpe, groups))
+	}
+
+	return version
+}
+
+// expandTemplate replaces the substitutions of a version info field with the groups of a match:
+//
+//   - $1 is the first group
+//   - $P(1) is the first group with unprintable characters removed
+//   - $SUBST(1,"_",".") is the first group with every _ replaced by a .
+//   - $I(1,">") is the first group unpacked as a big endian (">") or little endian ("<") unsigned integer
+func expandTemplate(template string, groups []string) string {
+	if !strings.Contains(template, "$") {
+		return template
+	}
+
+	group := func(s string) (string, bool) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n >= len(groups) {
+			return "", false
+		}
+		return string(fromLatin1(groups[n])), true
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '$' || i+1 == len(template) {
+			b.WriteByte(template[i])
+			continue
+		}
+
+		rest := template[i+1:]
+		switch {
+		case rest[0] >= '1' && rest[0] <= '9':
+			value, _ := group(rest[:1])
+			b.WriteString(value)
+			i++
+		case strings.HasPrefix(rest, "P(") || strings.HasPrefix(rest, "SUBST(") || strings.HasPrefix(rest, "I("):
+			name, argsAndRest, _ := strings.Cut(rest, "(")
+			args, _, ok := strings.Cut(argsAndRest, ")")
+			if !ok {
+				b.WriteByte('$')
+				continue
+			}
+			b.WriteString(templateFunction(name, splitTemplateArgs(args), group))
+			i += len(name) + len(args) + 2
+		default:
+			b.WriteByte('$')
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// templateFunction evaluates one of the $P, $SUBST or $I template functions
+func templateFunction(name string, args []string, group func(string) (string, bool)) string {
+	if len(args) == 0 {
+		return ""
+	}
+	value, ok := group(args[0])
+	if !ok {
+		return ""
+	}
+
+	switch name {
+	case "P":
+		return printable(value)
+	case "SUBST":
+		if len(args) != 3 {
+			return value
+		}
+		return strings.ReplaceAll(value, args[1], args[2])
+	case "I":
+		if len(value) > 8 {
+			return ""
+		}
+		var n uint64
+		for i := range value {
+			b := value[i]
+			if len(args) > 1 && args[1] == "<" {
+				b = value[len(value)-1-i]
+			}
+			n = n<<8 | uint64(b)
+		}
+		return strconv.FormatUint(n, 10)
+	}
+
+	return value
+}
+
+// splitTemplateArgs splits the arguments of a template function, removing the quotes around strings
+func splitTemplateArgs(args string) []string {
+	var out []string
+	for _, arg := range strings.Split(args, ",") {
+		arg = strings.TrimSpace(arg)
+		if len(arg) >= 2 && arg[0] == '"' && arg[len(arg)-1] == '"' {
+			arg = arg[1 : len(arg)-1]
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// printable removes every byte outside of printable ASCII from s
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 0x20 && r < 0x7f {
+			return r
+		}
+		return -1
+	}, s)
+}
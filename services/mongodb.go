@@ -0,0 +1,250 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	// mongoOpMsg is the opcode of OP_MSG, the wire protocol of MongoDB 3.6 and later
+	mongoOpMsg = 2013
+	// maxMongoMessage is the largest reply accepted
+	maxMongoMessage = 1 << 20
+)
+
+// bsonElement is a key and value of a BSON document. Only the value types gomap sends are supported
+type bsonElement struct {
+	key   string
+	value any
+}
+
+// probeMongoDB runs isMaster and buildInfo, which never need authentication, then listDatabases, which does
+// unless access control is off
+func probeMongoDB(target Target, _ *ServiceVersion, opts DetectOptions) (*DatabaseInfo, error) {
+	conn, err := dialService(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	hello, err := mongoCommand(conn, 1, []bsonElement{{"isMaster", int32(1)}, {"$db", "admin"}})
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DatabaseInfo{Product: "MongoDB", Info: make(map[string]string)}
+	if setName, ok := hello["setName"].(string); ok {
+		info.Info["replica_set"] = setName
+	}
+	if msg, ok := hello["msg"].(string); ok && msg == "isdbgrid" {
+		info.Info["role"] = "mongos"
+	}
+	if wire, ok := bsonNumber(hello["maxWireVersion"]); ok {
+		info.Info["max_wire_version"] = strconv.Itoa(int(wire))
+	}
+
+	if build, err := mongoCommand(conn, 2, []bsonElement{{"buildInfo", int32(1)}, {"$db", "admin"}}); err == nil {
+		if version, ok := build["version"].(string); ok {
+			info.Version = version
+		}
+	}
+
+	databases, err := mongoCommand(conn, 3, []bsonElement{{"listDatabases", int32(1)}, {"nameOnly", true}, {"$db", "admin"}})
+	if err != nil {
+		return info, nil
+	}
+	if ok, _ := bsonNumber(databases["ok"]); ok == 1 {
+		info.Unauthenticated = true
+		if list, ok := databases["databases"].([]any); ok {
+			info.Info["databases"] = strconv.Itoa(len(list))
+		}
+	} else if message, ok := databases["errmsg"].(string); ok {
+		info.Info["auth"] = message
+	}
+
+	return info, nil
+}
+
+// mongoCommand sends a command in an OP_MSG and returns the reply document
+func mongoCommand(conn io.ReadWriter, requestID int32, command []bsonElement) (map[string]any, error) {
+	body := binary.LittleEndian.AppendUint32(nil, 0) // flag bits
+	body = append(body, 0)                           // section kind 0, a single document
+	body = append(body, encodeBSON(command)...)
+
+	message := binary.LittleEndian.AppendUint32(nil, uint32(16+len(body)))
+	message = binary.LittleEndian.AppendUint32(message, uint32(requestID))
+	message = binary.LittleEndian.AppendUint32(message, 0) // response to
+	message = binary.LittleEndian.AppendUint32(message, mongoOpMsg)
+	message = append(message, body...)
+	if _, err := conn.Write(message); err != nil {
+		return nil, fmt.Errorf("error sending MongoDB command: %w", err)
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("error reading MongoDB reply: %w", err)
+	}
+	length := binary.LittleEndian.Uint32(header)
+	if length < 16+5 || length > maxMongoMessage {
+		return nil, fmt.Errorf("invalid MongoDB reply length %d", length)
+	}
+	reply := make([]byte, length-16)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("error reading MongoDB reply: %w", err)
+	}
+	if binary.LittleEndian.Uint32(header[12:]) != mongoOpMsg || reply[4] != 0 {
+		return nil, errors.New("unexpected MongoDB reply")
+	}
+
+	return decodeBSON(reply[5:])
+}
+
+// encodeBSON encodes a document of int32, string and bool values
+func encodeBSON(elements []bsonElement) []byte {
+	var body []byte
+	for _, element := range elements {
+		switch value := element.value.(type) {
+		case int32:
+			body = append(body, 0x10)
+			body = append(body, element.key+"\x00"...)
+			body = binary.LittleEndian.AppendUint32(body, uint32(value))
+		case string:
+			body = append(body, 0x02)
+			body = append(body, element.key+"\x00"...)
+			body = binary.LittleEndian.AppendUint32(body, uint32(len(value)+1))
+			body = append(body, value+"\x00"...)
+		case bool:
+			body = append(body, 0x08)
+			body = append(body, element.key+"\x00"...)
+			if value {
+				body = append(body, 1)
+			} else {
+				body = append(body, 0)
+			}
+		}
+	}
+
+	document := binary.LittleEndian.AppendUint32(nil, uint32(4+len(body)+1))
+	document = append(document, body...)
+	return append(document, 0)
+}
+
+// decodeBSON decodes the document at the start of data.
+// Arrays are returned as []any, and values of types gomap doesn't care about are skipped.
+func decodeBSON(data []byte) (map[string]any, error) {
+	errTruncated := errors.New("truncated BSON document")
+	if len(data) < 5 {
+		return nil, errTruncated
+	}
+	length := int(binary.LittleEndian.Uint32(data))
+	if length < 5 || length > len(data) {
+		return nil, errTruncated
+	}
+	data = data[4 : length-1]
+
+	document := make(map[string]any)
+	for len(data) > 0 {
+		kind := data[0]
+		key, value, ok := cutCString(data[1:])
+		if !ok {
+			return nil, errTruncated
+		}
+
+		// size is the length of the value, which is all fixed size types need
+		size := 0
+		switch kind {
+		case 0x01: // double
+			size = 8
+			if len(value) >= size {
+				document[key] = math.Float64frombits(binary.LittleEndian.Uint64(value))
+			}
+		case 0x02: // string
+			if len(value) < 4 {
+				return nil, errTruncated
+			}
+			size = 4 + int(binary.LittleEndian.Uint32(value))
+			if len(value) >= size && size > 4 {
+				document[key] = string(value[4 : size-1])
+			}
+		case 0x03, 0x04: // document, array
+			nested, err := decodeBSON(value)
+			if err != nil {
+				return nil, err
+			}
+			size = int(binary.LittleEndian.Uint32(value))
+			if kind == 0x03 {
+				document[key] = nested
+			} else {
+				// Array keys are "0", "1", ... in order
+				array := make([]any, len(nested))
+				for i := range array {
+					array[i] = nested[strconv.Itoa(i)]
+				}
+				document[key] = array
+			}
+		case 0x05: // binary
+			if len(value) < 4 {
+				return nil, errTruncated
+			}
+			size = 4 + 1 + int(binary.LittleEndian.Uint32(value))
+		case 0x06, 0x0a, 0x7f, 0xff: // undefined, null, max key, min key
+		case 0x07: // object id
+			size = 12
+		case 0x08: // bool
+			size = 1
+			if len(value) >= size {
+				document[key] = value[0] != 0
+			}
+		case 0x09, 0x11: // datetime, timestamp
+			size = 8
+		case 0x0b: // regex, two C strings
+			_, afterPattern, ok := cutCString(value)
+			if !ok {
+				return nil, errTruncated
+			}
+			_, afterOptions, ok := cutCString(afterPattern)
+			if !ok {
+				return nil, errTruncated
+			}
+			size = len(value) - len(afterOptions)
+		case 0x10: // int32
+			size = 4
+			if len(value) >= size {
+				document[key] = int32(binary.LittleEndian.Uint32(value))
+			}
+		case 0x12: // int64
+			size = 8
+			if len(value) >= size {
+				document[key] = int64(binary.LittleEndian.Uint64(value))
+			}
+		case 0x13: // decimal128
+			size = 16
+		default:
+			return nil, fmt.Errorf("unsupported BSON type 0x%02x", kind)
+		}
+
+		if size > len(value) {
+			return nil, errTruncated
+		}
+		data = value[size:]
+	}
+
+	return document, nil
+}
+
+// bsonNumber returns a numeric BSON value as a float64
+func bsonNumber(value any) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"unicode"
+)
+
+// nmapPayloadsData is the built-in UDP payload library in the nmap-payloads format
+//
+//go:embed nmap-payloads
+var nmapPayloadsData string
+
+// snmpPort is the port SNMP GetRequests are sent to
+const snmpPort = 161
+
+// sysDescrOID is the BER encoding of 1.3.6.1.2.1.1.1.0, the description of an SNMP agent's system
+var sysDescrOID = []byte{0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x01, 0x00}
+
+// UDPPayload is a datagram that makes a UDP service answer
+type UDPPayload struct {
+	Ports portList
+	// SourcePort is the port the payload has to be sent from, zero means any
+	SourcePort uint16
+	Data       []byte
+}
+
+// PayloadDB is a parsed nmap-payloads file
+type PayloadDB struct {
+	Payloads []*UDPPayload
+}
+
+var (
+	defaultPayloads    *PayloadDB
+	defaultPayloadsErr error
+	defaultPayloadsOne sync.Once
+)
+
+// DefaultPayloads returns the built-in UDP payloads, parsed the first time they're needed
+func DefaultPayloads() (*PayloadDB, error) {
+	defaultPayloadsOne.Do(func() {
+		defaultPayloads, defaultPayloadsErr = ParsePayloads(nmapPayloadsData)
+	})
+	return defaultPayloads, defaultPayloadsErr
+}
+
+// ParsePayloads parses payloads in the nmap-payloads format
+func ParsePayloads(data string) (*PayloadDB, error) {
+	tokens, err := tokenizePayloads(data)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &PayloadDB{}
+	for i := 0; i < len(tokens); {
+		if tokens[i].quoted || tokens[i].text != "udp" {
+			return nil, fmt.Errorf("expected 'udp', got '%s'", tokens[i].text)
+		}
+		if i+1 == len(tokens) || tokens[i+1].quoted {
+			return nil, errors.New("missing ports after 'udp'")
+		}
+		ports, err := parsePortList(tokens[i+1].text)
+		if err != nil {
+			return nil, err
+		}
+		i += 2
+
+		payload := &UDPPayload{Ports: ports}
+		for ; i < len(tokens) && tokens[i].quoted; i++ {
+			payload.Data = append(payload.Data, unescapeProbe(tokens[i].text)...)
+		}
+		if payload.Data == nil {
+			return nil, fmt.Errorf("missing payload for udp %s", tokens[i-1].text)
+		}
+
+		if i < len(tokens) && !tokens[i].quoted && tokens[i].text == "source" {
+			if i+1 == len(tokens) {
+				return nil, errors.New("missing port after 'source'")
+			}
+			port, err := strconv.ParseUint(tokens[i+1].text, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source port '%s': %w", tokens[i+1].text, err)
+			}
+			payload.SourcePort = uint16(port)
+			i += 2
+		}
+
+		db.Payloads = append(db.Payloads, payload)
+	}
+
+	return db, nil
+}
+
+// payloadToken is a word or a quoted string of an nmap-payloads file. Quoted strings are kept escaped.
+type payloadToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenizePayloads splits an nmap-payloads file into words and quoted strings, dropping comments
+func tokenizePayloads(data string) ([]payloadToken, error) {
+	var tokens []payloadToken
+	for i := 0; i < len(data); {
+		switch c := data[i]; {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			end := i + 1
+			for end < len(data) && data[end] != '"' {
+				if data[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(data) {
+				return nil, errors.New("unterminated payload string")
+			}
+			tokens = append(tokens, payloadToken{text: data[i+1 : end], quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(data) && !unicode.IsSpace(rune(data[end])) {
+				end++
+			}
+			tokens = append(tokens, payloadToken{text: data[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// For returns the payloads sent to port, in order. SNMP gets a v2c and a v1 GetRequest per community.
+// Ports without a payload get a single empty datagram.
+func (db *PayloadDB) For(port uint16, communities []string) []UDPPayload {
+	var payloads []UDPPayload
+	if port == snmpPort {
+		for _, community := range communities {
+			for _, version := range []int{1, 0} {
+				payloads = append(payloads, UDPPayload{Data: snmpGetRequest(version, community)})
+			}
+		}
+	}
+
+	for _, payload := range db.Payloads {
+		if payload.Ports.contains(port) {
+			payloads = append(payloads, *payload)
+		}
+	}
+
+	if len(payloads) == 0 {
+		payloads = append(payloads, UDPPayload{})
+	}
+	return payloads
+}
+
+// snmpGetRequest builds a GetRequest for sysDescr.0. Version 0 is SNMPv1 and 1 is SNMPv2c.
+func snmpGetRequest(version int, community string) []byte {
+	varbind := ber(0x30, ber(0x06, sysDescrOID), ber(0x05))
+	pdu := ber(0xa0,
+		ber(0x02, []byte{0x47, 0x6f}), // request ID
+		ber(0x02, []byte{0}),          // error status
+		ber(0x02, []byte{0}),          // error index
+		ber(0x30, varbind),
+	)
+	return ber(0x30, ber(0x02, []byte{byte(version)}), ber(0x04, []byte(community)), pdu)
+}
+
+// ber encodes a BER TLV with the given tag and contents
+func ber(tag byte, contents ...[]byte) []byte {
+	var body []byte
+	for _, content := range contents {
+		body = append(body, content...)
+	}
+
+	out := []byte{tag}
+	switch {
+	case len(body) < 0x80:
+		out = append(out, byte(len(body)))
+	case len(body) <= 0xff:
+		out = append(out, 0x81, byte(len(body)))
+	default:
+		out = append(out, 0x82, byte(len(body)>>8), byte(len(body)))
+	}
+	return append(out, body...)
+}
+
+// berField is a BER TLV
+type berField struct {
+	tag      byte
+	contents []byte
+}
+
+// readBER decodes the BER TLVs that make up data, e.g. the contents of a SEQUENCE
+func readBER(data []byte) ([]berField, error) {
+	var fields []berField
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("truncated BER field")
+		}
+		tag, length := data[0], int(data[1])
+		data = data[2:]
+
+		if length&0x80 != 0 {
+			n := length & 0x7f
+			if n == 0 || n > 2 || len(data) < n {
+				return nil, errors.New("invalid BER length")
+			}
+			length = 0
+			for _, b := range data[:n] {
+				length = length<<8 | int(b)
+			}
+			data = data[n:]
+		}
+		if length > len(data) {
+			return nil, errors.New("truncated BER field")
+		}
+
+		fields = append(fields, berField{tag: tag, contents: data[:length]})
+		data = data[length:]
+	}
+	return fields, nil
+}
+
+// berInt decodes a BER INTEGER
+func berInt(contents []byte) int {
+	n := 0
+	for _, b := range contents {
+		n = n<<8 | int(b)
+	}
+	return n
+}
@@ -0,0 +1,461 @@
+package services
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0niSec/gomap/logger"
+)
+
+// nmapServiceProbesData is a small built-in subset of probes in the nmap-service-probes format.
+// The full database shipped with nmap can be loaded instead with --service-probes.
+//
+//go:embed nmap-service-probes
+var nmapServiceProbesData string
+
+// defaultRarity is the rarity of probes that don't have a rarity directive
+const defaultRarity = 5
+
+// Probe is a single probe of an nmap-service-probes file and the matches that apply to its responses
+type Probe struct {
+	Protocol string
+	Name     string
+	Payload  []byte
+	// Ports are the ports the probe is tried on first, regardless of its rarity
+	Ports portList
+	// SSLPorts are the ports the probe is tried on first when the service is wrapped in SSL/TLS
+	SSLPorts portList
+	// Rarity is how rarely the probe gets a response, from 1 to 9
+	Rarity int
+	// TotalWait is how long to wait for a response, zero means the read timeout
+	TotalWait time.Duration
+	Matches   []*Match
+
+	// fallback are the probes whose matches are also tried on this probe's responses
+	fallbackNames []string
+	fallback      []*Probe
+}
+
+// Match is a match or softmatch line of an nmap-service-probes file
+type Match struct {
+	Service string
+	// Soft matches only name the service, and probing goes on to find its version
+	Soft    bool
+	Pattern *regexp.Regexp
+
+	product    string
+	version    string
+	info       string
+	hostname   string
+	osType     string
+	deviceType string
+	cpes       []string
+}
+
+// ProbeDB is a parsed nmap-service-probes file
+type ProbeDB struct {
+	Probes []*Probe
+	// Exclude are ports that are never probed, e.g. printers that print whatever they receive
+	Exclude portList
+}
+
+// portList is a list of port ranges like "21,25,80-90"
+type portList [][2]uint16
+
+// contains returns true if port is in one of the ranges
+func (l portList) contains(port uint16) bool {
+	for _, r := range l {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	defaultProbes    *ProbeDB
+	defaultProbesErr error
+	defaultProbesOne sync.Once
+)
+
+// DefaultProbes returns the built-in probes, parsed the first time they're needed
+func DefaultProbes() (*ProbeDB, error) {
+	defaultProbesOne.Do(func() {
+		defaultProbes, defaultProbesErr = ParseProbes(nmapServiceProbesData)
+	})
+	return defaultProbes, defaultProbesErr
+}
+
+// LoadProbes parses the nmap-service-probes file at path
+func LoadProbes(path string) (*ProbeDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading service probes: %w", err)
+	}
+	return ParseProbes(string(data))
+}
+
+// ParseProbes parses probes in the nmap-service-probes format.
+// Matches whose regex can't be expressed in Go's regexp syntax (backreferences, lookarounds, ...) are skipped.
+func ParseProbes(data string) (*ProbeDB, error) {
+	db := &ProbeDB{}
+	var probe *Probe
+	skipped := 0
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		directive, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+
+		if directive == "Probe" {
+			p, err := parseProbe(rest)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing line %d: %w", lineNumber, err)
+			}
+			probe = p
+			db.Probes = append(db.Probes, probe)
+			continue
+		}
+		if directive == "Exclude" {
+			ports, err := parsePortList(strings.TrimPrefix(rest, "T:"))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing line %d: %w", lineNumber, err)
+			}
+			db.Exclude = ports
+			continue
+		}
+		if probe == nil {
+			return nil, fmt.Errorf("error parsing line %d: %s directive before the first Probe", lineNumber, directive)
+		}
+
+		var err error
+		switch directive {
+		case "match", "softmatch":
+			var match *Match
+			match, err = parseMatch(rest, directive == "softmatch")
+			var unsupported unsupportedPatternError
+			if errors.As(err, &unsupported) {
+				logger.Debug("Skipping service match", "line", lineNumber, "err", err)
+				skipped++
+				err = nil
+			} else if err == nil {
+				probe.Matches = append(probe.Matches, match)
+			}
+		case "ports":
+			probe.Ports, err = parsePortList(rest)
+		case "sslports":
+			probe.SSLPorts, err = parsePortList(rest)
+		case "rarity":
+			probe.Rarity, err = strconv.Atoi(rest)
+		case "totalwaitms":
+			var ms int
+			ms, err = strconv.Atoi(rest)
+			probe.TotalWait = time.Duration(ms) * time.Millisecond
+		case "fallback":
+			probe.fallbackNames = strings.Split(rest, ",")
+		default:
+			// tcpwrappedms and anything newer than this parser doesn't change how probes are matched
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing line %d: %w", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading service probes: %w", err)
+	}
+
+	db.resolveFallbacks()
+
+	logger.Debug("Loaded service probes", "probes", len(db.Probes), "skipped_matches", skipped)
+
+	return db, nil
+}
+
+// resolveFallbacks links every probe to the probes named in its fallback directive.
+// The NULL probe of the same protocol is always the last fallback, like in nmap.
+func (db *ProbeDB) resolveFallbacks() {
+	byName := make(map[string]*Probe)
+	for _, probe := range db.Probes {
+		byName[probe.Protocol+"/"+probe.Name] = probe
+	}
+
+	for _, probe := range db.Probes {
+		for _, name := range probe.fallbackNames {
+			if fallback, ok := byName[probe.Protocol+"/"+strings.TrimSpace(name)]; ok && fallback != probe {
+				probe.fallback = append(probe.fallback, fallback)
+			}
+		}
+		if null, ok := byName[probe.Protocol+"/NULL"]; ok && null != probe && !slices.Contains(probe.fallback, null) {
+			probe.fallback = append(probe.fallback, null)
+		}
+	}
+}
+
+// parseProbe parses the arguments of a Probe directive, e.g. TCP GetRequest q|GET / HTTP/1.0\r\n\r\n|
+func parseProbe(args string) (*Probe, error) {
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("malformed Probe directive '%s'", args)
+	}
+	if fields[0] != "TCP" && fields[0] != "UDP" {
+		return nil, fmt.Errorf("unknown probe protocol '%s'", fields[0])
+	}
+
+	payload := fields[2]
+	if len(payload) < 3 || payload[0] != 'q' {
+		return nil, fmt.Errorf("malformed probe string '%s'", payload)
+	}
+	delimiter := payload[1]
+	end := strings.IndexByte(payload[2:], delimiter)
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated probe string '%s'", payload)
+	}
+
+	return &Probe{
+		Protocol: fields[0],
+		Name:     fields[1],
+		Payload:  unescapeProbe(payload[2 : 2+end]),
+		Rarity:   defaultRarity,
+	}, nil
+}
+
+// unescapeProbe decodes the C-style escapes of a probe string
+func unescapeProbe(s string) []byte {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case '0':
+			out = append(out, 0)
+		case 'a':
+			out = append(out, '\a')
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'v':
+			out = append(out, '\v')
+		case 'x':
+			if i+2 < len(s) {
+				if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					out = append(out, byte(b))
+					i += 2
+					continue
+				}
+			}
+			out = append(out, 'x')
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return out
+}
+
+// parsePortList parses a port list like "21,25,80-90"
+func parsePortList(s string) (portList, error) {
+	var ports portList
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(part, "-")
+		if !isRange {
+			high = low
+		}
+		start, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port '%s': %w", part, err)
+		}
+		end, err := strconv.ParseUint(high, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port '%s': %w", part, err)
+		}
+		ports = append(ports, [2]uint16{uint16(start), uint16(end)})
+	}
+	return ports, nil
+}
+
+// unsupportedPatternError is returned for match patterns Go's regexp package can't compile
+type unsupportedPatternError struct {
+	err error
+}
+
+func (e unsupportedPatternError) Error() string {
+	return fmt.Sprintf("unsupported match pattern: %s", e.err)
+}
+
+// parseMatch parses the arguments of a match or softmatch directive, e.g.
+//
+//	ssh m|^SSH-([\d.]+)-OpenSSH_([\w._-]+)\r?\n|i p/OpenSSH/ v/$2/ i/protocol $1/ cpe:/a:openbsd:openssh:$2/
+func parseMatch(args string, soft bool) (*Match, error) {
+	service, rest, ok := strings.Cut(args, " ")
+	if !ok || len(rest) < 3 || rest[0] != 'm' {
+		return nil, fmt.Errorf("malformed match directive '%s'", args)
+	}
+
+	delimiter := rest[1]
+	end := strings.IndexByte(rest[2:], delimiter)
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated match pattern '%s'", rest)
+	}
+	pattern := rest[2 : 2+end]
+	rest = rest[3+end:]
+
+	// Pattern options come right after the closing delimiter
+	flags := ""
+	for len(rest) > 0 && rest[0] != ' ' {
+		switch rest[0] {
+		case 'i':
+			flags += "i"
+		case 's':
+			flags += "s"
+		}
+		rest = rest[1:]
+	}
+
+	re, err := compilePattern(pattern, flags)
+	if err != nil {
+		return nil, unsupportedPatternError{err}
+	}
+
+	match := &Match{Service: service, Soft: soft, Pattern: re}
+	if err := match.parseTemplates(rest); err != nil {
+		return nil, err
+	}
+
+	return match, nil
+}
+
+// parseTemplates parses the version info fields that follow a match pattern, like p/vsftpd/ v/$1/
+func (m *Match) parseTemplates(s string) error {
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return nil
+		}
+
+		var key string
+		if strings.HasPrefix(s, "cpe:") {
+			key, s = "cpe", s[len("cpe:"):]
+		} else {
+			key, s = s[:1], s[1:]
+		}
+		if s == "" {
+			return fmt.Errorf("malformed version info field '%s'", key)
+		}
+
+		delimiter := s[0]
+		end := strings.IndexByte(s[1:], delimiter)
+		if end < 0 {
+			return fmt.Errorf("unterminated version info field '%s'", key)
+		}
+		value := s[1 : 1+end]
+		s = s[2+end:]
+
+		// Skip field flags, like the 'a' after a cpe
+		for s != "" && s[0] != ' ' {
+			s = s[1:]
+		}
+
+		switch key {
+		case "p":
+			m.product = value
+		case "v":
+			m.version = value
+		case "i":
+			m.info = value
+		case "h":
+			m.hostname = value
+		case "o":
+			m.osType = value
+		case "d":
+			m.deviceType = value
+		case "cpe":
+			m.cpes = append(m.cpes, "cpe:/"+value)
+		}
+	}
+}
+
+// compilePattern compiles a PCRE-style match pattern with Go's regexp package.
+//
+// Responses are matched as latin-1 (every byte is one rune) so byte escapes like \xff match single bytes,
+// which means the pattern has to be decoded the same way. PCRE's $ and \Z also match before a trailing
+// newline, which Go's $ doesn't, so both are rewritten outside of character classes.
+func compilePattern(pattern, flags string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	if flags != "" {
+		b.WriteString("(?" + flags + ")")
+	}
+
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == 'Z' && !inClass {
+				b.WriteString(`(?:\n?\z)`)
+			} else {
+				b.WriteByte('\\')
+				b.WriteRune(rune(pattern[i]))
+			}
+			continue
+		case c == '[' && !inClass:
+			inClass = true
+			b.WriteByte(c)
+			// A ] right after the opening bracket, or after its ^, is part of the class
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+				b.WriteByte('^')
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+				b.WriteString(`\]`)
+			}
+			continue
+		case c == '[' && inClass && strings.HasPrefix(pattern[i:], "[:"):
+			// A POSIX class like [:alpha:] ends with its own bracket, not the one of the class it's in
+			if end := strings.Index(pattern[i:], ":]"); end > 0 {
+				b.WriteString(pattern[i : i+end+2])
+				i += end + 1
+				continue
+			}
+		case c == ']' && inClass:
+			inClass = false
+		case c == '$' && !inClass:
+			b.WriteString(`(?:\n?\z)`)
+			continue
+		}
+		b.WriteRune(rune(c))
+	}
+
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		flags   string
+		subject []byte
+		want    bool
+	}{
+		{"$ at the end", `^220 ready$`, "", []byte("220 ready"), true},
+		{"$ before a trailing newline", `^220 ready$`, "", []byte("220 ready\n"), true},
+		{"$ before more lines", `^220 ready$`, "", []byte("220 ready\nmore"), false},
+		{`\Z at the end`, `^OK\r\n\Z`, "", []byte("OK\r\n"), true},
+		{`\Z before a trailing newline`, `^OK\Z`, "", []byte("OK\n"), true},
+		{`\Z before more data`, `^OK\r\n\Z`, "", []byte("OK\r\nmore"), false},
+		{"escaped $ stays literal", `^cost: \$5`, "", []byte("cost: $5"), true},
+		{"$ in a class stays literal", `^a[$]b`, "", []byte("a$b"), true},
+		{"] first in a class", `^a[]$]$`, "", []byte("a]"), true},
+		{"] first in a negated class", `^a[^]$]b`, "", []byte("a$b"), false},
+		{"POSIX class in a class", `^[[:digit:]]+$`, "", []byte("123\n"), true},
+		{"latin1 byte escapes", `^\xff\xfb\x01$`, "", []byte{0xff, 0xfb, 0x01}, true},
+		{"latin1 byte escapes don't match UTF-8", `^\xe9$`, "", []byte("é"), false},
+		{"raw latin1 bytes in the pattern", "^caf\xe9$", "", []byte("caf\xe9"), true},
+		{"NUL escapes", `^.\0\0\0\x0a`, "s", []byte{0x4a, 0, 0, 0, 0x0a}, true},
+		{"case insensitive", `^server: apache`, "i", []byte("Server: Apache"), true},
+		{"dot matches newlines with s", `^HTTP/1\.1 .*Server: x`, "s", []byte("HTTP/1.1 200 OK\r\nServer: x"), true},
+		{"dot doesn't match newlines without s", `^HTTP/1\.1 .*Server: x`, "", []byte("HTTP/1.1 200 OK\r\nServer: x"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			re, err := compilePattern(test.pattern, test.flags)
+			if err != nil {
+				t.Fatalf("compilePattern(%q, %q) error = %v", test.pattern, test.flags, err)
+			}
+			if got := re.MatchString(latin1(test.subject)); got != test.want {
+				t.Errorf("compilePattern(%q, %q) = %s, matches %q: %v, want %v", test.pattern, test.flags, re, test.subject, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompilePatternUnsupported(t *testing.T) {
+	for _, pattern := range []string{`^(\w+) \1`, `^HTTP(?=/1)`, `^(?<!x)y`} {
+		if _, err := compilePattern(pattern, ""); err == nil {
+			t.Errorf("compilePattern(%q) error = nil, want an error", pattern)
+		}
+	}
+}
+
+func TestParseMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		response []byte
+		want     *ServiceVersion
+	}{
+		{
+			name:     "$P removes unprintable characters",
+			line:     `http m|^HTTP/1\.[01] \d\d\d .*\r\nServer: ([^\r\n]+)\r\n|s p/$P(1)/`,
+			response: []byte("HTTP/1.1 200 OK\r\nDate: Mon, 19 Oct 2026 10:00:00 GMT\r\nServer: nginx\x01/1.18.0\r\n\r\n"),
+			want:     &ServiceVersion{Name: "http", Product: "nginx/1.18.0"},
+		},
+		{
+			name:     "$ on a binary MySQL error",
+			line:     `mysql m|^.\0\0\0\xffj\x04Host '([^']+)' is not allowed to connect to this MySQL server$|s p/MySQL/ i/unauthorized/ h/$1/ cpe:/a:mysql:mysql/`,
+			response: []byte("\x45\x00\x00\x00\xffj\x04Host '10.0.0.5' is not allowed to connect to this MySQL server"),
+			want:     &ServiceVersion{Name: "mysql", Product: "MySQL", Info: "unauthorized", Hostname: "10.0.0.5", CPEs: []string{"cpe:/a:mysql:mysql"}},
+		},
+		{
+			name:     "$ doesn't match before more data",
+			line:     `mysql m|^.\0\0\0\xffj\x04Host '([^']+)' is not allowed to connect to this MySQL server$|s p/MySQL/`,
+			response: []byte("\x45\x00\x00\x00\xffj\x04Host '10.0.0.5' is not allowed to connect to this MySQL server, really"),
+		},
+		{
+			name:     "groups next to each other",
+			line:     `mysql m|^.\0\0\0\x0a(5\.5\.5-)?(1\d\.[\d.]+)-MariaDB([-_~.+:\w]*)\0|s p/MariaDB/ v/$2$3/ cpe:/a:mariadb:mariadb:$2/`,
+			response: []byte("\x5b\x00\x00\x00\x0a5.5.5-10.6.12-MariaDB-0ubuntu0.22.04.1\x00\x2c\x00\x00\x00"),
+			want:     &ServiceVersion{Name: "mysql", Product: "MariaDB", Version: "10.6.12-0ubuntu0.22.04.1", CPEs: []string{"cpe:/a:mariadb:mariadb:10.6.12"}},
+		},
+		{
+			name:     "telnet negotiation bytes",
+			line:     `telnet m|^\xff\xfd\x18\xff\xfd \xff\xfd#\xff\xfd'$| p/Linux telnetd/ o/Linux/ cpe:/o:linux:linux_kernel/a`,
+			response: []byte("\xff\xfd\x18\xff\xfd \xff\xfd#\xff\xfd'"),
+			want:     &ServiceVersion{Name: "telnet", Product: "Linux telnetd", OSType: "Linux", CPEs: []string{"cpe:/o:linux:linux_kernel"}},
+		},
+		{
+			name:     `\Z after the banner`,
+			line:     `smtp m|^220 ([\w.-]+) ESMTP Postfix\r\n\Z| p/Postfix smtpd/ h/$1/ cpe:/a:postfix:postfix/a`,
+			response: []byte("220 mail.example.com ESMTP Postfix\r\n"),
+			want:     &ServiceVersion{Name: "smtp", Product: "Postfix smtpd", Hostname: "mail.example.com", CPEs: []string{"cpe:/a:postfix:postfix"}},
+		},
+		{
+			name:     `\Z doesn't match before more data`,
+			line:     `smtp m|^220 ([\w.-]+) ESMTP Postfix\r\n\Z| p/Postfix smtpd/`,
+			response: []byte("220 mail.example.com ESMTP Postfix\r\n250 ok\r\n"),
+		},
+		{
+			name:     "$SUBST in the version and the CPE",
+			line:     `ssh m|^SSH-([\d.]+)-dropbear_([\w.]+)\r?\n| p/Dropbear sshd/ v/$SUBST(2,"_",".")/ i/protocol $1/ cpe:/a:matt_johnston:dropbear_ssh_server:$SUBST(2,"_",".")/`,
+			response: []byte("SSH-2.0-dropbear_2020_81\r\n"),
+			want: &ServiceVersion{Name: "ssh", Product: "Dropbear sshd", Version: "2020.81", Info: "protocol 2.0",
+				CPEs: []string{"cpe:/a:matt_johnston:dropbear_ssh_server:2020.81"}},
+		},
+		{
+			name:     "$I big endian",
+			line:     `rpcbind m|^\x80\0\0(..)| i/length $I(1,">")/`,
+			response: []byte("\x80\x00\x00\x01\x02"),
+			want:     &ServiceVersion{Name: "rpcbind", Info: "length 258"},
+		},
+		{
+			name:     "$I little endian",
+			line:     `rpcbind m|^\x80\0\0(..)| i/length $I(1,"<")/`,
+			response: []byte("\x80\x00\x00\x01\x02"),
+			want:     &ServiceVersion{Name: "rpcbind", Info: "length 513"},
+		},
+		{
+			name:     "missing groups expand to nothing",
+			line:     `ftp m|^220 ProFTPD (\d\S+)? Server| p/ProFTPD/ v/$1/ i/$2/`,
+			response: []byte("220 ProFTPD  Server (Debian)"),
+			want:     &ServiceVersion{Name: "ftp", Product: "ProFTPD"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match, err := parseMatch(test.line, false)
+			if err != nil {
+				t.Fatalf("parseMatch(%q) error = %v", test.line, err)
+			}
+
+			got := match.apply(latin1(test.response))
+			if test.want == nil {
+				if got != nil {
+					t.Fatalf("apply(%q) = %+v, want no match", test.response, got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("apply(%q) = nil, want %+v", test.response, test.want)
+			}
+			if got.Name != test.want.Name || got.Product != test.want.Product || got.Version != test.want.Version ||
+				got.Info != test.want.Info || got.Hostname != test.want.Hostname || got.OSType != test.want.OSType ||
+				!slices.Equal(got.CPEs, test.want.CPEs) {
+				t.Errorf("apply(%q) = %+v, want %+v", test.response, got, test.want)
+			}
+		})
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	groups := []string{"whole", "2_4_1", latin1([]byte("a\x00b\xffc")), "\x01\x00"}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"no substitutions", "no substitutions"},
+		{"v$1", "v2_4_1"},
+		{`$SUBST(1,"_",".")`, "2.4.1"},
+		{`$SUBST(1,"_")`, "2_4_1"},
+		{"$P(2)", "abc"},
+		{`$I(3,">")`, "256"},
+		{`$I(3,"<")`, "1"},
+		{"$9", ""},
+		{"$P(9)", ""},
+		{"costs $", "costs $"},
+		{"$P(1", "$P(1"},
+		{"  $1  ", "2_4_1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			if got := expandTemplate(test.template, groups); got != test.want {
+				t.Errorf("expandTemplate(%q) = %q, want %q", test.template, got, test.want)
+			}
+		})
+	}
+}
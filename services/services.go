@@ -3,51 +3,16 @@ package services
 import (
 	"bufio"
 	_ "embed"
-	"fmt"
-	"io"
-	"net"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 )
 
-func GrabBanner(target net.IP, resultsMap map[uint16]string) (map[uint16]string, error) {
-	banners := make(map[uint16]string)
-
-	for port, status := range resultsMap {
-		if status == "open" {
-			address := fmt.Sprintf("%s:%d", target.To4().String(), port)
-			conn, err := net.DialTimeout("tcp", address, 5*time.Second)
-			if err != nil {
-				continue // Skip to the next port
-			}
-			defer conn.Close()
-
-			err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-			if err != nil {
-				continue // Skip to the next port
-			}
-
-			buffer := make([]byte, 1024)
-			n, err := conn.Read(buffer)
-			if err != nil && err != io.EOF {
-				continue // Skip to the next port
-			}
-
-			if n > 0 {
-				banners[port] = string(buffer[:n])
-			}
-		}
-	}
-
-	return banners, nil
-}
-
 //go:embed nmap-services
 var nmapServicesData string
 
-// GetServices returns a map of open ports to their corresponding service names
-func GetServices(openPorts []uint16) (map[uint16]string, error) {
+// GetServices returns a map of open ports to their corresponding service names for the protocol ("tcp" or "udp")
+func GetServices(openPorts []uint16, protocol string) (map[uint16]string, error) {
 	services := make(map[uint16]string)
 
 	scanner := bufio.NewScanner(strings.NewReader(nmapServicesData))
@@ -62,7 +27,7 @@ func GetServices(openPorts []uint16) (map[uint16]string, error) {
 			continue
 		}
 		portProto := strings.Split(fields[1], "/")
-		if len(portProto) != 2 || portProto[1] != "tcp" {
+		if len(portProto) != 2 || portProto[1] != protocol {
 			continue
 		}
 		port, err := strconv.ParseUint(portProto[0], 10, 16)
@@ -77,6 +42,49 @@ func GetServices(openPorts []uint16) (map[uint16]string, error) {
 	return services, scanner.Err()
 }
 
+// TopPorts returns the n ports of the protocol that are most often found open according to nmap-services,
+// sorted by port number
+func TopPorts(protocol string, n int) ([]uint16, error) {
+	type entry struct {
+		port      uint16
+		frequency float64
+	}
+	var entries []entry
+
+	scanner := bufio.NewScanner(strings.NewReader(nmapServicesData))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		portProto := strings.Split(fields[1], "/")
+		if len(portProto) != 2 || portProto[1] != protocol {
+			continue
+		}
+		port, err := strconv.ParseUint(portProto[0], 10, 16)
+		if err != nil {
+			continue
+		}
+		frequency, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{uint16(port), frequency})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].frequency > entries[j].frequency })
+	ports := make([]uint16, 0, n)
+	for _, e := range entries[:min(n, len(entries))] {
+		ports = append(ports, e.port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+	return ports, nil
+}
+
 // contains returns true if the given port is in the list of ports
 func contains(ports []uint16, port uint16) bool {
 	for _, p := range ports {
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/0niSec/gomap/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshClientVersion is the identification string gomap sends to SSH servers
+	sshClientVersion = "SSH-2.0-gomap"
+	// sshMsgKexinit is the message number of SSH_MSG_KEXINIT
+	sshMsgKexinit = 20
+	// maxSSHPacket is the largest KEXINIT packet accepted, real ones are a couple of kilobytes
+	maxSSHPacket = 64 * 1024
+)
+
+// errHostKeyCaptured stops the SSH handshake once the host key is known, before authentication starts
+var errHostKeyCaptured = errors.New("host key captured")
+
+// weakSSHAlgorithms are algorithms that are broken or deprecated
+var weakSSHAlgorithms = []string{
+	"diffie-hellman-group1-sha1", "diffie-hellman-group14-sha1", "diffie-hellman-group-exchange-sha1",
+	"ssh-dss", "ssh-rsa",
+	"arcfour", "arcfour128", "arcfour256", "3des-cbc", "blowfish-cbc", "cast128-cbc", "des-cbc",
+	"aes128-cbc", "aes192-cbc", "aes256-cbc", "rijndael-cbc@lysator.liu.se",
+	"hmac-md5", "hmac-md5-96", "hmac-md5-etm@openssh.com", "hmac-md5-96-etm@openssh.com", "hmac-sha1-96",
+}
+
+// sshKexAlgorithms are every key exchange gomap can complete, so even old servers give up their host keys
+var sshKexAlgorithms = []string{
+	"curve25519-sha256", "curve25519-sha256@libssh.org",
+	"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+	"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group-exchange-sha256",
+	"diffie-hellman-group14-sha1", "diffie-hellman-group-exchange-sha1", "diffie-hellman-group1-sha1",
+}
+
+// sshCiphers are every cipher gomap can use, for the same reason
+var sshCiphers = []string{
+	"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+	"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+}
+
+// SSHInfo is what the start of an SSH key exchange revealed
+type SSHInfo struct {
+	Protocol string `json:"protocol"`
+	Software string `json:"software"`
+	Comments string `json:"comments,omitempty"`
+	// The algorithm lists are the server's KEXINIT, the client to server lists for the ones that are split by direction
+	KexAlgorithms         []string     `json:"kex_algorithms"`
+	HostKeyAlgorithms     []string     `json:"host_key_algorithms"`
+	Ciphers               []string     `json:"ciphers"`
+	MACs                  []string     `json:"macs"`
+	CompressionAlgorithms []string     `json:"compression_algorithms"`
+	HostKeys              []SSHHostKey `json:"host_keys,omitempty"`
+	// Weak are the broken or deprecated algorithms the server offers
+	Weak []string `json:"weak_algorithms,omitempty"`
+}
+
+// SSHHostKey is one of the host keys of a server
+type SSHHostKey struct {
+	Type        string `json:"type"`
+	Bits        int    `json:"bits,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// isSSH returns true if the port should get the SSH deep probe: it was identified as SSH, or it's port 22
+// and nothing else was found there
+func isSSH(port uint16, version *ServiceVersion) bool {
+	if version != nil && version.Name != "" {
+		return version.Name == "ssh"
+	}
+	return port == 22
+}
+
+// probeSSH reads the KEXINIT of the server, then completes one key exchange per host key type to fingerprint its keys
+func probeSSH(target Target, opts DetectOptions) (*SSHInfo, error) {
+	address := net.JoinHostPort(target.IP.String(), strconv.Itoa(int(target.Port)))
+
+	info, err := readKexinit(target, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, algorithm := range hostKeyProbes(info.HostKeyAlgorithms) {
+		key, err := fetchHostKey(target, algorithm, opts)
+		if err != nil {
+			logger.Debug("Failed to fetch SSH host key", "address", address, "algorithm", algorithm, "err", err)
+			continue
+		}
+		info.HostKeys = append(info.HostKeys, newSSHHostKey(key))
+	}
+
+	for _, list := range [][]string{info.KexAlgorithms, info.HostKeyAlgorithms, info.Ciphers, info.MACs} {
+		for _, algorithm := range list {
+			if slices.Contains(weakSSHAlgorithms, algorithm) && !slices.Contains(info.Weak, algorithm) {
+				info.Weak = append(info.Weak, algorithm)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// readKexinit exchanges identification strings with the server and parses the KEXINIT it sends next
+func readKexinit(target Target, opts DetectOptions) (*SSHInfo, error) {
+	conn, err := dialService(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(sshClientVersion + "\r\n")); err != nil {
+		return nil, fmt.Errorf("error sending SSH identification: %w", err)
+	}
+
+	// Servers may send other lines before their identification string
+	reader := bufio.NewReader(conn)
+	var identification string
+	for identification == "" {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("error reading SSH identification: %w", err)
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			identification = strings.TrimRight(line, "\r\n")
+		}
+	}
+
+	info := &SSHInfo{}
+	// SSH-protoversion-softwareversion SP comments
+	versions, comments, _ := strings.Cut(strings.TrimPrefix(identification, "SSH-"), " ")
+	info.Protocol, info.Software, _ = strings.Cut(versions, "-")
+	info.Comments = comments
+
+	payload, err := readSSHPacket(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 17 {
+		return nil, fmt.Errorf("truncated KEXINIT from %s", conn.RemoteAddr())
+	}
+	if payload[0] != sshMsgKexinit {
+		return nil, fmt.Errorf("expected KEXINIT from %s, got message %d", conn.RemoteAddr(), payload[0])
+	}
+
+	// After the message number and the 16 byte cookie come 10 name-lists:
+	// kex, host key, ciphers c2s/s2c, MACs c2s/s2c, compression c2s/s2c, languages c2s/s2c
+	rest := payload[17:]
+	lists := make([][]string, 10)
+	for i := range lists {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("truncated KEXINIT from %s", conn.RemoteAddr())
+		}
+		n := binary.BigEndian.Uint32(rest)
+		if uint32(len(rest)-4) < n {
+			return nil, fmt.Errorf("truncated KEXINIT from %s", conn.RemoteAddr())
+		}
+		if n > 0 {
+			lists[i] = strings.Split(string(rest[4:4+n]), ",")
+		}
+		rest = rest[4+n:]
+	}
+
+	info.KexAlgorithms = lists[0]
+	info.HostKeyAlgorithms = lists[1]
+	info.Ciphers = lists[2]
+	info.MACs = lists[4]
+	info.CompressionAlgorithms = lists[6]
+
+	return info, nil
+}
+
+// readSSHPacket reads an unencrypted SSH binary packet and returns its payload
+func readSSHPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading SSH packet: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	padding := uint32(header[4])
+	if length > maxSSHPacket || length < padding+1 {
+		return nil, fmt.Errorf("invalid SSH packet length %d", length)
+	}
+
+	packet := make([]byte, length-1)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, fmt.Errorf("error reading SSH packet: %w", err)
+	}
+
+	return packet[:length-1-padding], nil
+}
+
+// hostKeyProbes picks one host key algorithm per key type, since the RSA signature algorithms all use the same key.
+// Certificates are skipped, the keys they certify are fingerprinted on their own.
+func hostKeyProbes(algorithms []string) []string {
+	var probes []string
+	seen := make(map[string]bool)
+	for _, algorithm := range algorithms {
+		if strings.Contains(algorithm, "-cert-") {
+			continue
+		}
+
+		keyType := algorithm
+		if algorithm == ssh.KeyAlgoRSASHA256 || algorithm == ssh.KeyAlgoRSASHA512 {
+			keyType = ssh.KeyAlgoRSA
+		}
+		if seen[keyType] {
+			continue
+		}
+		seen[keyType] = true
+		probes = append(probes, algorithm)
+	}
+	return probes
+}
+
+// fetchHostKey runs an SSH handshake that only accepts the given host key algorithm and returns the server's key
+func fetchHostKey(target Target, algorithm string, opts DetectOptions) (ssh.PublicKey, error) {
+	conn, err := dialService(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var hostKey ssh.PublicKey
+	config := &ssh.ClientConfig{
+		Config: ssh.Config{
+			KeyExchanges: sshKexAlgorithms,
+			Ciphers:      sshCiphers,
+		},
+		User:              "gomap",
+		ClientVersion:     sshClientVersion,
+		HostKeyAlgorithms: []string{algorithm},
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyCaptured
+		},
+	}
+
+	_, _, _, err = ssh.NewClientConn(conn, conn.RemoteAddr().String(), config)
+	if hostKey == nil {
+		return nil, fmt.Errorf("error completing SSH key exchange: %w", err)
+	}
+
+	return hostKey, nil
+}
+
+// newSSHHostKey describes a host key
+func newSSHHostKey(key ssh.PublicKey) SSHHostKey {
+	hostKey := SSHHostKey{
+		Type:        key.Type(),
+		Fingerprint: ssh.FingerprintSHA256(key),
+	}
+
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok {
+			hostKey.Bits = rsaKey.N.BitLen()
+		}
+	}
+
+	return hostKey
+}
+
+// Details returns the lines shown under the port in the results table
+func (s *SSHInfo) Details() []string {
+	lines := []string{fmt.Sprintf("SSH: protocol %s, %s", s.Protocol, s.Software)}
+
+	for _, key := range s.HostKeys {
+		if key.Bits > 0 {
+			lines = append(lines, fmt.Sprintf("Host key: %s %d %s", key.Type, key.Bits, key.Fingerprint))
+		} else {
+			lines = append(lines, fmt.Sprintf("Host key: %s %s", key.Type, key.Fingerprint))
+		}
+	}
+
+	lines = append(lines,
+		"kex_algorithms: "+strings.Join(s.KexAlgorithms, ","),
+		"server_host_key_algorithms: "+strings.Join(s.HostKeyAlgorithms, ","),
+		"encryption_algorithms: "+strings.Join(s.Ciphers, ","),
+		"mac_algorithms: "+strings.Join(s.MACs, ","),
+		"compression_algorithms: "+strings.Join(s.CompressionAlgorithms, ","),
+	)
+
+	if len(s.Weak) > 0 {
+		lines = append(lines, "WARNING: weak algorithms offered: "+strings.Join(s.Weak, ", "))
+	}
+
+	return lines
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sshPacket wraps payload in an unencrypted SSH binary packet with the given amount of padding
+func sshPacket(payload []byte, padding int) []byte {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)+padding))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	return append(packet, make([]byte, padding)...)
+}
+
+// kexinitPayload builds a KEXINIT payload with the given name-lists, followed by the first_kex_packet_follows flag
+// and the reserved field
+func kexinitPayload(lists ...string) []byte {
+	payload := append([]byte{sshMsgKexinit}, make([]byte, 16)...)
+	for _, list := range lists {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(list)))
+		payload = append(payload, list...)
+	}
+	return append(payload, make([]byte, 5)...)
+}
+
+// serveSSH accepts a single connection, reads the client identification and answers with reply
+func serveSSH(t *testing.T, reply []byte) Target {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write(reply)
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	return Target{IP: address.IP, Port: uint16(address.Port)}
+}
+
+func TestReadSSHPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"payload and padding", sshPacket([]byte("hello"), 4), []byte("hello"), false},
+		{"no padding", sshPacket([]byte("hello"), 0), []byte("hello"), false},
+		{"empty", nil, nil, true},
+		{"truncated header", []byte{0, 0, 0}, nil, true},
+		{"truncated payload", sshPacket([]byte("hello"), 4)[:8], nil, true},
+		{"length over the limit", []byte{0, 2, 0, 0, 4}, nil, true},
+		{"padding longer than the packet", []byte{0, 0, 0, 4, 4, 0, 0, 0}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readSSHPacket(bytes.NewReader(test.data))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readSSHPacket(%x) error = %v, want error %v", test.data, err, test.wantErr)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("readSSHPacket(%x) = %q, want %q", test.data, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadKexinit(t *testing.T) {
+	lists := []string{
+		"curve25519-sha256,diffie-hellman-group14-sha1", "ssh-ed25519,rsa-sha2-512",
+		"aes128-ctr", "aes256-ctr", "hmac-sha2-256", "hmac-sha1", "none,zlib@openssh.com", "none", "", "",
+	}
+	identification := "SSH-2.0-OpenSSH_9.6 Ubuntu-3\r\n"
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantErr bool
+	}{
+		{"KEXINIT", append([]byte(identification), sshPacket(kexinitPayload(lists...), 4)...), false},
+		{"lines before the identification", append([]byte("Welcome\r\n"+identification), sshPacket(kexinitPayload(lists...), 4)...), false},
+		{"no identification", []byte("Welcome\r\n"), true},
+		{"no KEXINIT", []byte(identification), true},
+		{"another message", append([]byte(identification), sshPacket(append([]byte{1}, make([]byte, 20)...), 4)...), true},
+		{"truncated cookie", append([]byte(identification), sshPacket([]byte{sshMsgKexinit, 0, 0, 0}, 4)...), true},
+		{"missing name-lists", append([]byte(identification), sshPacket(kexinitPayload(lists[:3]...), 4)...), true},
+		{"name-list longer than the packet", append([]byte(identification), sshPacket(append(append([]byte{sshMsgKexinit}, make([]byte, 16)...), 0, 0, 1, 0, 'a'), 4)...), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := serveSSH(t, test.reply)
+			info, err := readKexinit(target, DetectOptions{ConnectTimeout: time.Second, ReadTimeout: time.Second})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readKexinit() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if info.Protocol != "2.0" || info.Software != "OpenSSH_9.6" || info.Comments != "Ubuntu-3" {
+				t.Errorf("readKexinit() identification = %q %q %q, want 2.0 OpenSSH_9.6 Ubuntu-3", info.Protocol, info.Software, info.Comments)
+			}
+			if want := strings.Split(lists[0], ","); !slices.Equal(info.KexAlgorithms, want) {
+				t.Errorf("readKexinit() kex algorithms = %q, want %q", info.KexAlgorithms, want)
+			}
+			if want := strings.Split(lists[1], ","); !slices.Equal(info.HostKeyAlgorithms, want) {
+				t.Errorf("readKexinit() host key algorithms = %q, want %q", info.HostKeyAlgorithms, want)
+			}
+			if want := []string{"aes128-ctr"}; !slices.Equal(info.Ciphers, want) {
+				t.Errorf("readKexinit() ciphers = %q, want %q", info.Ciphers, want)
+			}
+			if want := []string{"hmac-sha2-256"}; !slices.Equal(info.MACs, want) {
+				t.Errorf("readKexinit() MACs = %q, want %q", info.MACs, want)
+			}
+			if want := []string{"none", "zlib@openssh.com"}; !slices.Equal(info.CompressionAlgorithms, want) {
+				t.Errorf("readKexinit() compression algorithms = %q, want %q", info.CompressionAlgorithms, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// certExpiryWarning is how close to its expiry a certificate gets flagged
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// TLSInfo is what the TLS handshake with a service revealed
+type TLSInfo struct {
+	Version     string    `json:"version"`
+	CipherSuite string    `json:"cipher_suite"`
+	ALPN        string    `json:"alpn,omitempty"`
+	Certificate *CertInfo `json:"certificate,omitempty"`
+}
+
+// CertInfo describes the leaf certificate a service presented
+type CertInfo struct {
+	Subject     string    `json:"subject"`
+	SANs        []string  `json:"sans,omitempty"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	KeyType     string    `json:"key_type"`
+	KeyBits     int       `json:"key_bits"`
+	SHA256      string    `json:"sha256"`
+	SelfSigned  bool      `json:"self_signed"`
+	Expired     bool      `json:"expired"`
+	ExpiresSoon bool      `json:"expires_soon"`
+}
+
+// TLSConfig returns the client config used to talk to services over TLS, offering the given ALPN protocols.
+// Certificates aren't verified since we want to see them, not trust them, and old versions and
+// ciphers are allowed so legacy services still complete the handshake.
+func TLSConfig(protocols ...string) *tls.Config {
+	var suites []uint16
+	for _, suite := range tls.CipherSuites() {
+		suites = append(suites, suite.ID)
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites = append(suites, suite.ID)
+	}
+
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+		CipherSuites:       suites,
+		NextProtos:         protocols,
+	}
+}
+
+// dialTLS connects to address and completes a TLS handshake, which has to finish within timeout
+func dialTLS(address string, timeout time.Duration, protocols ...string) (*tls.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, TLSConfig(protocols...))
+}
+
+// detectTLS tries a TLS handshake with address and returns what it revealed, or nil if the service doesn't speak TLS
+func detectTLS(address string, timeout time.Duration) *TLSInfo {
+	// Offering ALPN here shows what the service prefers. Probes are sent without it, since a service that
+	// picked h2 wouldn't understand them
+	conn, err := dialTLS(address, timeout, "h2", "http/1.1")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.Certificate = newCertInfo(state.PeerCertificates[0], time.Now())
+	}
+
+	return info
+}
+
+// newCertInfo extracts the details of a certificate, judging its expiry at now
+func newCertInfo(cert *x509.Certificate, now time.Time) *CertInfo {
+	info := &CertInfo{
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Expired:     now.After(cert.NotAfter),
+		ExpiresSoon: !now.After(cert.NotAfter) && cert.NotAfter.Sub(now) < certExpiryWarning,
+		SelfSigned:  bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil,
+	}
+
+	for _, name := range cert.DNSNames {
+		info.SANs = append(info.SANs, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		info.SANs = append(info.SANs, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		info.SANs = append(info.SANs, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		info.SANs = append(info.SANs, "URI:"+uri.String())
+	}
+
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.KeyType, info.KeyBits = "rsa", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		info.KeyType, info.KeyBits = "ec", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		info.KeyType, info.KeyBits = "ed25519", 256
+	default:
+		info.KeyType = strings.ToLower(cert.PublicKeyAlgorithm.String())
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02x", b)
+	}
+	info.SHA256 = strings.Join(hexBytes, ":")
+
+	return info
+}
+
+// Details returns the lines shown under the port in the results table
+func (t *TLSInfo) Details() []string {
+	handshake := fmt.Sprintf("TLS: %s, %s", t.Version, t.CipherSuite)
+	if t.ALPN != "" {
+		handshake += ", ALPN " + t.ALPN
+	}
+	lines := []string{handshake}
+
+	cert := t.Certificate
+	if cert == nil {
+		return lines
+	}
+
+	lines = append(lines, "Subject: "+cert.Subject)
+	if len(cert.SANs) > 0 {
+		lines = append(lines, "Subject Alternative Name: "+strings.Join(cert.SANs, ", "))
+	}
+	lines = append(lines,
+		"Issuer: "+cert.Issuer,
+		fmt.Sprintf("Public Key: %s %d", cert.KeyType, cert.KeyBits),
+		"Not valid before: "+cert.NotBefore.UTC().Format(time.RFC3339),
+		"Not valid after:  "+cert.NotAfter.UTC().Format(time.RFC3339),
+		"SHA-256: "+cert.SHA256,
+	)
+
+	if cert.SelfSigned {
+		lines = append(lines, "WARNING: certificate is self-signed")
+	}
+	if cert.Expired {
+		lines = append(lines, fmt.Sprintf("WARNING: certificate expired %d days ago", int(time.Since(cert.NotAfter).Hours()/24)))
+	} else if cert.ExpiresSoon {
+		lines = append(lines, fmt.Sprintf("WARNING: certificate expires in %d days", int(time.Until(cert.NotAfter).Hours()/24)))
+	}
+
+	return lines
+}
+
+// tlsServiceName is the name of a service found inside a TLS tunnel, like nmap's ssl/ prefix
+func tlsServiceName(name string) string {
+	switch name {
+	case "":
+		return "ssl"
+	case "http":
+		return "https"
+	default:
+		return "ssl/" + name
+	}
+}
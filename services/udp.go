@@ -0,0 +1,777 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0niSec/gomap/logger"
+)
+
+// maxDNSPointers is how many compression pointers are followed in one name, so a loop can't hang the parser
+const maxDNSPointers = 16
+
+// UDPInfo is what the reply to a UDP payload revealed beyond the service and its version
+type UDPInfo struct {
+	Info map[string]string `json:"info,omitempty"`
+	// Warnings are findings worth acting on, like an SNMP community that grants access
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// udpParsers turn the reply to the payloads of a port into the service and its version.
+// They return nil for replies they don't understand.
+var udpParsers = map[uint16]func([]byte) *ServiceVersion{
+	53:    parseDNSVersion,
+	69:    parseTFTP,
+	111:   rpcParser("rpcbind", 100000),
+	123:   parseNTP,
+	137:   parseNBSTAT,
+	161:   parseSNMP,
+	500:   parseIKE,
+	623:   parseIPMI,
+	1434:  parseMSSQLBrowser,
+	1900:  parseSSDP,
+	2049:  rpcParser("nfs", 100003),
+	3478:  parseSTUN,
+	5060:  parseSIP,
+	5353:  parseMDNS,
+	11211: parseMemcachedUDP,
+}
+
+// detectUDPVersion identifies the service on a UDP port from its reply to the payloads of the port.
+// When no parser understands the reply, the UDP probes of the service probes get a try.
+func detectUDPVersion(target Target, opts DetectOptions) *ServiceVersion {
+	var reply []byte
+	if opts.Payloads != nil {
+		reply = exchangeUDP(target, opts.Payloads.For(target.Port, opts.SNMPCommunities), opts.ReadTimeout)
+		if parse, ok := udpParsers[target.Port]; ok && reply != nil {
+			if version := parse(reply); version != nil {
+				if len(version.UDP.Info) == 0 && len(version.UDP.Warnings) == 0 {
+					version.UDP = nil
+				}
+				return withBanner(version, reply)
+			}
+		}
+	}
+
+	if opts.Probes != nil {
+		address := net.JoinHostPort(target.IP.String(), strconv.Itoa(int(target.Port)))
+		dial := func() (net.Conn, error) {
+			return net.DialTimeout("udp", address, opts.ConnectTimeout)
+		}
+		version, response, _ := runProbes(target, opts.Probes.probesFor("UDP", target.Port, opts.Intensity, false), dial, nil, opts)
+		if reply == nil {
+			reply = response
+		}
+		if version != nil {
+			return withBanner(version, reply)
+		}
+	}
+
+	return withBanner(nil, reply)
+}
+
+// exchangeUDP sends every payload to the target from its own socket and returns the first reply, or nil if
+// nothing answered within timeout. The sockets aren't connected, since services like TFTP answer from another port.
+func exchangeUDP(target Target, payloads []UDPPayload, timeout time.Duration) []byte {
+	replies := make(chan []byte, len(payloads))
+	var wg sync.WaitGroup
+	for _, payload := range payloads {
+		wg.Add(1)
+		go func(payload UDPPayload) {
+			defer wg.Done()
+			reply, err := sendUDPPayload(target, payload, timeout)
+			if err != nil {
+				logger.Debug("No reply to UDP payload", "target", target.IP, "port", target.Port, "err", err)
+				return
+			}
+			replies <- reply
+		}(payload)
+	}
+	go func() {
+		wg.Wait()
+		close(replies)
+	}()
+
+	// Closing the channel without a reply gives nil
+	return <-replies
+}
+
+// sendUDPPayload sends a payload to the target and waits for a datagram from it
+func sendUDPPayload(target Target, payload UDPPayload, timeout time.Duration) ([]byte, error) {
+	conn, err := listenUDP(payload.SourcePort)
+	if err != nil {
+		return nil, fmt.Errorf("error opening UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(payload.Data, &net.UDPAddr{IP: target.IP, Port: int(target.Port)}); err != nil {
+		return nil, fmt.Errorf("error sending UDP payload: %w", err)
+	}
+
+	buffer := make([]byte, 64*1024)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return nil, err
+		}
+		if from.IP.Equal(target.IP) {
+			return append([]byte(nil), buffer[:n]...), nil
+		}
+	}
+}
+
+// listenUDP opens a UDP socket on port, or on any port if port is zero or can't be bound.
+// Any port is better than no probe when another process holds the port or we can't bind privileged ports.
+func listenUDP(port uint16) (*net.UDPConn, error) {
+	if port != 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+		if err == nil {
+			return conn, nil
+		}
+		logger.Debug("Failed to bind UDP source port", "port", port, "err", err)
+	}
+	return net.ListenUDP("udp", nil)
+}
+
+// newUDPVersion returns an empty version of the named service, ready for a parser to fill in
+func newUDPVersion(name string) *ServiceVersion {
+	return &ServiceVersion{Name: name, UDP: &UDPInfo{Info: make(map[string]string)}}
+}
+
+// dnsRecord is a resource record of a DNS message. Offset is where its data starts in the message,
+// which is needed to decompress the names in it.
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	Data   []byte
+	Offset int
+}
+
+// parseDNSMessage returns the response code and every resource record of a DNS response
+func parseDNSMessage(msg []byte) (int, []dnsRecord, error) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return 0, nil, errors.New("not a DNS response")
+	}
+	rcode := int(msg[3] & 0x0f)
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		offset = next + 4
+	}
+
+	var answers []dnsRecord
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		if next+10 > len(msg) {
+			return 0, nil, errors.New("truncated DNS record")
+		}
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+length > len(msg) {
+			return 0, nil, errors.New("truncated DNS record")
+		}
+		answers = append(answers, dnsRecord{
+			Name:   name,
+			Type:   binary.BigEndian.Uint16(msg[next:]),
+			Data:   msg[start : start+length],
+			Offset: start,
+		})
+		offset = start + length
+	}
+
+	return rcode, answers, nil
+}
+
+// readDNSName reads the possibly compressed name at offset and returns it with the offset right after it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for pointers := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("truncated DNS name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) || pointers == maxDNSPointers {
+				return "", 0, errors.New("invalid DNS name pointer")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			pointers++
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errors.New("truncated DNS name")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// dnsVersionPatterns turn the version.bind of well-known DNS servers into their product and version
+var dnsVersionPatterns = []struct {
+	pattern *regexp.Regexp
+	product string
+}{
+	{regexp.MustCompile(`^dnsmasq-(\S+)`), "dnsmasq"},
+	{regexp.MustCompile(`^unbound (\S+)`), "Unbound"},
+	{regexp.MustCompile(`^PowerDNS Authoritative Server (\S+)`), "PowerDNS Authoritative Server"},
+	{regexp.MustCompile(`^PowerDNS Recursor (\S+)`), "PowerDNS Recursor"},
+	{regexp.MustCompile(`^Knot DNS (\S+)`), "Knot DNS"},
+	{regexp.MustCompile(`^NSD (\S+)`), "NLnet Labs NSD"},
+	{regexp.MustCompile(`^Microsoft DNS (\S+)`), "Microsoft DNS"},
+	{regexp.MustCompile(`^(9\.\S+)`), "ISC BIND"},
+}
+
+// dnsRcodes names the response codes servers answer version.bind with when they don't disclose it
+var dnsRcodes = map[int]string{2: "SERVFAIL", 4: "NOTIMP", 5: "REFUSED"}
+
+// parseDNSVersion reads the answer to a version.bind query
+func parseDNSVersion(reply []byte) *ServiceVersion {
+	rcode, records, err := parseDNSMessage(reply)
+	if err != nil {
+		return nil
+	}
+
+	version := newUDPVersion("domain")
+	if name, ok := dnsRcodes[rcode]; ok {
+		version.UDP.Info["version.bind"] = "not disclosed (" + name + ")"
+		return version
+	}
+
+	for _, record := range records {
+		if record.Type != 16 { // TXT
+			continue
+		}
+		text := printable(string(txtStrings(record.Data)))
+		version.UDP.Info["version.bind"] = text
+		for _, known := range dnsVersionPatterns {
+			if match := known.pattern.FindStringSubmatch(text); match != nil {
+				version.Product, version.Version = known.product, match[1]
+				break
+			}
+		}
+		break
+	}
+
+	return version
+}
+
+// txtStrings joins the length prefixed strings of a TXT record
+func txtStrings(data []byte) []byte {
+	var text []byte
+	for len(data) > 0 {
+		length := int(data[0])
+		if 1+length > len(data) {
+			break
+		}
+		text = append(text, data[1:1+length]...)
+		data = data[1+length:]
+	}
+	return text
+}
+
+// parseMDNS lists the service types a DNS-SD responder advertises
+func parseMDNS(reply []byte) *ServiceVersion {
+	_, records, err := parseDNSMessage(reply)
+	if err != nil {
+		return nil
+	}
+
+	version := newUDPVersion("zeroconf")
+	version.Product = "DNS-based service discovery"
+	var services []string
+	for _, record := range records {
+		if record.Type != 12 { // PTR
+			continue
+		}
+		if name, _, err := readDNSName(reply, record.Offset); err == nil {
+			services = append(services, strings.TrimSuffix(name, ".local"))
+		}
+	}
+	if len(services) > 0 {
+		sort.Strings(services)
+		version.UDP.Info["services"] = strings.Join(services, ", ")
+	}
+
+	return version
+}
+
+// parseNBSTAT reads the name table of a NetBIOS node
+func parseNBSTAT(reply []byte) *ServiceVersion {
+	_, records, err := parseDNSMessage(reply)
+	if err != nil || len(records) == 0 || records[0].Type != 0x21 {
+		return nil
+	}
+	data := records[0].Data
+	if len(data) < 1 || len(data) < 1+int(data[0])*18 {
+		return nil
+	}
+
+	version := newUDPVersion("netbios-ns")
+	var names []string
+	for i := 0; i < int(data[0]); i++ {
+		entry := data[1+i*18 : 1+(i+1)*18]
+		name := strings.TrimRight(printable(string(entry[:15])), " ")
+		suffix := entry[15]
+		group := binary.BigEndian.Uint16(entry[16:])&0x8000 != 0
+		names = append(names, fmt.Sprintf("%s<%02x>", name, suffix))
+
+		switch {
+		case suffix == 0x00 && !group && version.Hostname == "":
+			version.Hostname = name
+		case suffix == 0x00 && group && version.Info == "":
+			version.Info = "workgroup: " + name
+		}
+	}
+	version.UDP.Info["names"] = strings.Join(names, ", ")
+
+	// Samba always reports a zero MAC address
+	mac := data[1+int(data[0])*18:]
+	if len(mac) >= 6 {
+		mac = mac[:6]
+		version.UDP.Info["mac"] = net.HardwareAddr(mac).String()
+		if bytes.Equal(mac, make([]byte, 6)) {
+			version.Product = "Samba nmbd netbios-ns"
+		} else {
+			version.Product = "Microsoft Windows netbios-ns"
+		}
+	}
+
+	return version
+}
+
+// ntpVariablePattern matches the name=value pairs of an NTP mode 6 READVAR reply
+var ntpVariablePattern = regexp.MustCompile(`(\w+)=("[^"]*"|[^,\s]*)`)
+
+// ntpDaemonPattern splits the version variable of ntpd, e.g. "ntpd 4.2.8p15@1.3728-o Wed Sep 23 11:46:38 UTC 2020 (1)"
+var ntpDaemonPattern = regexp.MustCompile(`^(\S+) ([^@\s]+)`)
+
+// parseNTP reads the answer to either the mode 6 READVAR or the mode 3 client request
+func parseNTP(reply []byte) *ServiceVersion {
+	if len(reply) < 12 {
+		return nil
+	}
+
+	version := newUDPVersion("ntp")
+	version.Product = "NTP"
+	switch reply[0] & 0x07 {
+	case 4: // server
+		if len(reply) < 48 {
+			return nil
+		}
+		stratum := reply[1]
+		version.Version = fmt.Sprintf("v%d", reply[0]>>3&0x07)
+		if reply[0]>>6 == 3 || stratum == 0 || stratum >= 16 {
+			version.Info = "unsynchronized"
+		}
+		version.UDP.Info["stratum"] = strconv.Itoa(int(stratum))
+		// The reference ID is a clock name at stratum 0 and 1, and the address of the upstream server below
+		if stratum <= 1 {
+			version.UDP.Info["refid"] = strings.TrimRight(printable(string(reply[12:16])), " ")
+		} else {
+			version.UDP.Info["refid"] = net.IP(reply[12:16]).String()
+		}
+	case 6: // control message
+		if reply[1]&0x80 == 0 || reply[1]&0x40 != 0 {
+			return nil
+		}
+		count := int(binary.BigEndian.Uint16(reply[10:]))
+		data := reply[12:min(12+count, len(reply))]
+
+		for _, match := range ntpVariablePattern.FindAllStringSubmatch(printable(string(data)), -1) {
+			value := strings.Trim(match[2], `"`)
+			switch match[1] {
+			case "version":
+				if daemon := ntpDaemonPattern.FindStringSubmatch(value); daemon != nil {
+					version.Product, version.Version = daemon[1], daemon[2]
+				}
+			case "system", "processor", "stratum", "refid":
+				version.UDP.Info[match[1]] = value
+			}
+		}
+		version.UDP.Warnings = append(version.UDP.Warnings, "NTP mode 6 queries are answered, which can be abused for amplification")
+	default:
+		return nil
+	}
+
+	return version
+}
+
+// parseSNMP reads the GetResponse to a sysDescr.0 request. Agents only answer requests with a valid
+// community, and it's echoed in the response
+func parseSNMP(reply []byte) *ServiceVersion {
+	message, err := readBER(reply)
+	if err != nil || len(message) == 0 || message[0].tag != 0x30 {
+		return nil
+	}
+	fields, err := readBER(message[0].contents)
+	if err != nil || len(fields) < 3 || fields[0].tag != 0x02 || fields[1].tag != 0x04 || fields[2].tag != 0xa2 {
+		return nil
+	}
+
+	version := newUDPVersion("snmp")
+	snmpVersion := "v1"
+	if berInt(fields[0].contents) == 1 {
+		snmpVersion = "v2c"
+	}
+	community := string(fields[1].contents)
+	version.Product = "SNMP" + snmpVersion + " server"
+	version.Info = "community: " + community
+	version.UDP.Warnings = append(version.UDP.Warnings, fmt.Sprintf("SNMP community '%s' grants read access", community))
+
+	// GetResponse: request ID, error status, error index, variable bindings
+	pdu, err := readBER(fields[2].contents)
+	if err != nil || len(pdu) < 4 || berInt(pdu[1].contents) != 0 {
+		return version
+	}
+	bindings, err := readBER(pdu[3].contents)
+	if err != nil || len(bindings) == 0 {
+		return version
+	}
+	binding, err := readBER(bindings[0].contents)
+	if err != nil || len(binding) < 2 || binding[1].tag != 0x04 {
+		return version
+	}
+	version.UDP.Info["sysDescr"] = printable(strings.Join(strings.Fields(string(binding[1].contents)), " "))
+
+	return version
+}
+
+// parseTFTP recognizes the error or data packet a TFTP server answers a read request with
+func parseTFTP(reply []byte) *ServiceVersion {
+	if len(reply) < 4 {
+		return nil
+	}
+
+	version := newUDPVersion("tftp")
+	switch binary.BigEndian.Uint16(reply) {
+	case 3: // DATA
+		version.UDP.Info["read request"] = "accepted"
+	case 5: // ERROR
+		if message, _, ok := cutCString(reply[4:]); ok && message != "" {
+			version.UDP.Info["error"] = printable(message)
+		}
+	default:
+		return nil
+	}
+
+	return version
+}
+
+// rpcParser returns a parser for the reply to a NULL call to an RPC program
+func rpcParser(name string, program int) func([]byte) *ServiceVersion {
+	return func(reply []byte) *ServiceVersion {
+		// xid, message type (1 is a reply) and reply state (0 is accepted)
+		if len(reply) < 12 || binary.BigEndian.Uint32(reply[4:]) != 1 {
+			return nil
+		}
+
+		version := newUDPVersion(name)
+		version.Info = fmt.Sprintf("RPC #%d", program)
+		if binary.BigEndian.Uint32(reply[8:]) != 0 {
+			return version
+		}
+
+		// The verifier comes before the accept state
+		if len(reply) < 20 {
+			return version
+		}
+		offset := 16 + int(binary.BigEndian.Uint32(reply[16:])) + 4
+		if offset+4 > len(reply) {
+			return version
+		}
+		// A program mismatch tells the range of versions the server supports
+		if binary.BigEndian.Uint32(reply[offset:]) == 2 && offset+12 <= len(reply) {
+			version.Version = fmt.Sprintf("%d-%d", binary.BigEndian.Uint32(reply[offset+4:]), binary.BigEndian.Uint32(reply[offset+8:]))
+		}
+
+		return version
+	}
+}
+
+// ikeVendorIDs are the vendor IDs of well-known IKE implementations and extensions, matched as prefixes
+var ikeVendorIDs = []struct {
+	prefix  string
+	name    string
+	product string
+}{
+	{"882fe56d6fd20dbc2251613b2ebe5beb", "strongSwan", "strongSwan"},
+	{"12f5f28c457168a9702d9fe274cc01", "Cisco Unity", "Cisco"},
+	{"4865617274426561745f4e6f74696679", "Cisco Heartbeat Notify", "Cisco"},
+	{"1e2b516905991c7d7c96fcbfb587e461", "MS NT5 ISAKMPOAKLEY", "Microsoft Windows"},
+	{"4a131c81070358455c5728f20e95452f", "RFC 3947 NAT-T", ""},
+	{"afcad71368a1f1c96b8696fc77570100", "Dead Peer Detection v1.0", ""},
+	{"4048b7d56ebce88525e7de7f00d6c2d3", "IKE Fragmentation", ""},
+	{"09002689dfd6b712", "XAUTH", ""},
+}
+
+// parseIKE reads the answer to an IKEv1 main mode proposal, which is either the accepted proposal or a notification
+func parseIKE(reply []byte) *ServiceVersion {
+	if len(reply) < 28 || reply[17]>>4 == 0 {
+		return nil
+	}
+
+	version := newUDPVersion("isakmp")
+	version.Info = fmt.Sprintf("IKEv%d", reply[17]>>4)
+
+	var vendors []string
+	next, offset := reply[16], 28
+	for next != 0 && offset+4 <= len(reply) {
+		length := int(binary.BigEndian.Uint16(reply[offset+2:]))
+		if length < 4 || offset+length > len(reply) {
+			break
+		}
+		body := reply[offset+4 : offset+length]
+
+		switch next {
+		case 1: // security association
+			version.UDP.Warnings = append(version.UDP.Warnings, "accepts 3DES, SHA1 and MODP1024 with pre-shared keys in main mode")
+		case 11: // notification
+			if len(body) >= 8 {
+				version.UDP.Info["notification"] = strconv.Itoa(int(binary.BigEndian.Uint16(body[6:])))
+			}
+		case 13: // vendor ID
+			vendor := hex.EncodeToString(body)
+			for _, known := range ikeVendorIDs {
+				if strings.HasPrefix(vendor, known.prefix) {
+					vendor = known.name
+					if version.Product == "" {
+						version.Product = known.product
+					}
+					break
+				}
+			}
+			vendors = append(vendors, vendor)
+		}
+
+		next = reply[offset]
+		offset += length
+	}
+	if len(vendors) > 0 {
+		version.UDP.Info["vendor_ids"] = strings.Join(vendors, ", ")
+	}
+
+	return version
+}
+
+// parseIPMI reads the answer to Get Channel Authentication Capabilities
+func parseIPMI(reply []byte) *ServiceVersion {
+	// RMCP version 6 and class IPMI
+	if len(reply) < 4 || reply[0] != 0x06 || reply[3] != 0x07 {
+		return nil
+	}
+
+	version := newUDPVersion("asf-rmcp")
+	version.Product = "IPMI"
+	// RMCP header, IPMI 1.5 session header, then the response message whose data starts with the completion code
+	if len(reply) < 25 || reply[20] != 0 {
+		return version
+	}
+
+	version.Version = "1.5"
+	if reply[22]&0x80 != 0 && reply[24]&0x02 != 0 {
+		version.Version = "2.0"
+	}
+	if reply[23]&0x01 != 0 {
+		version.UDP.Warnings = append(version.UDP.Warnings, "anonymous IPMI login is enabled")
+	}
+	if reply[23]&0x02 != 0 {
+		version.UDP.Warnings = append(version.UDP.Warnings, "IPMI null usernames are enabled")
+	}
+
+	return version
+}
+
+// parseMSSQLBrowser reads the instance list of the SQL Server Browser
+func parseMSSQLBrowser(reply []byte) *ServiceVersion {
+	if len(reply) < 3 || reply[0] != 0x05 {
+		return nil
+	}
+
+	version := newUDPVersion("ms-sql-m")
+	version.Product = "Microsoft SQL Server"
+
+	var instances []string
+	for _, instance := range strings.Split(printable(string(reply[3:])), ";;") {
+		fields := strings.Split(instance, ";")
+		values := make(map[string]string)
+		for i := 0; i+1 < len(fields); i += 2 {
+			values[fields[i]] = fields[i+1]
+		}
+		if values["InstanceName"] == "" {
+			continue
+		}
+
+		if version.Version == "" {
+			version.Version = values["Version"]
+			version.Hostname = values["ServerName"]
+		}
+		description := fmt.Sprintf("%s (%s)", values["InstanceName"], values["Version"])
+		if values["tcp"] != "" {
+			description += " tcp/" + values["tcp"]
+		}
+		instances = append(instances, description)
+	}
+	if len(instances) > 0 {
+		version.UDP.Info["instances"] = strings.Join(instances, ", ")
+	}
+
+	return version
+}
+
+// parseHeaders splits a text protocol reply like HTTP or SIP into its first line and its headers, with lowercase names
+func parseHeaders(reply []byte) (string, map[string]string) {
+	lines := strings.Split(string(reply), "\n")
+	headers := make(map[string]string)
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(printable(line), ":")
+		if !ok {
+			continue
+		}
+		headers[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return printable(lines[0]), headers
+}
+
+// parseSSDP reads the answer of a UPnP device to an M-SEARCH
+func parseSSDP(reply []byte) *ServiceVersion {
+	status, headers := parseHeaders(reply)
+	if !strings.HasPrefix(status, "HTTP/1.") {
+		return nil
+	}
+
+	version := newUDPVersion("upnp")
+	version.Product = headers["server"]
+	if headers["location"] != "" {
+		version.UDP.Info["location"] = headers["location"]
+	}
+	if headers["usn"] != "" {
+		version.UDP.Info["usn"] = headers["usn"]
+	}
+
+	return version
+}
+
+// parseSIP reads the answer to an OPTIONS request
+func parseSIP(reply []byte) *ServiceVersion {
+	status, headers := parseHeaders(reply)
+	if !strings.HasPrefix(status, "SIP/2.0 ") {
+		return nil
+	}
+
+	version := newUDPVersion("sip")
+	version.Product = headers["server"]
+	if version.Product == "" {
+		version.Product = headers["user-agent"]
+	}
+	version.Info = "status: " + strings.TrimPrefix(status, "SIP/2.0 ")
+	if headers["allow"] != "" {
+		version.UDP.Info["allow"] = headers["allow"]
+	}
+
+	return version
+}
+
+// parseSTUN reads a binding response, which tells the address the request came from and often the server software
+func parseSTUN(reply []byte) *ServiceVersion {
+	const magicCookie = 0x2112a442
+	if len(reply) < 20 || binary.BigEndian.Uint16(reply) != 0x0101 || binary.BigEndian.Uint32(reply[4:]) != magicCookie {
+		return nil
+	}
+
+	version := newUDPVersion("stun")
+	attributes := reply[20:]
+	for len(attributes) >= 4 {
+		kind := binary.BigEndian.Uint16(attributes)
+		length := int(binary.BigEndian.Uint16(attributes[2:]))
+		if 4+length > len(attributes) {
+			break
+		}
+		value := attributes[4 : 4+length]
+
+		switch kind {
+		case 0x8022: // SOFTWARE
+			version.Product = printable(string(value))
+		case 0x0020: // XOR-MAPPED-ADDRESS, IPv4 only
+			if length == 8 && value[1] == 0x01 {
+				port := binary.BigEndian.Uint16(value[2:]) ^ magicCookie>>16
+				ip := make(net.IP, 4)
+				binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(value[4:])^magicCookie)
+				version.UDP.Info["mapped_address"] = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+			}
+		}
+
+		// Attributes are padded to 4 bytes
+		attributes = attributes[min(4+(length+3)&^3, len(attributes)):]
+	}
+
+	return version
+}
+
+// parseMemcachedUDP reads the answer to the version command behind the UDP frame header
+func parseMemcachedUDP(reply []byte) *ServiceVersion {
+	if len(reply) < 8 {
+		return nil
+	}
+	line, _, _ := strings.Cut(string(reply[8:]), "\r\n")
+	number, ok := strings.CutPrefix(line, "VERSION ")
+	if !ok {
+		return nil
+	}
+
+	version := newUDPVersion("memcached")
+	version.Product, version.Version = "Memcached", printable(number)
+	version.UDP.Warnings = append(version.UDP.Warnings, "memcached answers over UDP, which can be abused for amplification")
+
+	return version
+}
+
+// Details returns the lines shown under the port in the results table
+func (u *UDPInfo) Details() []string {
+	keys := make([]string, 0, len(u.Info))
+	for key := range u.Info {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, key+": "+u.Info[key])
+	}
+	for _, warning := range u.Warnings {
+		lines = append(lines, "WARNING: "+warning)
+	}
+
+	return lines
+}
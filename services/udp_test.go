@@ -0,0 +1,227 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"maps"
+	"testing"
+)
+
+// u16 and u32 encode big endian integers for building replies
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+// join concatenates the parts of a reply
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	header := func(flags, questions, answers uint16) []byte {
+		return join(u16(0x1234), u16(flags), u16(questions), u16(answers), u16(0), u16(0))
+	}
+	question := join([]byte("\x07version\x04bind\x00"), u16(16), u16(3))
+	txt := []byte("\x099.18.19-1")
+	answer := join([]byte{0xc0, 0x0c}, u16(16), u16(3), u32(0), u16(uint16(len(txt))), txt)
+	response := join(header(0x8180, 1, 1), question, answer)
+
+	type record struct {
+		name string
+		kind uint16
+		data []byte
+	}
+	tests := []struct {
+		name    string
+		msg     []byte
+		rcode   int
+		records []record
+		wantErr bool
+	}{
+		{"answer", response, 0, []record{{"version.bind", 16, txt}}, false},
+		{"refused", join(header(0x8185, 1, 0), question), 5, nil, false},
+		{"too short", header(0x8180, 0, 0)[:11], 0, nil, true},
+		{"query", join(header(0x0100, 1, 0), question), 0, nil, true},
+		{"truncated question", join(header(0x8180, 1, 0), question[:5]), 0, nil, true},
+		{"missing record", join(header(0x8180, 1, 2), question, answer), 0, nil, true},
+		{"truncated record header", response[:len(response)-len(txt)-4], 0, nil, true},
+		{"truncated record data", response[:len(response)-1], 0, nil, true},
+		{"pointer loop", join(header(0x8180, 0, 1), []byte{0xc0, 0x0c}, u16(16), u16(3), u32(0), u16(0)), 0, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rcode, records, err := parseDNSMessage(test.msg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseDNSMessage(%x) error = %v, want error %v", test.msg, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if rcode != test.rcode {
+				t.Errorf("parseDNSMessage(%x) rcode = %d, want %d", test.msg, rcode, test.rcode)
+			}
+			if len(records) != len(test.records) {
+				t.Fatalf("parseDNSMessage(%x) = %d records, want %d", test.msg, len(records), len(test.records))
+			}
+			for i, want := range test.records {
+				if got := records[i]; got.Name != want.name || got.Type != want.kind || !bytes.Equal(got.Data, want.data) {
+					t.Errorf("parseDNSMessage(%x) record %d = %s type %d %q, want %s type %d %q", test.msg, i, got.Name, got.Type, got.Data, want.name, want.kind, want.data)
+				}
+			}
+		})
+	}
+}
+
+func TestRPCParser(t *testing.T) {
+	// xid, a reply and its state, then the verifier and the accept state
+	reply := func(state uint32, verifier []byte, accept ...uint32) []byte {
+		msg := join(u32(0x1234), u32(1), u32(state), u32(0), u32(uint32(len(verifier))), verifier)
+		for _, v := range accept {
+			msg = append(msg, u32(v)...)
+		}
+		return msg
+	}
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantNil bool
+		version string
+	}{
+		{"success", reply(0, nil, 0), false, ""},
+		{"program mismatch", reply(0, nil, 2, 2, 4), false, "2-4"},
+		{"program mismatch after a verifier", reply(0, []byte("abcd"), 2, 3, 4), false, "3-4"},
+		{"truncated program mismatch", reply(0, nil, 2, 2), false, ""},
+		{"denied", reply(1, nil), false, ""},
+		{"missing verifier", reply(0, nil)[:16], false, ""},
+		{"verifier longer than the reply", join(u32(0x1234), u32(1), u32(0), u32(0), u32(0xffffffff)), false, ""},
+		{"call", join(u32(0x1234), u32(0), u32(0)), true, ""},
+		{"too short", join(u32(0x1234), u32(1)), true, ""},
+	}
+
+	parse := rpcParser("rpcbind", 100000)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version := parse(test.reply)
+			if (version == nil) != test.wantNil {
+				t.Fatalf("rpcParser()(%x) = %v, want nil %v", test.reply, version, test.wantNil)
+			}
+			if version == nil {
+				return
+			}
+
+			if version.Name != "rpcbind" || version.Info != "RPC #100000" {
+				t.Errorf("rpcParser()(%x) = %s %q, want rpcbind \"RPC #100000\"", test.reply, version.Name, version.Info)
+			}
+			if version.Version != test.version {
+				t.Errorf("rpcParser()(%x) version = %q, want %q", test.reply, version.Version, test.version)
+			}
+		})
+	}
+}
+
+func TestParseIKE(t *testing.T) {
+	// The cookies, the first payload, IKEv1, main mode, no flags, the message ID and the length
+	header := func(next byte) []byte {
+		return join(make([]byte, 16), []byte{next, 0x10, 2, 0}, u32(0), u32(0))
+	}
+	payload := func(next byte, body []byte) []byte {
+		return join([]byte{next, 0}, u16(uint16(4+len(body))), body)
+	}
+	strongSwan, _ := hex.DecodeString("882fe56d6fd20dbc2251613b2ebe5beb")
+	notification := join(u32(1), []byte{1, 0}, u16(14))
+
+	tests := []struct {
+		name     string
+		reply    []byte
+		wantNil  bool
+		product  string
+		info     map[string]string
+		warnings int
+	}{
+		{"accepted proposal", join(header(1), payload(0, make([]byte, 8))), false, "", map[string]string{}, 1},
+		{"notification", join(header(11), payload(0, notification)), false, "", map[string]string{"notification": "14"}, 0},
+		{"truncated notification", join(header(11), payload(0, notification[:6])), false, "", map[string]string{}, 0},
+		{"vendor IDs", join(header(13), payload(13, strongSwan), payload(0, []byte{0xab, 0xcd})), false, "strongSwan", map[string]string{"vendor_ids": "strongSwan, abcd"}, 0},
+		{"payload longer than the reply", join(header(13), payload(0, strongSwan)[:10]), false, "", map[string]string{}, 0},
+		{"payload shorter than its header", join(header(13), []byte{0, 0, 0, 2}), false, "", map[string]string{}, 0},
+		{"version 0", join(make([]byte, 16), []byte{1, 0, 2, 0}, u32(0), u32(0)), true, "", nil, 0},
+		{"too short", header(1)[:27], true, "", nil, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version := parseIKE(test.reply)
+			if (version == nil) != test.wantNil {
+				t.Fatalf("parseIKE(%x) = %v, want nil %v", test.reply, version, test.wantNil)
+			}
+			if version == nil {
+				return
+			}
+
+			if version.Info != "IKEv1" || version.Product != test.product {
+				t.Errorf("parseIKE(%x) = %q %q, want \"IKEv1\" %q", test.reply, version.Info, version.Product, test.product)
+			}
+			if !maps.Equal(version.UDP.Info, test.info) {
+				t.Errorf("parseIKE(%x) info = %v, want %v", test.reply, version.UDP.Info, test.info)
+			}
+			if len(version.UDP.Warnings) != test.warnings {
+				t.Errorf("parseIKE(%x) warnings = %q, want %d", test.reply, version.UDP.Warnings, test.warnings)
+			}
+		})
+	}
+}
+
+func TestParseSTUN(t *testing.T) {
+	const magicCookie = 0x2112a442
+	header := func(kind uint16, cookie uint32) []byte {
+		return join(u16(kind), u16(0), u32(cookie), make([]byte, 12))
+	}
+	attribute := func(kind uint16, value []byte) []byte {
+		padding := make([]byte, (4-len(value)%4)%4)
+		return join(u16(kind), u16(uint16(len(value))), value, padding)
+	}
+	// 192.0.2.1:32853 XORed with the magic cookie
+	mapped := join([]byte{0, 0x01}, u16(32853^magicCookie>>16), u32(0xc0000201^magicCookie))
+	mappedIPv6 := join([]byte{0, 0x02}, u16(32853^magicCookie>>16), make([]byte, 16))
+	software := []byte("Coturn-4.6.2")
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantNil bool
+		product string
+		info    map[string]string
+	}{
+		{"software and mapped address", join(header(0x0101, magicCookie), attribute(0x8022, software), attribute(0x0020, mapped)), false, "Coturn-4.6.2", map[string]string{"mapped_address": "192.0.2.1:32853"}},
+		{"padded software", join(header(0x0101, magicCookie), attribute(0x8022, []byte("stund")), attribute(0x0020, mapped)), false, "stund", map[string]string{"mapped_address": "192.0.2.1:32853"}},
+		{"unpadded last attribute", join(header(0x0101, magicCookie), u16(0x8022), u16(5), []byte("stund")), false, "stund", map[string]string{}},
+		{"IPv6 mapped address", join(header(0x0101, magicCookie), attribute(0x0020, mappedIPv6)), false, "", map[string]string{}},
+		{"attribute longer than the reply", join(header(0x0101, magicCookie), attribute(0x8022, software)[:10]), false, "", map[string]string{}},
+		{"no attributes", header(0x0101, magicCookie), false, "", map[string]string{}},
+		{"binding request", header(0x0001, magicCookie), true, "", nil},
+		{"wrong magic cookie", header(0x0101, 0), true, "", nil},
+		{"too short", header(0x0101, magicCookie)[:19], true, "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version := parseSTUN(test.reply)
+			if (version == nil) != test.wantNil {
+				t.Fatalf("parseSTUN(%x) = %v, want nil %v", test.reply, version, test.wantNil)
+			}
+			if version == nil {
+				return
+			}
+
+			if version.Product != test.product {
+				t.Errorf("parseSTUN(%x) product = %q, want %q", test.reply, version.Product, test.product)
+			}
+			if !maps.Equal(version.UDP.Info, test.info) {
+				t.Errorf("parseSTUN(%x) info = %v, want %v", test.reply, version.UDP.Info, test.info)
+			}
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/0niSec/gomap/logger"
+)
+
+const (
+	// maxVersionLength is the longest version string shown in the results table
+	maxVersionLength = 60
+	// maxResponseSize is how much of a response to a probe is kept for matching
+	maxResponseSize = 16 * 1024
+	// DefaultIntensity is the version intensity used when none is given, the same as nmap's
+	DefaultIntensity = 7
+)
+
+// errConnect is returned when a probe couldn't connect to the port at all
+var errConnect = errors.New("error connecting")
+
+// Target is an open port to detect the service of
+type Target struct {
+	IP   net.IP
+	Port uint16
+	// Protocol is "tcp" or "udp", empty means tcp
+	Protocol string
+}
+
+// DetectOptions configures version detection
+type DetectOptions struct {
+	// Workers is the number of ports probed at once
+	Workers int
+	// ConnectTimeout is how long to wait for each connection to be established
+	ConnectTimeout time.Duration
+	// ReadTimeout is how long to wait for each service to answer a probe
+	ReadTimeout time.Duration
+	// Intensity is the highest rarity of the probes that are tried, from 0 to 9
+	Intensity int
+	// Probes are the probes and matches used to identify services
+	Probes *ProbeDB
+	// Payloads are the datagrams sent to UDP ports
+	Payloads *PayloadDB
+	// SNMPCommunities are the communities SNMP GetRequests are sent with
+	SNMPCommunities []string
+	// TryLogins lets the data store clients log in as root or postgres with an empty password. Without it they only
+	// read what the servers say before authentication, since logins show up in auth logs and can get us blocked.
+	TryLogins bool
+}
+
+// ServiceVersion is what version detection learned about the service on a port
+type ServiceVersion struct {
+	// Name is the service the probes identified, which replaces the guess made from the port number
+	Name       string   `json:"-"`
+	Product    string   `json:"product,omitempty"`
+	Version    string   `json:"version,omitempty"`
+	Info       string   `json:"extra_info,omitempty"`
+	Hostname   string   `json:"hostname,omitempty"`
+	OSType     string   `json:"os_type,omitempty"`
+	DeviceType string   `json:"device_type,omitempty"`
+	CPEs       []string `json:"cpe,omitempty"`
+	// Soft is true when a softmatch named the service but no probe could tell its version
+	Soft bool `json:"-"`
+	// Banner is the first response received from the service
+	Banner string `json:"banner,omitempty"`
+	// TLS is only set when the service is wrapped in TLS
+	TLS *TLSInfo `json:"tls,omitempty"`
+	// HTTP is only set for web services
+	HTTP *HTTPInfo `json:"http,omitempty"`
+	// SSH is only set for SSH servers
+	SSH *SSHInfo `json:"ssh,omitempty"`
+	// Database is only set for data stores
+	Database *DatabaseInfo `json:"database,omitempty"`
+	// UDP is only set when the reply to a UDP payload revealed more than the version
+	UDP *UDPInfo `json:"udp,omitempty"`
+}
+
+// Display returns the version shown in the VERSION column, e.g. "OpenSSH 8.9p1 (Ubuntu Linux; protocol 2.0)".
+// When no probe matched, the first line of the banner is shown instead.
+func (v *ServiceVersion) Display() string {
+	var parts []string
+	if v.Product != "" {
+		parts = append(parts, v.Product)
+	} else if v.Database != nil {
+		parts = append(parts, v.Database.Product)
+	} else if v.HTTP != nil && v.HTTP.Server != "" {
+		parts = append(parts, v.HTTP.Server)
+	}
+	if v.Version != "" {
+		parts = append(parts, v.Version)
+	} else if v.Database != nil && v.Database.Version != "" {
+		parts = append(parts, v.Database.Version)
+	}
+	if v.Info != "" {
+		parts = append(parts, "("+v.Info+")")
+	}
+	if v.HTTP != nil {
+		parts = append(parts, v.HTTP.Summary())
+	}
+	if v.Database != nil && v.Database.Summary() != "" {
+		parts = append(parts, v.Database.Summary())
+	}
+	if len(parts) == 0 {
+		return versionFromBanner(v.Banner)
+	}
+
+	return truncateVersion(strings.Join(parts, " "))
+}
+
+// Details returns the extra lines shown under the port in the results table
+func (v *ServiceVersion) Details() []string {
+	var lines []string
+	if v.TLS != nil {
+		lines = append(lines, v.TLS.Details()...)
+	}
+	if v.HTTP != nil {
+		lines = append(lines, v.HTTP.Details()...)
+	}
+	if v.SSH != nil {
+		lines = append(lines, v.SSH.Details()...)
+	}
+	if v.Database != nil {
+		lines = append(lines, v.Database.Details()...)
+	}
+	if v.UDP != nil {
+		lines = append(lines, v.UDP.Details()...)
+	}
+	return lines
+}
+
+// DetectVersions probes every target with a bounded pool of workers.
+// The returned slice is in the same order as targets. Ports nothing could be learned about are nil.
+func DetectVersions(targets []Target, opts DetectOptions) []*ServiceVersion {
+	results := make([]*ServiceVersion, len(targets))
+
+	workers := opts.Workers
+	if workers <= 0 || workers > len(targets) {
+		workers = len(targets)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if targets[job].Protocol == "udp" {
+					results[job] = detectUDPVersion(targets[job], opts)
+					continue
+				}
+				results[job] = deepProbe(targets[job], detectVersion(targets[job], opts), opts)
+			}
+		}()
+	}
+
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// detectVersion identifies the service on a single port.
+//
+// Services that talk first are matched on their banner by the NULL probe. Services that stay silent get a TLS handshake,
+// and when it succeeds every probe is sent again inside the TLS tunnel, so e.g. HTTPS on any port is found as https.
+func detectVersion(target Target, opts DetectOptions) *ServiceVersion {
+	if opts.Probes == nil || opts.Probes.Exclude.contains(target.Port) {
+		return nil
+	}
+
+	address := net.JoinHostPort(target.IP.String(), strconv.Itoa(int(target.Port)))
+	plain := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, opts.ConnectTimeout)
+	}
+
+	probes := opts.Probes.probesFor("TCP", target.Port, opts.Intensity, false)
+	var soft *ServiceVersion
+	var banner []byte
+	if len(probes) > 0 && probes[0].Name == "NULL" {
+		var err error
+		soft, banner, err = runProbes(target, probes[:1], plain, nil, opts)
+		if errors.Is(err, errConnect) {
+			return nil
+		}
+		if soft != nil && !soft.Soft {
+			return withBanner(soft, banner)
+		}
+		probes = probes[1:]
+	}
+
+	// Silent services might be waiting for a TLS ClientHello
+	if banner == nil {
+		if tlsInfo := detectTLS(address, opts.ConnectTimeout); tlsInfo != nil {
+			logger.Debug("Service speaks TLS", "target", target.IP, "port", target.Port, "version", tlsInfo.Version)
+			tunnel := func() (net.Conn, error) {
+				return dialTLS(address, opts.ConnectTimeout)
+			}
+			version, response, _ := runProbes(target, opts.Probes.probesFor("TCP", target.Port, opts.Intensity, true), tunnel, nil, opts)
+			if version == nil {
+				version = &ServiceVersion{}
+			}
+			version.TLS = tlsInfo
+			version.Name = tlsServiceName(version.Name)
+			return withBanner(version, response)
+		}
+	}
+
+	version, response, _ := runProbes(target, probes, plain, soft, opts)
+	if banner == nil {
+		banner = response
+	}
+	return withBanner(version, banner)
+}
+
+// deepProbe learns more about a service once it's identified, with a client for its protocol.
+// It returns the version with what was learned, which is only created here if the probes found nothing.
+func deepProbe(target Target, version *ServiceVersion, opts DetectOptions) *ServiceVersion {
+	if version != nil && IsHTTP(version.Name) {
+		info, err := probeHTTP(target, version.TLS != nil, opts)
+		if err != nil {
+			logger.Debug("Failed to probe HTTP", "target", target.IP, "port", target.Port, "err", err)
+		}
+		version.HTTP = info
+	}
+
+	if isSSH(target.Port, version) {
+		info, err := probeSSH(target, opts)
+		if err != nil {
+			logger.Debug("Failed to probe SSH", "target", target.IP, "port", target.Port, "err", err)
+		} else {
+			if version == nil {
+				version = &ServiceVersion{}
+			}
+			version.Name = "ssh"
+			version.SSH = info
+		}
+	}
+
+	if service := databaseService(target.Port, version); service != "" {
+		info, err := databaseProbes[service](target, version, opts)
+		if err != nil {
+			logger.Debug("Failed to probe database", "target", target.IP, "port", target.Port, "service", service, "err", err)
+		} else {
+			if version == nil {
+				version = &ServiceVersion{}
+			}
+			if version.Name == "" {
+				version.Name = service
+			}
+			version.Database = info
+		}
+	}
+
+	return version
+}
+
+// withBanner puts the banner in the version, or makes a version of the banner alone if no probe matched
+func withBanner(version *ServiceVersion, banner []byte) *ServiceVersion {
+	if version == nil {
+		if len(banner) == 0 {
+			return nil
+		}
+		version = &ServiceVersion{}
+	}
+	version.Banner = string(banner)
+	return version
+}
+
+// runProbes sends probes over connections from dial until one of their responses is matched.
+// It returns the best match, which is only soft if no probe could do better, and the first response received.
+//
+// A softmatch only names the service, so probing goes on with the probes that can match that service.
+func runProbes(target Target, probes []*Probe, dial func() (net.Conn, error), soft *ServiceVersion, opts DetectOptions) (*ServiceVersion, []byte, error) {
+	var banner []byte
+	for _, probe := range probes {
+		if soft != nil && !probe.canMatch(soft.Name) {
+			continue
+		}
+
+		response, version, err := runProbe(probe, dial, opts)
+		if err != nil {
+			logger.Debug("Failed to run service probe", "target", target.IP, "port", target.Port, "probe", probe.Name, "err", err)
+			if errors.Is(err, errConnect) {
+				// The port stopped accepting connections, no other probe will do better
+				return soft, banner, err
+			}
+			continue
+		}
+		if banner == nil && len(response) > 0 {
+			banner = response
+		}
+		if version == nil || (soft != nil && version.Name != soft.Name) {
+			continue
+		}
+
+		logger.Debug("Service probe matched", "target", target.IP, "port", target.Port, "probe", probe.Name, "service", version.Name, "soft", version.Soft)
+		if !version.Soft {
+			return version, banner, nil
+		}
+		if soft == nil {
+			soft = version
+		}
+	}
+
+	return soft, banner, nil
+}
+
+// probesFor returns the probes of the protocol ("TCP" or "UDP") to send to port at the given intensity, in the order
+// they're tried: the NULL probe, then the probes registered for the port, then every other probe in rarity order.
+// Probes registered for the port are tried whatever their rarity. Inside a TLS tunnel, that includes their sslports.
+func (db *ProbeDB) probesFor(protocol string, port uint16, intensity int, tunnel bool) []*Probe {
+	var null, forPort, others []*Probe
+	for _, probe := range db.Probes {
+		switch {
+		case probe.Protocol != protocol:
+		case probe.Name == "NULL":
+			null = append(null, probe)
+		case probe.Ports.contains(port) || (tunnel && probe.SSLPorts.contains(port)):
+			forPort = append(forPort, probe)
+		case probe.Rarity <= intensity:
+			others = append(others, probe)
+		}
+	}
+
+	sort.SliceStable(others, func(i, j int) bool { return others[i].Rarity < others[j].Rarity })
+
+	return append(append(null, forPort...), others...)
+}
+
+// runProbe connects with dial, sends the payload of the probe and reads the response until a match is found,
+// the service closes the connection or the wait is over
+func runProbe(probe *Probe, dial func() (net.Conn, error), opts DetectOptions) ([]byte, *ServiceVersion, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errConnect, err)
+	}
+	defer conn.Close()
+
+	wait := opts.ReadTimeout
+	if probe.TotalWait > 0 && probe.TotalWait < wait {
+		wait = probe.TotalWait
+	}
+	if err := conn.SetDeadline(time.Now().Add(wait)); err != nil {
+		return nil, nil, err
+	}
+
+	if len(probe.Payload) > 0 {
+		if _, err := conn.Write(probe.Payload); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var response []byte
+	var version *ServiceVersion
+	buffer := make([]byte, 4096)
+	for len(response) < maxResponseSize {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			response = append(response, buffer[:n]...)
+			version = probe.match(response)
+			if version != nil && !version.Soft {
+				break
+			}
+		}
+		if err != nil {
+			// Timeouts, EOF and resets all end the response, which is whatever arrived before them
+			break
+		}
+	}
+
+	return response, version, nil
+}
+
+// versionFromBanner returns the first line of the banner with unprintable characters removed,
+// cut down to fit in the results table
+func versionFromBanner(banner string) string {
+	var line string
+	for _, l := range strings.Split(banner, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			line = l
+			break
+		}
+	}
+
+	line = strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, line)
+
+	return truncateVersion(line)
+}
+
+// truncateVersion cuts a version down to fit in the results table
+func truncateVersion(version string) string {
+	if len(version) > maxVersionLength {
+		version = version[:maxVersionLength-3] + "..."
+	}
+	return version
+}
@@ -0,0 +1,53 @@
+package vulns
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/0niSec/gomap/scanner"
+)
+
+// Annotate attaches the CVEs affecting the products found on the ports of the hosts, leaving out the ones
+// scored below minCVSS. Products are identified by their CPEs, so ports without one are left alone.
+func Annotate(hosts []scanner.HostResult, db *DB, minCVSS float64) {
+	for h := range hosts {
+		for p := range hosts[h].Ports {
+			port := &hosts[h].Ports[p]
+			if port.ServiceVersion == nil {
+				continue
+			}
+
+			seen := make(map[string]bool)
+			for _, cpe := range port.CPEs {
+				parsed, ok := parseCPE(cpe)
+				if !ok {
+					continue
+				}
+				// Some probes only name the product in the CPE and leave the version to the VERSION column
+				version := parsed.version
+				if version == "" {
+					version, _, _ = strings.Cut(port.Version, " ")
+					if version != "" {
+						cpe += ":" + version
+					}
+				}
+
+				for _, entry := range db.Match(cpe, version) {
+					if entry.CVSS < minCVSS || seen[entry.ID] {
+						continue
+					}
+					seen[entry.ID] = true
+					port.Vulns = append(port.Vulns, scanner.Vuln{ID: entry.ID, CVSS: entry.CVSS, CPE: cpe})
+				}
+			}
+
+			// The most severe first
+			sort.SliceStable(port.Vulns, func(i, j int) bool {
+				if port.Vulns[i].CVSS != port.Vulns[j].CVSS {
+					return port.Vulns[i].CVSS > port.Vulns[j].CVSS
+				}
+				return port.Vulns[i].ID < port.Vulns[j].ID
+			})
+		}
+	}
+}
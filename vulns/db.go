@@ -0,0 +1,211 @@
+// The vulns package matches the versions found by version detection against an offline feed of CVEs.
+package vulns
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Entry is a CVE affecting a range of versions of a product. Versions are compared the way [CompareVersions] does,
+// and an entry without any bound affects every version.
+type Entry struct {
+	ID      string  `json:"id"`
+	CVSS    float64 `json:"cvss"`
+	CPE     string  `json:"cpe"`
+	Summary string  `json:"summary,omitempty"`
+	// Version is a single affected version. The bounds below are ignored when it's set
+	Version               string `json:"version,omitempty"`
+	VersionStartIncluding string `json:"version_start_including,omitempty"`
+	VersionStartExcluding string `json:"version_start_excluding,omitempty"`
+	VersionEndIncluding   string `json:"version_end_including,omitempty"`
+	VersionEndExcluding   string `json:"version_end_excluding,omitempty"`
+}
+
+// DB is a loaded feed of CVEs, indexed by vendor and product
+type DB struct {
+	entries map[string][]*Entry
+}
+
+// Load reads a feed of CVEs, either a JSON array of entries or a CSV file whose header names the columns,
+// using the same names as the JSON fields. The format is picked from the extension, or the contents without one.
+func Load(path string) (*DB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CVE feed: %w", err)
+	}
+
+	var entries []*Entry
+	switch ext := strings.ToLower(filepath.Ext(path)); {
+	case ext == ".json", ext != ".csv" && bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")):
+		err = json.Unmarshal(data, &entries)
+	default:
+		entries, err = parseCSV(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CVE feed %s: %w", path, err)
+	}
+
+	db := &DB{entries: make(map[string][]*Entry)}
+	for i, entry := range entries {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("entry %d of %s has no id", i+1, path)
+		}
+		cpe, ok := parseCPE(entry.CPE)
+		if !ok {
+			return nil, fmt.Errorf("entry %s of %s has an invalid cpe '%s'", entry.ID, path, entry.CPE)
+		}
+		// A feed listing the exact version in the CPE works like one with a version column
+		if entry.Version == "" && cpe.version != "" {
+			entry.Version = cpe.version
+		}
+		db.entries[cpe.key()] = append(db.entries[cpe.key()], entry)
+	}
+	return db, nil
+}
+
+// parseCSV parses a CSV feed, whose first row names the columns
+func parseCSV(data []byte) ([]*Entry, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"id", "cpe"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing CSV column '%s'", required)
+		}
+	}
+
+	var entries []*Entry
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		entry := &Entry{
+			ID:                    field("id"),
+			CPE:                   field("cpe"),
+			Summary:               field("summary"),
+			Version:               field("version"),
+			VersionStartIncluding: field("version_start_including"),
+			VersionStartExcluding: field("version_start_excluding"),
+			VersionEndIncluding:   field("version_end_including"),
+			VersionEndExcluding:   field("version_end_excluding"),
+		}
+		if cvss := field("cvss"); cvss != "" {
+			if entry.CVSS, err = strconv.ParseFloat(cvss, 64); err != nil {
+				return nil, fmt.Errorf("invalid cvss '%s' for %s", cvss, entry.ID)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Match returns the entries affecting the given version of the product a CPE names
+func (db *DB) Match(cpe, version string) []*Entry {
+	parsed, ok := parseCPE(cpe)
+	if !ok || version == "" {
+		return nil
+	}
+
+	var matches []*Entry
+	for _, entry := range db.entries[parsed.key()] {
+		if entry.affects(version) {
+			matches = append(matches, entry)
+		}
+	}
+	return matches
+}
+
+// affects returns true if the version is in the range of the entry
+func (e *Entry) affects(version string) bool {
+	if e.Version != "" {
+		return CompareVersions(version, e.Version) == 0
+	}
+	if e.VersionStartIncluding != "" && CompareVersions(version, e.VersionStartIncluding) < 0 {
+		return false
+	}
+	if e.VersionStartExcluding != "" && CompareVersions(version, e.VersionStartExcluding) <= 0 {
+		return false
+	}
+	if e.VersionEndIncluding != "" && CompareVersions(version, e.VersionEndIncluding) > 0 {
+		return false
+	}
+	if e.VersionEndExcluding != "" && CompareVersions(version, e.VersionEndExcluding) >= 0 {
+		return false
+	}
+	return true
+}
+
+// cpeName is the part of a CPE that identifies a product, and its version when there is one
+type cpeName struct {
+	part, vendor, product, version string
+}
+
+// key indexes entries by the product they affect
+func (c cpeName) key() string {
+	return c.part + ":" + c.vendor + ":" + c.product
+}
+
+// parseCPE parses a CPE 2.2 URI like cpe:/a:openbsd:openssh:8.9p1, or a CPE 2.3 name like
+// cpe:2.3:a:openbsd:openssh:8.9:p1:*:*:*:*:*:*
+func parseCPE(cpe string) (cpeName, bool) {
+	var fields []string
+	switch {
+	case strings.HasPrefix(cpe, "cpe:2.3:"):
+		fields = strings.Split(strings.TrimPrefix(cpe, "cpe:2.3:"), ":")
+		// 2.3 splits the update from the version, 2.2 and nmap keep them together
+		if len(fields) > 4 && !isWildcard(fields[3]) && !isWildcard(fields[4]) {
+			fields[3] += fields[4]
+		}
+	case strings.HasPrefix(cpe, "cpe:/"):
+		fields = strings.Split(strings.TrimPrefix(cpe, "cpe:/"), ":")
+	default:
+		return cpeName{}, false
+	}
+	if len(fields) < 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+		return cpeName{}, false
+	}
+
+	name := cpeName{
+		part:    strings.ToLower(fields[0]),
+		vendor:  strings.ToLower(fields[1]),
+		product: strings.ToLower(fields[2]),
+	}
+	if len(fields) > 3 && !isWildcard(fields[3]) {
+		name.version = fields[3]
+	}
+	return name, true
+}
+
+// isWildcard returns true for the CPE values meaning any or not applicable
+func isWildcard(value string) bool {
+	return value == "" || value == "*" || value == "-"
+}
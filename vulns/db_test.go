@@ -0,0 +1,132 @@
+package vulns
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseCPE(t *testing.T) {
+	tests := []struct {
+		cpe  string
+		want cpeName
+		ok   bool
+	}{
+		{"cpe:/a:openbsd:openssh:8.9p1", cpeName{"a", "openbsd", "openssh", "8.9p1"}, true},
+		{"cpe:/a:openbsd:openssh", cpeName{"a", "openbsd", "openssh", ""}, true},
+		{"cpe:/a:Apache:HTTP_Server:2.4.49", cpeName{"a", "apache", "http_server", "2.4.49"}, true},
+		{"cpe:/o:linux:linux_kernel", cpeName{"o", "linux", "linux_kernel", ""}, true},
+		{"cpe:2.3:a:openbsd:openssh:8.9:p1:*:*:*:*:*:*", cpeName{"a", "openbsd", "openssh", "8.9p1"}, true},
+		{"cpe:2.3:a:openssl:openssl:1.1.1:k:*:*:*:*:*:*", cpeName{"a", "openssl", "openssl", "1.1.1k"}, true},
+		{"cpe:2.3:a:apache:http_server:2.4.49:*:*:*:*:*:*:*", cpeName{"a", "apache", "http_server", "2.4.49"}, true},
+		{"cpe:2.3:a:apache:http_server:2.4.49:-:*:*:*:*:*:*", cpeName{"a", "apache", "http_server", "2.4.49"}, true},
+		{"cpe:2.3:a:apache:http_server:*:*:*:*:*:*:*:*", cpeName{"a", "apache", "http_server", ""}, true},
+		{"cpe:2.3:a:apache:http_server:-:*:*:*:*:*:*:*", cpeName{"a", "apache", "http_server", ""}, true},
+		{"cpe:2.3:a:apache:http_server", cpeName{"a", "apache", "http_server", ""}, true},
+		{"cpe:/a:openbsd", cpeName{}, false},
+		{"cpe:2.3:a::openssh:8.9", cpeName{}, false},
+		{"openssh 8.9p1", cpeName{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.cpe, func(t *testing.T) {
+			got, ok := parseCPE(test.cpe)
+			if ok != test.ok || got != test.want {
+				t.Errorf("parseCPE(%q) = %+v, %v, want %+v, %v", test.cpe, got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestEntryAffects(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   Entry
+		version string
+		want    bool
+	}{
+		{"exact version", Entry{Version: "8.9p1"}, "8.9p1", true},
+		{"other patch level", Entry{Version: "8.9p1"}, "8.9p2", false},
+		{"exact version ignores the bounds", Entry{Version: "8.9p1", VersionEndExcluding: "9.0"}, "8.8", false},
+		{"no bounds", Entry{}, "1.0", true},
+		{"start including, at the start", Entry{VersionStartIncluding: "2.4.0", VersionEndExcluding: "2.4.50"}, "2.4.0", true},
+		{"start including, before the start", Entry{VersionStartIncluding: "2.4.0", VersionEndExcluding: "2.4.50"}, "2.3.9", false},
+		{"end excluding, before the end", Entry{VersionStartIncluding: "2.4.0", VersionEndExcluding: "2.4.50"}, "2.4.49", true},
+		{"end excluding, at the end", Entry{VersionStartIncluding: "2.4.0", VersionEndExcluding: "2.4.50"}, "2.4.50", false},
+		{"start excluding, at the start", Entry{VersionStartExcluding: "1.0", VersionEndIncluding: "1.1.1k"}, "1.0", false},
+		{"end including, at the end", Entry{VersionStartExcluding: "1.0", VersionEndIncluding: "1.1.1k"}, "1.1.1k", true},
+		{"end including, letter past the end", Entry{VersionStartExcluding: "1.0", VersionEndIncluding: "1.1.1k"}, "1.1.1l", false},
+		{"end including, release before its letters", Entry{VersionStartExcluding: "1.0", VersionEndIncluding: "1.1.1k"}, "1.1.1", true},
+		{"release candidate before the fixed release", Entry{VersionEndExcluding: "2.0"}, "2.0rc1", true},
+		{"patch level past the fixed release", Entry{VersionEndExcluding: "8.9"}, "8.9p1", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.entry.affects(test.version); got != test.want {
+				t.Errorf("affects(%q) = %v, want %v", test.version, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadAndMatch(t *testing.T) {
+	feeds := map[string]string{
+		"feed.json": `[
+			{"id": "CVE-2023-0001", "cvss": 7.5, "cpe": "cpe:2.3:a:openbsd:openssh:8.9:p1:*:*:*:*:*:*"},
+			{"id": "CVE-2023-0002", "cvss": 5.3, "cpe": "cpe:/a:openbsd:openssh", "version_end_excluding": "9.3p2"},
+			{"id": "CVE-2023-0003", "cvss": 9.8, "cpe": "cpe:/a:openssl:openssl", "version_end_excluding": "3.0"}
+		]`,
+		"feed.csv": "id,cvss,cpe,version_end_excluding\n" +
+			"CVE-2023-0001,7.5,cpe:2.3:a:openbsd:openssh:8.9:p1:*:*:*:*:*:*,\n" +
+			"# a comment\n" +
+			"CVE-2023-0002,5.3,cpe:/a:openbsd:openssh,9.3p2\n" +
+			"CVE-2023-0003,9.8,cpe:/a:openssl:openssl,3.0\n",
+	}
+
+	tests := []struct {
+		cpe, version string
+		want         []string
+	}{
+		{"cpe:/a:openbsd:openssh", "8.9p1", []string{"CVE-2023-0001", "CVE-2023-0002"}},
+		{"cpe:/a:openbsd:openssh:8.9p1", "8.9p1", []string{"CVE-2023-0001", "CVE-2023-0002"}},
+		{"cpe:/a:openbsd:openssh", "8.9", []string{"CVE-2023-0002"}},
+		{"cpe:/a:openbsd:openssh", "9.3p2", nil},
+		{"cpe:/a:openbsd:openssh", "", nil},
+		{"cpe:/a:apache:http_server", "2.4.49", nil},
+	}
+
+	for name, feed := range feeds {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(feed), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			db, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+
+			for _, test := range tests {
+				var got []string
+				for _, entry := range db.Match(test.cpe, test.version) {
+					got = append(got, entry.ID)
+				}
+				if !slices.Equal(got, test.want) {
+					t.Errorf("Match(%q, %q) = %v, want %v", test.cpe, test.version, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadRejectsInvalidCPE(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.json")
+	if err := os.WriteFile(path, []byte(`[{"id": "CVE-2023-0001", "cpe": "openssh"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("Load() error = nil, want an error for the invalid cpe")
+	}
+}
@@ -0,0 +1,94 @@
+package vulns
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// preReleases are the suffixes that come before the release they're attached to, e.g. 2.0rc1 < 2.0
+var preReleases = []string{"dev", "alpha", "beta", "pre", "rc"}
+
+// CompareVersions compares two versions and returns -1, 0 or 1. Versions are split into runs of digits, compared
+// as numbers, and runs of letters, compared as text, so 8.9p1 < 9.3p2 and 1.1.1k > 1.1.1. A version with more
+// components is the later one, unless its next component is a pre-release like rc.
+func CompareVersions(a, b string) int {
+	as, bs := versionTokens(a), versionTokens(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := compareTokens(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(as) > len(bs):
+		if isPreRelease(as[len(bs)]) {
+			return -1
+		}
+		return 1
+	case len(as) < len(bs):
+		if isPreRelease(bs[len(as)]) {
+			return 1
+		}
+		return -1
+	}
+	return 0
+}
+
+// versionTokens splits a version into runs of digits and runs of letters, dropping separators
+func versionTokens(version string) []string {
+	var tokens []string
+	var current []rune
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, string(current))
+			current = nil
+		}
+	}
+
+	for _, r := range strings.ToLower(version) {
+		switch {
+		case !unicode.IsDigit(r) && !unicode.IsLetter(r):
+			flush()
+		case len(current) > 0 && unicode.IsDigit(r) != unicode.IsDigit(current[0]):
+			flush()
+			current = append(current, r)
+		default:
+			current = append(current, r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// compareTokens compares two components of a version. Numbers come after letters, so 1.0 > 1.rc
+func compareTokens(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareInts(an, bn)
+	case aErr == nil:
+		return 1
+	case bErr == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareInts compares two numbers
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// isPreRelease returns true if the component marks a pre-release
+func isPreRelease(token string) bool {
+	return slices.Contains(preReleases, token)
+}
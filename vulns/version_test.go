@@ -0,0 +1,43 @@
+package vulns
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"8.9p1", "8.9p1", 0},
+		{"8.9P1", "8.9p1", 0},
+		{"1.2.3", "1-2-3", 0},
+		{"8.9p1", "9.3p2", -1},
+		{"7.4p1", "7.4", 1},
+		{"7.4p1", "7.4p2", -1},
+		{"2.4.10", "2.4.9", 1},
+		{"1.0.1", "1.0", 1},
+		{"1.1.1k", "1.1.1", 1},
+		{"1.1.1k", "1.1.1l", -1},
+		{"1.0.2zb", "1.0.2z", 1},
+		{"2.0rc1", "2.0", -1},
+		{"2.0", "2.0rc1", 1},
+		{"2.0-RC1", "2.0", -1},
+		{"2.0rc1", "2.0rc2", -1},
+		{"2.0beta2", "2.0rc1", -1},
+		{"2.0alpha", "2.0beta", -1},
+		{"2.0dev", "2.0", -1},
+		{"2.0pre1", "2.0.1", -1},
+		{"1.0", "1.rc", 1},
+		{"", "", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.a+" vs "+test.b, func(t *testing.T) {
+			if got := CompareVersions(test.a, test.b); got != test.want {
+				t.Errorf("CompareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+			}
+			if got := CompareVersions(test.b, test.a); got != -test.want {
+				t.Errorf("CompareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+			}
+		})
+	}
+}